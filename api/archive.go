@@ -1,20 +1,61 @@
 package api
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/ssongin/tartarus/cmd/archive"
 )
 
 type Request struct {
-	InputPath     string   `json:"input"`
-	OutputPath    string   `json:"output"`
-	Passphrase    string   `json:"passphrase,omitempty"`
-	CompressLevel int      `json:"compression_level,omitempty"`
-	Filters       []string `json:"filters,omitempty"`
+	InputPath       string            `json:"input"`
+	OutputPath      string            `json:"output"`
+	Passphrase      string            `json:"passphrase,omitempty"`
+	CompressLevel   int               `json:"compression_level,omitempty"`
+	Codec           string            `json:"codec,omitempty"`
+	Format          string            `json:"format,omitempty"`
+	Indexed         bool              `json:"indexed,omitempty"`
+	Snapshot        bool              `json:"snapshot,omitempty"`
+	Base            string            `json:"base,omitempty"`
+	Chain           []string          `json:"chain,omitempty"`
+	Repository      string            `json:"repository,omitempty"`
+	SnapshotID      string            `json:"snapshot_id,omitempty"`
+	Snapshots       []string          `json:"snapshots,omitempty"`
+	VolumeSize      int64             `json:"volume_size,omitempty"`
+	Parity          int               `json:"parity,omitempty"`
+	ParitySidecar   bool              `json:"parity_sidecar,omitempty"`
+	Filters         []string          `json:"filters,omitempty"`
+	Rules           []string          `json:"rules,omitempty"`
+	IgnoreFiles     bool              `json:"ignore_files,omitempty"`
+	Prune           []string          `json:"prune,omitempty"`
+	FollowSymlinks  bool              `json:"follow_symlinks,omitempty"`
+	Reproducible    bool              `json:"reproducible,omitempty"`
+	Mtime           int64             `json:"mtime,omitempty"`
+	ClampMtime      bool              `json:"clamp_mtime,omitempty"`
+	TarFormat       string            `json:"tar_format,omitempty"`
+	KDF             string            `json:"kdf,omitempty"`
+	Recipients      []string          `json:"recipients,omitempty"`
+	Identities      []string          `json:"identities,omitempty"`
+	SigningKey      string            `json:"signing_key,omitempty"`
+	DetachedSig     bool              `json:"detached_signature,omitempty"`
+	TrustedKeys     []string          `json:"trusted_keys,omitempty"`
+	SignaturePath   string            `json:"signature,omitempty"`
+	UIDMap          map[int]int       `json:"uid_map,omitempty"`
+	GIDMap          map[int]int       `json:"gid_map,omitempty"`
+	Members         []string          `json:"members,omitempty"`
+	Include         []string          `json:"include,omitempty"`
+	Exclude         []string          `json:"exclude,omitempty"`
+	StripComponents int               `json:"strip_components,omitempty"`
+	Remap           map[string]string `json:"remap,omitempty"`
 }
 
 func GetArchiveRouter() *http.ServeMux {
@@ -26,7 +67,15 @@ func GetArchiveRouter() *http.ServeMux {
 	mux.HandleFunc("/encrypt", HandleEncrypt)
 	mux.HandleFunc("/decrypt", HandleDecrypt)
 	mux.HandleFunc("/archive", HandleArchive)
+	mux.HandleFunc("/preview", HandlePreview)
 	mux.HandleFunc("/extract", HandleExtract)
+	mux.HandleFunc("/restore", HandleRestore)
+	mux.HandleFunc("/list", HandleList)
+	mux.HandleFunc("/file", HandleFile)
+	mux.HandleFunc("/migrate", HandleMigrate)
+	mux.HandleFunc("/verify", HandleVerify)
+	mux.HandleFunc("/volumes", HandleVolumes)
+	mux.HandleFunc("/repair", HandleRepair)
 
 	return mux
 }
@@ -36,6 +85,252 @@ func writeError(w http.ResponseWriter, msg string, code int) {
 	http.Error(w, msg, code)
 }
 
+// writeExtractError reports members rejected for escaping the destination,
+// and damaged volumes, as a 422 naming them, and keys that do not open the
+// archive as a 401; anything else is a server error.
+func writeExtractError(w http.ResponseWriter, err error) {
+	var unsafe *archive.UnsafeEntriesError
+	var volumes *archive.VolumeError
+	if errors.Is(err, archive.ErrAuthentication) || errors.Is(err, archive.ErrPassphraseRequired) || errors.Is(err, archive.ErrNoIdentity) {
+		writeError(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, archive.ErrUnknownFormat) || errors.Is(err, archive.ErrUnsupportedArchive) {
+		writeError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if errors.As(err, &volumes) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{
+			"error":   volumes.Error(),
+			"volumes": volumes.Problems,
+		})
+		return
+	}
+	if !errors.As(err, &unsafe) {
+		writeError(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":    unsafe.Error(),
+		"rejected": unsafe.Members,
+	})
+}
+
+// writeArchiveError reports a failure to write an archive; conflicting keys
+// and entries the chosen tar format cannot hold are the client's to fix, and
+// files changing under a snapshot a conflict.
+func writeArchiveError(w http.ResponseWriter, err error) {
+	if errors.Is(err, archive.ErrAmbiguousKeys) {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	if errors.Is(err, archive.ErrUnrepresentable) {
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if errors.Is(err, archive.ErrFileChanged) {
+		writeError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeError(w, err.Error(), 500)
+}
+
+// openInput opens the archive at path, or the volume set of that name when
+// only its volumes exist.
+func openInput(path string) (io.ReadCloser, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		if _, err := os.Stat(archive.VolumeManifestName(path)); err == nil {
+			return archive.OpenVolumes(path)
+		}
+	}
+	return os.Open(path)
+}
+
+// tarOptions builds the tree walking options from the request filters.
+func tarOptions(req Request) (archive.TarOptions, error) {
+	patterns, where, err := archive.SplitFilters(req.Filters)
+	if err != nil {
+		return archive.TarOptions{}, err
+	}
+	opts := archive.TarOptions{
+		Filter:         archive.FilterFunc(patterns),
+		FollowSymlinks: req.FollowSymlinks,
+		IgnoreFiles:    req.IgnoreFiles,
+		Where:          where,
+	}
+	if len(req.Prune) > 0 {
+		opts.Select = archive.ExcludeTrees(req.Prune)
+	}
+	if len(req.Rules) > 0 {
+		rules, err := archive.ParseRules(req.Rules)
+		if err != nil {
+			return opts, err
+		}
+		opts.Rules = rules
+	}
+	if req.Reproducible {
+		opts.Reproducible = &archive.Reproducible{Clamp: req.ClampMtime}
+		if req.Mtime != 0 {
+			opts.Reproducible.ModTime = time.Unix(req.Mtime, 0)
+		}
+	}
+	if opts.Dialect, err = archive.ParseDialect(req.TarFormat); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// archiveOptions builds the pipeline options shared by the archiving handlers.
+func archiveOptions(req Request) (archive.ArchiveOptions, error) {
+	tarOpts, err := tarOptions(req)
+	if err != nil {
+		return archive.ArchiveOptions{}, err
+	}
+	opts := archive.ArchiveOptions{
+		Tar:           tarOpts,
+		Format:        archive.Format(req.Format),
+		Indexed:       req.Indexed,
+		Snapshot:      req.Snapshot,
+		Parity:        req.Parity,
+		CompressLevel: req.CompressLevel,
+		Codec:         requestCodec(req),
+		Passphrase:    []byte(req.Passphrase),
+	}
+	switch opts.Format {
+	case "", archive.FormatTar, archive.FormatZip:
+	default:
+		return opts, fmt.Errorf("unknown format %q", req.Format)
+	}
+	kdf, err := archive.ParseKDF(req.KDF)
+	if err != nil {
+		return opts, err
+	}
+	opts.KDF = kdf
+	for _, s := range req.Recipients {
+		recipient, err := archive.ParseX25519Recipient(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.Recipients = append(opts.Recipients, recipient)
+	}
+	if len(opts.Passphrase) > 0 && len(opts.Recipients) > 0 {
+		return opts, archive.ErrAmbiguousKeys
+	}
+	if req.SigningKey != "" {
+		if opts.SigningKey, err = archive.ParseSigningKey(req.SigningKey); err != nil {
+			return opts, err
+		}
+	}
+	if req.Base != "" {
+		if opts.Base, err = readBaseManifest(req); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// readBaseManifest reads the manifest of the snapshot archive named by
+// req.Base, opened with the request's keys.
+func readBaseManifest(req Request) (*archive.Manifest, error) {
+	keys, err := requestKeys(req)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(req.Base)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return archive.ReadManifest(f, keys)
+}
+
+// requestCodec returns the codec named by the request, archive.DefaultCodec
+// when there is none.
+func requestCodec(req Request) string {
+	if req.Codec == "" {
+		return archive.DefaultCodec
+	}
+	return req.Codec
+}
+
+// rawCodec is requestCodec for /compress and /decompress, which have always
+// written raw DEFLATE and keep it as their default.
+func rawCodec(req Request) string {
+	if req.Codec == "" {
+		return "flate"
+	}
+	return req.Codec
+}
+
+// requestKeys collects the passphrase and identities that may open an archive.
+func requestKeys(req Request) (archive.Keys, error) {
+	keys := archive.Keys{Passphrase: []byte(req.Passphrase)}
+	for _, s := range req.Identities {
+		id, err := archive.ParseX25519Identity(s)
+		if err != nil {
+			return keys, err
+		}
+		keys.Identities = append(keys.Identities, id)
+	}
+	return keys, nil
+}
+
+// trustedKeys parses the keys an archive signature must be made with.
+func trustedKeys(req Request) ([]ed25519.PublicKey, error) {
+	trusted := make([]ed25519.PublicKey, 0, len(req.TrustedKeys))
+	for _, s := range req.TrustedKeys {
+		key, err := archive.ParseSignerKey(s)
+		if err != nil {
+			return nil, err
+		}
+		trusted = append(trusted, key)
+	}
+	return trusted, nil
+}
+
+// errUnseekableInput is returned when a signature is to be checked on a
+// volume set, which can only be read front to back.
+var errUnseekableInput = errors.New("signatures can only be verified on a single archive file")
+
+// verifiedInput checks the signature of the archive in input against the
+// trusted keys, using the detached signature at sigPath if one is named,
+// and returns the archive bytes. Without trusted keys input is returned
+// as it is.
+func verifiedInput(input io.Reader, sigPath string, trusted []ed25519.PublicKey) (io.Reader, error) {
+	if len(trusted) == 0 {
+		return input, nil
+	}
+	rs, ok := input.(io.ReadSeeker)
+	if !ok {
+		return nil, errUnseekableInput
+	}
+	var detached []byte
+	if sigPath != "" {
+		var err error
+		if detached, err = os.ReadFile(sigPath); err != nil {
+			return nil, err
+		}
+	}
+	payload, _, err := archive.VerifyArchive(rs, detached, trusted)
+	return payload, err
+}
+
+// writeVerifyError reports a signature that does not check out as a 422.
+func writeVerifyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnseekableInput):
+		writeError(w, err.Error(), 400)
+	case errors.Is(err, archive.ErrUnsigned), errors.Is(err, archive.ErrBadSignature), errors.Is(err, archive.ErrUntrustedSigner):
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		writeError(w, err.Error(), 500)
+	}
+}
+
 func HandlePipeline(w http.ResponseWriter, r *http.Request) {
 	var req Request
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -44,20 +339,85 @@ func HandlePipeline(w http.ResponseWriter, r *http.Request) {
 	}
 	in := req.InputPath
 	out := req.OutputPath
-	pass := []byte(req.Passphrase)
-	filter := archive.FilterFunc(req.Filters)
-
-	outFile, err := os.Create(out)
+	opts, err := archiveOptions(req)
 	if err != nil {
-		writeError(w, "Failed to create output file", 500)
+		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer outFile.Close()
+	// Inline parity would be read back as archive data when the volumes
+	// are joined, so a volume set keeps its parity beside it.
+	if req.VolumeSize > 0 && req.Parity > 0 && !req.ParitySidecar {
+		writeError(w, "parity on a volume set needs parity_sidecar", http.StatusBadRequest)
+		return
+	}
+
+	// Whatever a failed run leaves behind is incomplete, and a detached
+	// signature or volume manifest would vouch for it, so it all goes.
+	failed := true
+	var partial []string
+	defer func() {
+		if failed {
+			for _, name := range partial {
+				os.Remove(name)
+			}
+		}
+	}()
+
+	var outFile io.WriteCloser
+	if req.VolumeSize > 0 {
+		volumes, err := archive.NewVolumeWriter(out, req.VolumeSize)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer func() {
+			if failed {
+				volumes.Abort()
+			}
+		}()
+		outFile = volumes
+	} else {
+		f, err := os.Create(out)
+		if err != nil {
+			writeError(w, "Failed to create output file", 500)
+			return
+		}
+		defer f.Close()
+		partial = append(partial, out)
+		outFile = f
+	}
+
+	if opts.SigningKey != nil && req.DetachedSig {
+		sigFile, err := os.Create(out + ".sig")
+		if err != nil {
+			writeError(w, "Failed to create signature file", 500)
+			return
+		}
+		defer sigFile.Close()
+		partial = append(partial, sigFile.Name())
+		opts.DetachedSignature = sigFile
+	}
+	if opts.Parity > 0 && req.ParitySidecar {
+		parFile, err := os.Create(out + ".par")
+		if err != nil {
+			writeError(w, "Failed to create parity file", 500)
+			return
+		}
+		defer parFile.Close()
+		partial = append(partial, parFile.Name())
+		opts.ParitySidecar = parFile
+	}
 
-	if err := archive.ArchiveAndCompressEncrypt(in, outFile, req.CompressLevel, pass, filter); err != nil {
+	if err := archive.Archive(in, outFile, opts); err != nil {
+		writeArchiveError(w, err)
+		return
+	}
+	// Closing a volume set writes its manifest.
+	if err := outFile.Close(); err != nil {
 		writeError(w, err.Error(), 500)
 		return
 	}
+	failed = false
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -81,7 +441,7 @@ func HandleCompress(w http.ResponseWriter, r *http.Request) {
 	}
 	defer outFile.Close()
 
-	writer, err := archive.CompressWriter(outFile, req.CompressLevel)
+	writer, err := archive.NewCompressWriter(outFile, rawCodec(req), req.CompressLevel)
 	if err != nil {
 		writeError(w, err.Error(), 500)
 		return
@@ -106,11 +466,12 @@ func HandleDecompress(w http.ResponseWriter, r *http.Request) {
 	}
 	defer inFile.Close()
 
-	reader, err := archive.DecompressReader(inFile)
+	reader, err := archive.NewDecompressReader(inFile, rawCodec(req))
 	if err != nil {
 		writeError(w, err.Error(), 500)
 		return
 	}
+	defer reader.Close()
 
 	outFile, err := os.Create(req.OutputPath)
 	if err != nil {
@@ -130,6 +491,12 @@ func HandleEncrypt(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "Invalid request", 400)
 		return
 	}
+	opts, err := archiveOptions(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+
 	inFile, err := os.Open(req.InputPath)
 	if err != nil {
 		writeError(w, err.Error(), 500)
@@ -144,9 +511,9 @@ func HandleEncrypt(w http.ResponseWriter, r *http.Request) {
 	}
 	defer outFile.Close()
 
-	writer, err := archive.EncryptWriterCTR_HMAC(outFile, []byte(req.Passphrase))
+	writer, err := opts.EncryptWriter(outFile)
 	if err != nil {
-		writeError(w, err.Error(), 500)
+		writeArchiveError(w, err)
 		return
 	}
 	defer writer.Close()
@@ -162,16 +529,22 @@ func HandleDecrypt(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "Invalid request", 400)
 		return
 	}
-	inFile, err := os.Open(req.InputPath)
+	inFile, err := openInput(req.InputPath)
 	if err != nil {
-		writeError(w, err.Error(), 500)
+		writeExtractError(w, err)
 		return
 	}
 	defer inFile.Close()
 
-	reader, err := archive.DecryptReaderCTR_HMAC(inFile, []byte(req.Passphrase))
+	keys, err := requestKeys(req)
 	if err != nil {
-		writeError(w, err.Error(), 500)
+		writeError(w, err.Error(), 400)
+		return
+	}
+
+	reader, err := archive.DecryptReader(inFile, keys)
+	if err != nil {
+		writeExtractError(w, err)
 		return
 	}
 
@@ -193,17 +566,67 @@ func HandleArchive(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "Invalid request", 400)
 		return
 	}
+	format := archive.Format(req.Format)
+	if format != "" && format != archive.FormatTar && format != archive.FormatZip {
+		writeError(w, fmt.Sprintf("unknown format %q", req.Format), 400)
+		return
+	}
+	tarOpts, err := tarOptions(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
 	outFile, err := os.Create(req.OutputPath)
-	filter := archive.FilterFunc(req.Filters)
 	if err != nil {
 		writeError(w, err.Error(), 500)
 		return
 	}
 	defer outFile.Close()
 
-	if err := archive.TarFolderFiltered(req.InputPath, outFile, filter); err != nil {
-		writeError(w, err.Error(), 500)
+	if format == archive.FormatZip {
+		opts := archive.ZipOptions{
+			Filter:         tarOpts.Filter,
+			FollowSymlinks: tarOpts.FollowSymlinks,
+			Rules:          tarOpts.Rules,
+			IgnoreFiles:    tarOpts.IgnoreFiles,
+			Select:         tarOpts.Select,
+			Where:          tarOpts.Where,
+			Level:          req.CompressLevel,
+		}
+		err = archive.ZipFolder(req.InputPath, outFile, opts)
+	} else {
+		err = archive.TarFolder(req.InputPath, outFile, tarOpts)
+	}
+	if err != nil {
+		writeArchiveError(w, err)
+	}
+}
+
+// HandlePreview walks the input with the pipeline's filters without writing
+// anything and reports what would be archived. Snapshots are previewed in
+// full, so a base is refused.
+func HandlePreview(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	if req.Base != "" {
+		writeError(w, "incremental snapshots cannot be previewed", 400)
+		return
+	}
+	opts, err := archiveOptions(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	var preview archive.Preview
+	opts.Tar.DryRun = &preview
+	if err := archive.Archive(req.InputPath, nil, opts); err != nil {
+		writeArchiveError(w, err)
+		return
 	}
+	writeJSON(w, preview)
 }
 
 func HandleExtract(w http.ResponseWriter, r *http.Request) {
@@ -212,14 +635,325 @@ func HandleExtract(w http.ResponseWriter, r *http.Request) {
 		writeError(w, "Invalid request", 400)
 		return
 	}
-	inFile, err := os.Open(req.InputPath)
+	inFile, err := openInput(req.InputPath)
+	if err != nil {
+		writeExtractError(w, err)
+		return
+	}
+	defer inFile.Close()
+
+	keys, err := requestKeys(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	if req.StripComponents < 0 {
+		writeError(w, "strip_components must not be negative", 400)
+		return
+	}
+	opts := archive.ExtractOptions{
+		UIDMap:          req.UIDMap,
+		GIDMap:          req.GIDMap,
+		Members:         req.Members,
+		Include:         req.Include,
+		Exclude:         req.Exclude,
+		StripComponents: req.StripComponents,
+		Remap:           req.Remap,
+	}
+	trusted, err := trustedKeys(req)
 	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	input, err := verifiedInput(inFile, req.SignaturePath, trusted)
+	if err != nil {
+		writeVerifyError(w, err)
+		return
+	}
+	if err := archive.Extract(input, req.OutputPath, keys, opts); err != nil {
+		writeExtractError(w, err)
+	}
+}
+
+// HandleRestore replays a full snapshot archive and the incremental or
+// differential archives listed after it in req.Chain into req.OutputPath.
+// With trusted keys every archive must be signed, either embedded or with
+// a detached signature beside it named as /pipeline writes them.
+func HandleRestore(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	if len(req.Chain) == 0 {
+		writeError(w, "chain must name at least one archive", 400)
+		return
+	}
+	keys, err := requestKeys(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	trusted, err := trustedKeys(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	inputs := make([]io.Reader, 0, len(req.Chain))
+	for _, name := range req.Chain {
+		f, err := openInput(name)
+		if err != nil {
+			writeExtractError(w, err)
+			return
+		}
+		defer f.Close()
+		sigPath := name + ".sig"
+		if _, err := os.Stat(sigPath); err != nil {
+			sigPath = ""
+		}
+		input, err := verifiedInput(f, sigPath, trusted)
+		if err != nil {
+			writeVerifyError(w, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		inputs = append(inputs, input)
+	}
+	opts := archive.ExtractOptions{UIDMap: req.UIDMap, GIDMap: req.GIDMap}
+	err = archive.RestoreChain(inputs, req.OutputPath, keys, opts)
+	if errors.Is(err, archive.ErrNoManifest) || errors.Is(err, archive.ErrBrokenChain) {
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		writeExtractError(w, err)
+	}
+}
+
+// HandleList returns the members of an archive as JSON without extracting it.
+func HandleList(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	keys, err := requestKeys(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	inFile, err := openInput(req.InputPath)
+	if err != nil {
+		writeExtractError(w, err)
+		return
+	}
+	defer inFile.Close()
+
+	members, err := archive.List(inFile, keys)
+	if err != nil {
+		writeExtractError(w, err)
+		return
+	}
+	if members == nil {
+		members = []archive.Member{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"members": members})
+}
+
+// HandleFile streams one member of an indexed archive, reading only the
+// blocks that hold it. The archive and member are named by the "archive" and
+// "member" query parameters; keys are passed in the X-Archive-Passphrase and
+// X-Archive-Identity headers so they stay out of URLs and access logs.
+func HandleFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	keys, err := requestKeys(Request{
+		Passphrase: r.Header.Get("X-Archive-Passphrase"),
+		Identities: r.Header.Values("X-Archive-Identity"),
+	})
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+
+	inFile, err := os.Open(query.Get("archive"))
+	if err != nil {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer inFile.Close()
+	info, err := inFile.Stat()
+	if err != nil {
+		writeError(w, err.Error(), 500)
+		return
+	}
+
+	ir, err := archive.OpenIndexed(inFile, info.Size(), keys)
+	switch {
+	case errors.Is(err, archive.ErrNotIndexed):
+		writeError(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	case errors.Is(err, archive.ErrAuthentication), errors.Is(err, archive.ErrPassphraseRequired), errors.Is(err, archive.ErrNoIdentity):
+		writeError(w, err.Error(), http.StatusUnauthorized)
+		return
+	case err != nil:
 		writeError(w, err.Error(), 500)
 		return
 	}
+
+	body, member, err := ir.Open(query.Get("member"))
+	if errors.Is(err, archive.ErrMemberNotFound) {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(member.Size, 10))
+	w.Header().Set("Last-Modified", member.ModTime.UTC().Format(http.TimeFormat))
+	if _, err := io.Copy(w, body); err != nil {
+		// The status is sent already; abort so the client sees a broken
+		// response instead of a short one.
+		log.Printf("file %s in %s: %v", query.Get("member"), query.Get("archive"), err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// HandleMigrate re-encrypts a legacy CTR-HMAC archive into the current format.
+func HandleMigrate(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	kdf, err := archive.ParseKDF(req.KDF)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	if info, err := os.Stat(req.InputPath); err != nil || !info.Mode().IsRegular() {
+		writeError(w, "input_path must name an archive file", 400)
+		return
+	}
+
+	err = archive.MigrateLegacyFile(req.InputPath, req.OutputPath, []byte(req.Passphrase), kdf)
+	switch {
+	case errors.Is(err, archive.ErrNotLegacy):
+		writeError(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, archive.ErrAuthentication):
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+	case err != nil:
+		writeError(w, err.Error(), 500)
+	}
+}
+
+// HandleVerify checks an archive signature against the trusted keys and
+// reports the signer.
+func HandleVerify(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	trusted, err := trustedKeys(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+
+	var detached []byte
+	if req.SignaturePath != "" {
+		var err error
+		if detached, err = os.ReadFile(req.SignaturePath); err != nil {
+			writeError(w, err.Error(), 500)
+			return
+		}
+	}
+
+	inFile, err := openInput(req.InputPath)
+	if err != nil {
+		writeExtractError(w, err)
+		return
+	}
 	defer inFile.Close()
+	rs, ok := inFile.(io.ReadSeeker)
+	if !ok {
+		writeError(w, errUnseekableInput.Error(), 400)
+		return
+	}
+
+	_, info, err := archive.VerifyArchive(rs, detached, trusted)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, archive.ErrUnsigned), errors.Is(err, archive.ErrBadSignature), errors.Is(err, archive.ErrUntrustedSigner):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "signer": info})
+	case err != nil:
+		writeError(w, err.Error(), 500)
+	default:
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// HandleVolumes checks every volume of the set named by req.InputPath and
+// reports the damaged ones.
+func HandleVolumes(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	m, err := archive.ReadVolumeManifest(req.InputPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = archive.VerifyVolumes(req.InputPath)
+	}
+	if err != nil {
+		writeExtractError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
 
-	if err := archive.UntarStream(inFile, req.OutputPath); err != nil {
+// HandleRepair rebuilds damaged parts of req.InputPath from its parity, found
+// in req.InputPath + ".par" when req.ParitySidecar is set, and reports what
+// it found and fixed. Volume sets are not repaired in place.
+func HandleRepair(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	if _, err := os.Stat(req.InputPath); errors.Is(err, fs.ErrNotExist) {
+		if _, err := os.Stat(archive.VolumeManifestName(req.InputPath)); err == nil {
+			writeError(w, "volume sets cannot be repaired; join the volumes first", 400)
+			return
+		}
+	}
+	var sidecar string
+	if req.ParitySidecar {
+		sidecar = req.InputPath + ".par"
+	}
+	report, err := archive.RepairArchive(req.InputPath, sidecar)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, archive.ErrNoParity):
+		writeError(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, archive.ErrUnrepairable):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "report": report})
+	case err != nil:
 		writeError(w, err.Error(), 500)
+	default:
+		json.NewEncoder(w).Encode(report)
 	}
 }
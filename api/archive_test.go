@@ -1,13 +1,23 @@
 package api
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/flate"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ssongin/tartarus/cmd/archive"
 )
 
 func setupTestDir(t *testing.T) (string, string) {
@@ -102,6 +112,13 @@ func TestCompressAndDecompress(t *testing.T) {
 	if string(data) != "root content" {
 		t.Fatalf("Expected root content, got %s", string(data))
 	}
+
+	// Without a codec both stay on raw DEFLATE, as they always have.
+	f := mustOpen(t, compressed)
+	defer f.Close()
+	if raw, err := io.ReadAll(flate.NewReader(f)); err != nil || string(raw) != "root content" {
+		t.Errorf("compressed output is not raw DEFLATE: %q, %v", raw, err)
+	}
 }
 
 func TestEncryptAndDecrypt(t *testing.T) {
@@ -183,3 +200,886 @@ func TestDecryptWithWrongPassphrase(t *testing.T) {
 		t.Fatal("Expected failure with wrong passphrase")
 	}
 }
+
+func TestExtractRejectsZipSlip(t *testing.T) {
+	_, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "evil.tar")
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../../evil.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("evil"))
+	tw.Close()
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rr := postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:  archivePath,
+		OutputPath: filepath.Join(outputDir, "extracted"),
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp struct {
+		Rejected []string `json:"rejected"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Rejected) != 1 || resp.Rejected[0] != "../../evil.txt" {
+		t.Fatalf("unexpected rejected list: %v", resp.Rejected)
+	}
+}
+
+func TestMigrateRejectsCurrentFormat(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	encrypted := filepath.Join(outputDir, "enc.aes")
+
+	rr := postJSON(t, HandleEncrypt, "/encrypt", Request{
+		InputPath:  filepath.Join(inputDir, "root.txt"),
+		OutputPath: encrypted,
+		Passphrase: "pass",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Encrypt failed: %s", rr.Body.String())
+	}
+
+	rr = postJSON(t, HandleMigrate, "/migrate", Request{
+		InputPath:  encrypted,
+		OutputPath: filepath.Join(outputDir, "migrated.aes"),
+		Passphrase: "pass",
+	})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for an already migrated archive, got %d", rr.Code)
+	}
+
+	rr = postJSON(t, HandleMigrate, "/migrate", Request{
+		InputPath:  outputDir,
+		OutputPath: filepath.Join(outputDir, "migrated.aes"),
+		Passphrase: "pass",
+	})
+	if rr.Code != 400 {
+		t.Errorf("expected 400 for a directory, got %d", rr.Code)
+	}
+}
+
+func TestEncryptToRecipients(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	encrypted := filepath.Join(outputDir, "enc.age")
+	decrypted := filepath.Join(outputDir, "dec.txt")
+	id, err := archive.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := postJSON(t, HandleEncrypt, "/encrypt", Request{
+		InputPath:  filepath.Join(inputDir, "root.txt"),
+		OutputPath: encrypted,
+		Recipients: []string{id.Recipient().String()},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Encrypt failed: %s", rr.Body.String())
+	}
+
+	rr = postJSON(t, HandleDecrypt, "/decrypt", Request{
+		InputPath:  encrypted,
+		OutputPath: decrypted,
+		Identities: []string{id.String()},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Decrypt failed: %s", rr.Body.String())
+	}
+
+	data, _ := os.ReadFile(decrypted)
+	if string(data) != "root content" {
+		t.Fatalf("Expected root content, got %s", string(data))
+	}
+
+	other, err := archive.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = postJSON(t, HandleDecrypt, "/decrypt", Request{
+		InputPath:  encrypted,
+		OutputPath: decrypted,
+		Identities: []string{other.String()},
+	})
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a non-matching identity, got %d", rr.Code)
+	}
+
+	rr = postJSON(t, HandleEncrypt, "/encrypt", Request{
+		InputPath:  filepath.Join(inputDir, "root.txt"),
+		OutputPath: filepath.Join(outputDir, "both.age"),
+		Passphrase: "pass",
+		Recipients: []string{id.Recipient().String()},
+	})
+	if rr.Code != 400 {
+		t.Fatalf("expected 400 for a passphrase and recipients, got %d", rr.Code)
+	}
+}
+
+func TestPipelineSignAndVerify(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	outputPath := filepath.Join(outputDir, "signed.pipeline")
+	key, err := archive.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := archive.EncodeSignerKey(key.Public().(ed25519.PublicKey))
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:   inputDir,
+		OutputPath:  outputPath,
+		Passphrase:  "p@ss",
+		SigningKey:  archive.EncodeSigningKey(key),
+		DetachedSig: true,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+
+	rr = postJSON(t, HandleVerify, "/verify", Request{
+		InputPath:     outputPath,
+		SignaturePath: outputPath + ".sig",
+		TrustedKeys:   []string{pub},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Verify failed: %s", rr.Body.String())
+	}
+	var info archive.SignatureInfo
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.PublicKey != pub || info.Embedded {
+		t.Fatalf("unexpected signer: %+v", info)
+	}
+
+	rr = postJSON(t, HandleVerify, "/verify", Request{
+		InputPath:   outputPath,
+		TrustedKeys: []string{pub},
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 without the detached signature, got %d", rr.Code)
+	}
+}
+
+func TestExtractChecksTrustedSigner(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	outputPath := filepath.Join(outputDir, "signed.pipeline")
+	key, err := archive.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := archive.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := archive.EncodeSignerKey(key.Public().(ed25519.PublicKey))
+	otherPub := archive.EncodeSignerKey(other.Public().(ed25519.PublicKey))
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:   inputDir,
+		OutputPath:  outputPath,
+		Passphrase:  "p@ss",
+		Snapshot:    true,
+		SigningKey:  archive.EncodeSigningKey(key),
+		DetachedSig: true,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+
+	untrusted := filepath.Join(outputDir, "untrusted")
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:     outputPath,
+		OutputPath:    untrusted,
+		Passphrase:    "p@ss",
+		SignaturePath: outputPath + ".sig",
+		TrustedKeys:   []string{otherPub},
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for an untrusted signer, got %d", rr.Code)
+	}
+	if _, err := os.Stat(untrusted); !os.IsNotExist(err) {
+		t.Fatalf("archive from an untrusted signer was extracted: %v", err)
+	}
+
+	extractDir := filepath.Join(outputDir, "extracted")
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:     outputPath,
+		OutputPath:    extractDir,
+		Passphrase:    "p@ss",
+		SignaturePath: outputPath + ".sig",
+		TrustedKeys:   []string{pub},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Extract failed: %s", rr.Body.String())
+	}
+	data, _ := os.ReadFile(filepath.Join(extractDir, "root.txt"))
+	if string(data) != "root content" {
+		t.Fatalf("Expected root content, got %s", string(data))
+	}
+
+	rr = postJSON(t, HandleRestore, "/restore", Request{
+		Chain:       []string{outputPath},
+		OutputPath:  filepath.Join(outputDir, "restored-untrusted"),
+		Passphrase:  "p@ss",
+		TrustedKeys: []string{otherPub},
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 restoring from an untrusted signer, got %d", rr.Code)
+	}
+	rr = postJSON(t, HandleRestore, "/restore", Request{
+		Chain:       []string{outputPath},
+		OutputPath:  filepath.Join(outputDir, "restored"),
+		Passphrase:  "p@ss",
+		TrustedKeys: []string{pub},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Restore failed: %s", rr.Body.String())
+	}
+}
+
+func TestPipelineFailureRemovesSignature(t *testing.T) {
+	_, outputDir := setupTestDir(t)
+	key, err := archive.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(outputDir, "failed.pipeline")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:   filepath.Join(outputDir, "missing"),
+		OutputPath:  outputPath,
+		Passphrase:  "p@ss",
+		SigningKey:  archive.EncodeSigningKey(key),
+		DetachedSig: true,
+	})
+	if rr.Code == 200 {
+		t.Fatal("pipeline of a missing directory succeeded")
+	}
+	if _, err := os.Stat(outputPath + ".sig"); !os.IsNotExist(err) {
+		t.Fatalf("failed pipeline left a signature: %v", err)
+	}
+}
+
+func TestExtractDetectsFormat(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "pipeline.bin")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Passphrase: "sniffed",
+		Codec:      "xz",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+
+	extractDir := filepath.Join(outputDir, "extracted")
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:  archivePath,
+		OutputPath: extractDir,
+		Passphrase: "sniffed",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Extract failed: %s", rr.Body.String())
+	}
+	data, _ := os.ReadFile(filepath.Join(extractDir, "nested", "nested.txt"))
+	if string(data) != "nested content" {
+		t.Fatalf("Expected nested content, got %s", string(data))
+	}
+
+	junkPath := filepath.Join(outputDir, "junk.bin")
+	os.WriteFile(junkPath, nil, 0644)
+	rr = postJSON(t, HandleExtract, "/extract", Request{InputPath: junkPath, OutputPath: extractDir})
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestArchiveAndExtractZip(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "archive.zip")
+	extractDir := filepath.Join(outputDir, "extracted")
+
+	rr := postJSON(t, HandleArchive, "/archive", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Format:     "zip",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Archive failed: %s", rr.Body.String())
+	}
+	data, _ := os.ReadFile(archivePath)
+	if !bytes.HasPrefix(data, []byte("PK")) {
+		t.Fatalf("output is not a zip archive")
+	}
+
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:  archivePath,
+		OutputPath: extractDir,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Extract failed: %s", rr.Body.String())
+	}
+	data, _ = os.ReadFile(filepath.Join(extractDir, "nested", "nested.txt"))
+	if string(data) != "nested content" {
+		t.Fatalf("Expected nested content, got %s", string(data))
+	}
+
+	rr = postJSON(t, HandleArchive, "/archive", Request{InputPath: inputDir, OutputPath: archivePath, Format: "rar"})
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown format, got %d", rr.Code)
+	}
+}
+
+func TestListArchive(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "archive.bin")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Passphrase: "listing",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+
+	rr = postJSON(t, HandleList, "/list", Request{InputPath: archivePath, Passphrase: "listing"})
+	if rr.Code != 200 {
+		t.Fatalf("List failed: %s", rr.Body.String())
+	}
+	var resp struct {
+		Members []archive.Member `json:"members"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]string{}
+	for _, m := range resp.Members {
+		names[m.Name] = m.Type
+	}
+	if names["nested/nested.txt"] != "file" || names["nested/"] != "dir" {
+		t.Fatalf("unexpected members: %v", names)
+	}
+
+	rr = postJSON(t, HandleList, "/list", Request{InputPath: archivePath, Passphrase: "wrong"})
+	if rr.Code == 200 {
+		t.Fatal("listing with the wrong passphrase succeeded")
+	}
+}
+
+func TestExtractSelectedMember(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "archive.bin")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Passphrase: "selective",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+
+	extractDir := filepath.Join(outputDir, "restore")
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:       archivePath,
+		OutputPath:      extractDir,
+		Passphrase:      "selective",
+		Members:         []string{"nested/nested.txt"},
+		StripComponents: 1,
+		Remap:           map[string]string{"nested.txt": "config/restored.txt"},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Extract failed: %s", rr.Body.String())
+	}
+	data, _ := os.ReadFile(filepath.Join(extractDir, "config", "restored.txt"))
+	if string(data) != "nested content" {
+		t.Fatalf("Expected nested content, got %s", string(data))
+	}
+	if _, err := os.Stat(filepath.Join(extractDir, "root.txt")); err == nil {
+		t.Fatal("root.txt should not have been extracted")
+	}
+}
+
+func TestReadIndexedMember(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "archive.idx")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Passphrase: "indexed",
+		Indexed:    true,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+
+	get := func(member, passphrase string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/file?archive="+archivePath+"&member="+member, nil)
+		req.Header.Set("X-Archive-Passphrase", passphrase)
+		rr := httptest.NewRecorder()
+		HandleFile(rr, req)
+		return rr
+	}
+
+	rr = get("nested/nested.txt", "indexed")
+	if rr.Code != 200 || rr.Body.String() != "nested content" {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr = get("nested/missing.txt", "indexed"); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rr.Code)
+	}
+	if rr = get("root.txt", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+
+	// A member that cannot be sent in full must abort the response rather
+	// than end it as if it were complete.
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("failed copy: recovered %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	req := httptest.NewRequest(http.MethodGet, "/file?archive="+archivePath+"&member=root.txt", nil)
+	req.Header.Set("X-Archive-Passphrase", "indexed")
+	HandleFile(failingWriter{httptest.NewRecorder()}, req)
+}
+
+// failingWriter is a response whose body cannot be written.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestIncrementalPipelineAndRestore(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	fullPath := filepath.Join(outputDir, "full.bin")
+	incrPath := filepath.Join(outputDir, "incr.bin")
+	restoreDir := filepath.Join(outputDir, "restored")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: fullPath,
+		Passphrase: "nightly",
+		Snapshot:   true,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Full backup failed: %s", rr.Body.String())
+	}
+
+	os.Remove(filepath.Join(inputDir, "root.txt"))
+	os.WriteFile(filepath.Join(inputDir, "new.txt"), []byte("new content"), 0644)
+	rr = postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: incrPath,
+		Passphrase: "nightly",
+		Base:       fullPath,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Incremental backup failed: %s", rr.Body.String())
+	}
+
+	rr = postJSON(t, HandleRestore, "/restore", Request{
+		Chain:      []string{incrPath},
+		OutputPath: restoreDir,
+		Passphrase: "nightly",
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Restore without full backup: got %d", rr.Code)
+	}
+
+	rr = postJSON(t, HandleRestore, "/restore", Request{
+		Chain:      []string{fullPath, incrPath},
+		OutputPath: restoreDir,
+		Passphrase: "nightly",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Restore failed: %s", rr.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(restoreDir, "root.txt")); err == nil {
+		t.Error("deleted file was restored")
+	}
+	for name, want := range map[string]string{"new.txt": "new content", "nested/nested.txt": "nested content"} {
+		data, err := os.ReadFile(filepath.Join(restoreDir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v", name, data, err)
+		}
+	}
+}
+
+func TestPipelineVolumes(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	os.WriteFile(filepath.Join(inputDir, "big.bin"), big, 0644)
+	archivePath := filepath.Join(outputDir, "archive.bin")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Passphrase: "split",
+		Codec:      "flate",
+		VolumeSize: 1024,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+	if _, err := os.Stat(archivePath + ".002"); err != nil {
+		t.Fatalf("expected several volumes: %v", err)
+	}
+
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:  archivePath,
+		OutputPath: filepath.Join(outputDir, "extracted"),
+		Passphrase: "split",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Extract failed: %s", rr.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(outputDir, "extracted", "big.bin")); !bytes.Equal(data, big) {
+		t.Error("big.bin does not match")
+	}
+
+	f, err := os.OpenFile(archivePath+".002", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, 10)
+	f.WriteAt([]byte{b[0] ^ 1}, 10)
+	f.Close()
+	rr = postJSON(t, HandleVolumes, "/volumes", Request{InputPath: archivePath})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Volumes: got %d %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Volumes []archive.VolumeProblem `json:"volumes"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || len(resp.Volumes) != 1 || resp.Volumes[0].Volume != 2 {
+		t.Errorf("Volumes = %+v, %v", resp, err)
+	}
+
+	rr = postJSON(t, HandleVerify, "/verify", Request{InputPath: archivePath})
+	if rr.Code != 400 {
+		t.Errorf("Verify of a volume set: got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPipelineVolumesParity(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "archive.bin")
+	req := Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Passphrase: "split",
+		VolumeSize: 1024,
+		Parity:     10,
+	}
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", req)
+	if rr.Code != 400 {
+		t.Fatalf("inline parity on volumes: got %d %s", rr.Code, rr.Body.String())
+	}
+	if left, _ := filepath.Glob(archivePath + "*"); len(left) != 0 {
+		t.Errorf("rejected pipeline left %v", left)
+	}
+
+	req.ParitySidecar = true
+	rr = postJSON(t, HandlePipeline, "/pipeline", req)
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:  archivePath,
+		OutputPath: filepath.Join(outputDir, "extracted"),
+		Passphrase: "split",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Extract failed: %s", rr.Body.String())
+	}
+
+	rr = postJSON(t, HandleRepair, "/repair", Request{InputPath: archivePath, ParitySidecar: true})
+	if rr.Code != 400 {
+		t.Errorf("Repair of a volume set: got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPipelineFailureRemovesVolumes(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	big := make([]byte, 256<<10)
+	rand.Read(big)
+	os.WriteFile(filepath.Join(inputDir, "big.bin"), big, 0644)
+	// USTAR cannot store this name, so the run fails after big.bin.
+	os.WriteFile(filepath.Join(inputDir, "zz-é.txt"), []byte("late"), 0644)
+	archivePath := filepath.Join(outputDir, "archive.bin")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Passphrase: "split",
+		VolumeSize: 16 << 10,
+		TarFormat:  "ustar",
+	})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Pipeline: got %d %s", rr.Code, rr.Body.String())
+	}
+	if left, _ := filepath.Glob(archivePath + "*"); len(left) != 0 {
+		t.Errorf("failed pipeline left %v", left)
+	}
+}
+
+func TestPipelineParityRepair(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	archivePath := filepath.Join(outputDir, "archive.bin")
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+		InputPath:     inputDir,
+		OutputPath:    archivePath,
+		Passphrase:    "parity",
+		Parity:        10,
+		ParitySidecar: true,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Pipeline failed: %s", rr.Body.String())
+	}
+	f, err := os.OpenFile(archivePath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("XXXX"), 60)
+	f.Close()
+
+	rr = postJSON(t, HandleRepair, "/repair", Request{InputPath: archivePath, ParitySidecar: true})
+	if rr.Code != 200 {
+		t.Fatalf("Repair failed: %s", rr.Body.String())
+	}
+	var report archive.RepairReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil || report.Repaired != 1 {
+		t.Errorf("report = %+v, %v", report, err)
+	}
+
+	rr = postJSON(t, HandleExtract, "/extract", Request{
+		InputPath:  archivePath,
+		OutputPath: filepath.Join(outputDir, "extracted"),
+		Passphrase: "parity",
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Extract after repair failed: %s", rr.Body.String())
+	}
+
+	rr = postJSON(t, HandleRepair, "/repair", Request{InputPath: archivePath})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Repair without parity: got %d", rr.Code)
+	}
+}
+
+func TestArchiveWithIgnoreRules(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	os.WriteFile(filepath.Join(inputDir, "debug.log"), []byte("log"), 0644)
+	os.WriteFile(filepath.Join(inputDir, "nested", archive.IgnoreFileName), []byte("*.txt\n"), 0644)
+	archivePath := filepath.Join(outputDir, "archive.tar")
+
+	rr := postJSON(t, HandleArchive, "/archive", Request{
+		InputPath:   inputDir,
+		OutputPath:  archivePath,
+		Rules:       []string{"*.log"},
+		IgnoreFiles: true,
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Archive failed: %s", rr.Body.String())
+	}
+	rr = postJSON(t, HandleList, "/list", Request{InputPath: archivePath})
+	var resp struct {
+		Members []archive.Member `json:"members"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, m := range resp.Members {
+		names[m.Name] = true
+	}
+	if !names["root.txt"] || names["debug.log"] || names["nested/nested.txt"] {
+		t.Errorf("archived %v", names)
+	}
+
+	rr = postJSON(t, HandleArchive, "/archive", Request{InputPath: inputDir, OutputPath: archivePath, Prune: []string{"nested"}})
+	if rr.Code != 200 {
+		t.Fatalf("Archive failed: %s", rr.Body.String())
+	}
+	members, err := archive.List(mustOpen(t, archivePath), archive.Keys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range members {
+		if strings.HasPrefix(m.Name, "nested") {
+			t.Errorf("pruned directory archived: %s", m.Name)
+		}
+	}
+
+	rr = postJSON(t, HandleArchive, "/archive", Request{InputPath: inputDir, OutputPath: archivePath, Rules: []string{"[bad"}})
+	if rr.Code != 400 {
+		t.Errorf("invalid rule: got %d", rr.Code)
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestArchiveWithPredicateFilters(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	os.WriteFile(filepath.Join(inputDir, "big.txt"), make([]byte, 8192), 0644)
+	archivePath := filepath.Join(outputDir, "archive.tar")
+
+	rr := postJSON(t, HandleArchive, "/archive", Request{
+		InputPath:  inputDir,
+		OutputPath: archivePath,
+		Filters:    []string{"*.txt", "size < 4K and mtime > 1d", `{"not": {"type": "symlink"}}`},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Archive failed: %s", rr.Body.String())
+	}
+	members, err := archive.List(mustOpen(t, archivePath), archive.Keys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, m := range members {
+		names[m.Name] = true
+	}
+	if !names["root.txt"] || names["big.txt"] {
+		t.Errorf("archived %v", names)
+	}
+
+	rr = postJSON(t, HandleArchive, "/archive", Request{InputPath: inputDir, OutputPath: archivePath, Filters: []string{"size < lots"}})
+	if rr.Code != 400 {
+		t.Errorf("bad predicate: got %d", rr.Code)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	os.WriteFile(filepath.Join(inputDir, "debug.log"), bytes.Repeat([]byte("line\n"), 20000), 0644)
+	os.WriteFile(filepath.Join(inputDir, "keep.log"), []byte("kept"), 0644)
+
+	rr := postJSON(t, HandlePreview, "/preview", Request{
+		InputPath:     inputDir,
+		OutputPath:    filepath.Join(outputDir, "unused.tar.gz.enc"),
+		Passphrase:    "secret",
+		CompressLevel: 6,
+		Rules:         []string{"*.log", "!keep.log"},
+		Prune:         []string{"nested"},
+	})
+	if rr.Code != 200 {
+		t.Fatalf("Preview failed: %s", rr.Body.String())
+	}
+	var preview archive.Preview
+	if err := json.NewDecoder(rr.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	decided := map[string]string{}
+	for _, e := range preview.Excluded {
+		decided[e.Path] = e.DecidedBy
+	}
+	if decided["debug.log"] != "*.log" || decided["nested"] != "select" {
+		t.Errorf("excluded %+v", preview.Excluded)
+	}
+	included := map[string]string{}
+	for _, e := range preview.Included {
+		included[e.Path] = e.DecidedBy
+	}
+	if by, ok := included["keep.log"]; !ok || by != "!keep.log" {
+		t.Errorf("included %+v", preview.Included)
+	}
+	if preview.Files != 2 || preview.TotalBytes != int64(len("root content")+len("kept")) {
+		t.Errorf("files = %d, bytes = %d", preview.Files, preview.TotalBytes)
+	}
+	if preview.EstimatedSize <= 0 {
+		t.Errorf("estimated size = %d", preview.EstimatedSize)
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "unused.tar.gz.enc")); !os.IsNotExist(err) {
+		t.Error("preview wrote output")
+	}
+
+	rr = postJSON(t, HandlePreview, "/preview", Request{InputPath: inputDir, Snapshot: true, Base: filepath.Join(outputDir, "base.bin")})
+	if rr.Code != 400 {
+		t.Errorf("Preview with a base: got %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestPipelineReproducible(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	plain := func(name string) []byte {
+		out := filepath.Join(outputDir, name)
+		rr := postJSON(t, HandlePipeline, "/pipeline", Request{
+			InputPath:    inputDir,
+			OutputPath:   out,
+			Passphrase:   "secret",
+			Reproducible: true,
+			Mtime:        1700000000,
+			TarFormat:    "pax",
+		})
+		if rr.Code != 200 {
+			t.Fatalf("Pipeline failed: %s", rr.Body.String())
+		}
+		dec, err := archive.DecryptReader(mustOpen(t, out), archive.Keys{Passphrase: []byte("secret")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(dec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	first := plain("first.enc")
+	os.Chtimes(filepath.Join(inputDir, "root.txt"), time.Now(), time.Now())
+	if !bytes.Equal(first, plain("second.enc")) {
+		t.Error("decrypted streams differ")
+	}
+
+	rr := postJSON(t, HandlePipeline, "/pipeline", Request{InputPath: inputDir, OutputPath: filepath.Join(outputDir, "x"), TarFormat: "v7"})
+	if rr.Code != 400 {
+		t.Errorf("unknown tar format: got %d", rr.Code)
+	}
+}
+
+func TestArchiveTarFormat(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	os.WriteFile(filepath.Join(inputDir, strings.Repeat("x", 120)), []byte("long"), 0644)
+	archivePath := filepath.Join(outputDir, "archive.tar")
+
+	rr := postJSON(t, HandleArchive, "/archive", Request{InputPath: inputDir, OutputPath: archivePath, TarFormat: "ustar"})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("USTAR long name: got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = postJSON(t, HandleArchive, "/archive", Request{InputPath: inputDir, OutputPath: archivePath, TarFormat: "gnu"})
+	if rr.Code != 200 {
+		t.Fatalf("Archive failed: %s", rr.Body.String())
+	}
+	rr = postJSON(t, HandleExtract, "/extract", Request{InputPath: archivePath, OutputPath: filepath.Join(outputDir, "out")})
+	if rr.Code != 200 {
+		t.Fatalf("Extract failed: %s", rr.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "out", strings.Repeat("x", 120))); err != nil {
+		t.Error(err)
+	}
+}
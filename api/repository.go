@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ssongin/tartarus/cmd/archive"
+)
+
+func GetRepositoryRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/init", HandleRepoInit)
+	mux.HandleFunc("/backup", HandleRepoBackup)
+	mux.HandleFunc("/snapshots", HandleRepoSnapshots)
+	mux.HandleFunc("/restore", HandleRepoRestore)
+	mux.HandleFunc("/forget", HandleRepoForget)
+	mux.HandleFunc("/prune", HandleRepoPrune)
+
+	return mux
+}
+
+// writeRepositoryError maps repository errors to status codes.
+func writeRepositoryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, archive.ErrNotRepository), errors.Is(err, archive.ErrSnapshotNotFound):
+		writeError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, archive.ErrRepositoryLocked), errors.Is(err, archive.ErrRepositoryExists):
+		writeError(w, err.Error(), http.StatusConflict)
+	default:
+		writeExtractError(w, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// openRepository decodes the request and opens the repository it names,
+// reporting any failure to the client.
+func openRepository(w http.ResponseWriter, r *http.Request) (Request, *archive.Repository, bool) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return req, nil, false
+	}
+	keys, err := requestKeys(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return req, nil, false
+	}
+	repo, err := archive.OpenRepository(req.Repository, keys)
+	if err != nil {
+		writeRepositoryError(w, err)
+		return req, nil, false
+	}
+	return req, repo, true
+}
+
+// HandleRepoInit creates a repository protected by the request's passphrase
+// or recipients.
+func HandleRepoInit(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "Invalid request", 400)
+		return
+	}
+	opts, err := archiveOptions(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	codec, err := archive.LookupCodec(opts.Codec)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	if codec.NewWriter == nil {
+		writeError(w, fmt.Sprintf("codec %s cannot compress", codec.Name), 400)
+		return
+	}
+	_, err = archive.InitRepository(req.Repository, archive.RepositoryOptions{
+		Codec:         opts.Codec,
+		CompressLevel: opts.CompressLevel,
+		Passphrase:    opts.Passphrase,
+		KDF:           opts.KDF,
+		Recipients:    opts.Recipients,
+	})
+	if err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleRepoBackup stores req.InputPath as a new snapshot.
+func HandleRepoBackup(w http.ResponseWriter, r *http.Request) {
+	req, repo, ok := openRepository(w, r)
+	if !ok {
+		return
+	}
+	opts, err := tarOptions(req)
+	if err != nil {
+		writeError(w, err.Error(), 400)
+		return
+	}
+	snap, err := repo.Backup(req.InputPath, opts)
+	if err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	writeJSON(w, snap)
+}
+
+// HandleRepoSnapshots lists the snapshots of a repository.
+func HandleRepoSnapshots(w http.ResponseWriter, r *http.Request) {
+	_, repo, ok := openRepository(w, r)
+	if !ok {
+		return
+	}
+	snaps, err := repo.Snapshots()
+	if err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	if snaps == nil {
+		snaps = []archive.RepoSnapshot{}
+	}
+	writeJSON(w, map[string]any{"snapshots": snaps})
+}
+
+// HandleRepoRestore writes snapshot req.SnapshotID to req.OutputPath.
+func HandleRepoRestore(w http.ResponseWriter, r *http.Request) {
+	req, repo, ok := openRepository(w, r)
+	if !ok {
+		return
+	}
+	if req.StripComponents < 0 {
+		writeError(w, "strip_components must not be negative", 400)
+		return
+	}
+	opts := archive.ExtractOptions{
+		UIDMap:          req.UIDMap,
+		GIDMap:          req.GIDMap,
+		Members:         req.Members,
+		Include:         req.Include,
+		Exclude:         req.Exclude,
+		StripComponents: req.StripComponents,
+		Remap:           req.Remap,
+	}
+	if err := repo.Restore(req.SnapshotID, req.OutputPath, opts); err != nil {
+		writeRepositoryError(w, err)
+	}
+}
+
+// HandleRepoForget removes the snapshots in req.Snapshots.
+func HandleRepoForget(w http.ResponseWriter, r *http.Request) {
+	req, repo, ok := openRepository(w, r)
+	if !ok {
+		return
+	}
+	if len(req.Snapshots) == 0 {
+		writeError(w, "snapshots must name at least one snapshot", 400)
+		return
+	}
+	if err := repo.Forget(req.Snapshots...); err != nil {
+		writeRepositoryError(w, err)
+	}
+}
+
+// HandleRepoPrune deletes chunks no snapshot refers to any more.
+func HandleRepoPrune(w http.ResponseWriter, r *http.Request) {
+	_, repo, ok := openRepository(w, r)
+	if !ok {
+		return
+	}
+	stats, err := repo.Prune()
+	if err != nil {
+		writeRepositoryError(w, err)
+		return
+	}
+	writeJSON(w, stats)
+}
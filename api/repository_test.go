@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ssongin/tartarus/cmd/archive"
+)
+
+func TestRepositoryLifecycle(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	repoDir := filepath.Join(outputDir, "repo")
+	restoreDir := filepath.Join(outputDir, "restored")
+	base := Request{Repository: repoDir, Passphrase: "repo-secret"}
+
+	if rr := postJSON(t, HandleRepoInit, "/init", base); rr.Code != http.StatusCreated {
+		t.Fatalf("Init failed: %d %s", rr.Code, rr.Body.String())
+	}
+
+	var ids []string
+	for i := 0; i < 2; i++ {
+		req := base
+		req.InputPath = inputDir
+		rr := postJSON(t, HandleRepoBackup, "/backup", req)
+		if rr.Code != 200 {
+			t.Fatalf("Backup failed: %s", rr.Body.String())
+		}
+		var snap archive.RepoSnapshot
+		if err := json.NewDecoder(rr.Body).Decode(&snap); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && snap.Added != 0 {
+			t.Errorf("unchanged backup added %d bytes", snap.Added)
+		}
+		ids = append(ids, snap.ID)
+	}
+
+	rr := postJSON(t, HandleRepoSnapshots, "/snapshots", base)
+	var listing struct {
+		Snapshots []archive.RepoSnapshot `json:"snapshots"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&listing); err != nil || len(listing.Snapshots) != 2 {
+		t.Fatalf("Snapshots = %+v, %v", listing, err)
+	}
+
+	forget := base
+	forget.Snapshots = ids[:1]
+	if rr := postJSON(t, HandleRepoForget, "/forget", forget); rr.Code != 200 {
+		t.Fatalf("Forget failed: %s", rr.Body.String())
+	}
+	if rr := postJSON(t, HandleRepoPrune, "/prune", base); rr.Code != 200 {
+		t.Fatalf("Prune failed: %s", rr.Body.String())
+	}
+
+	restore := base
+	restore.SnapshotID = ids[0]
+	restore.OutputPath = restoreDir
+	if rr := postJSON(t, HandleRepoRestore, "/restore", restore); rr.Code != http.StatusNotFound {
+		t.Errorf("Restoring forgotten snapshot: got %d", rr.Code)
+	}
+	restore.SnapshotID = ids[1]
+	if rr := postJSON(t, HandleRepoRestore, "/restore", restore); rr.Code != 200 {
+		t.Fatalf("Restore failed: %s", rr.Body.String())
+	}
+	data, err := os.ReadFile(filepath.Join(restoreDir, "nested", "nested.txt"))
+	if err != nil || string(data) != "nested content" {
+		t.Errorf("nested.txt = %q, %v", data, err)
+	}
+
+	wrong := base
+	wrong.Passphrase = "wrong"
+	if rr := postJSON(t, HandleRepoSnapshots, "/snapshots", wrong); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong passphrase: got %d", rr.Code)
+	}
+}
+
+func TestRepositoryConflicts(t *testing.T) {
+	inputDir, outputDir := setupTestDir(t)
+	repoDir := filepath.Join(outputDir, "repo")
+	base := Request{Repository: repoDir, Passphrase: "repo-secret"}
+
+	if rr := postJSON(t, HandleRepoInit, "/init", base); rr.Code != http.StatusCreated {
+		t.Fatalf("Init failed: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(t, HandleRepoInit, "/init", base); rr.Code != http.StatusConflict {
+		t.Errorf("Init over a repository: got %d %s", rr.Code, rr.Body.String())
+	}
+	other := base
+	other.Repository = filepath.Join(outputDir, "other")
+	other.Codec = "nope"
+	if rr := postJSON(t, HandleRepoInit, "/init", other); rr.Code != 400 {
+		t.Errorf("Init with an unknown codec: got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// A prune in progress holds the exclusive lock.
+	if err := os.WriteFile(filepath.Join(repoDir, "locks", "exclusive"), []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backup := base
+	backup.InputPath = inputDir
+	if rr := postJSON(t, HandleRepoBackup, "/backup", backup); rr.Code != http.StatusConflict {
+		t.Errorf("Backup during a prune: got %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -2,75 +2,456 @@ package archive
 
 import (
 	"archive/tar"
+	"compress/flate"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 )
 
+// TarOptions controls how TarFolder walks and records a source tree.
+type TarOptions struct {
+	// Filter selects relative paths to archive; nil archives everything.
+	Filter func(string) bool
+	// FollowSymlinks archives what symlinks point to instead of the links.
+	FollowSymlinks bool
+	// Rules exclude paths with .gitignore semantics, after Filter.
+	Rules *Rules
+	// IgnoreFiles applies the rules in IgnoreFileName files found while
+	// walking to the directory they are in, after Rules.
+	IgnoreFiles bool
+	// Select decides per path, after Filter; nil includes everything.
+	// Directories excluded by Rules or with ExcludeTree are not walked.
+	Select func(relPath string, isDir bool) Verdict
+	// Where selects files, but not directories, by their attributes once
+	// they are stat'ed; nil includes everything.
+	Where Predicate
+	// DryRun walks the tree with the same filters but only fills in the
+	// preview; nothing is written.
+	DryRun *Preview
+	// Reproducible normalizes the headers so that the same tree always
+	// gives the same stream; nil stores metadata as found.
+	Reproducible *Reproducible
+	// Dialect is the tar format every header is written in; see
+	// ParseDialect. Entries it cannot represent fail with
+	// ErrUnrepresentable.
+	Dialect tar.Format
+}
+
+// Verdict is what a filter decides about a path.
+type Verdict int
+
+const (
+	Include Verdict = iota
+	// Exclude skips the entry but still walks a directory's contents.
+	Exclude
+	// ExcludeTree skips a directory and everything below it.
+	ExcludeTree
+)
+
+// ExcludeTrees returns a Select function that prunes directories matching
+// any of the patterns, compared like FilterFunc patterns.
+func ExcludeTrees(patterns []string) func(string, bool) Verdict {
+	match := FilterFunc(patterns)
+	return func(relPath string, isDir bool) Verdict {
+		if len(patterns) > 0 && isDir && match(relPath) {
+			return ExcludeTree
+		}
+		return Include
+	}
+}
+
+// TarFolderFiltered is TarFolder with only a filter. For a dry run, call
+// TarFolder with TarOptions.DryRun.
 func TarFolderFiltered(src string, w io.Writer, filter func(string) bool) error {
+	return TarFolder(src, w, TarOptions{Filter: filter})
+}
+
+// TarFolder writes the tree below src to w as a tar stream. Symlinks are
+// stored with their targets, files sharing an inode are stored once and
+// referenced by later hardlink entries, and FIFOs and device nodes are kept
+// as special entries. Sockets cannot be represented and are skipped.
+func TarFolder(src string, w io.Writer, opts TarOptions) error {
+	if opts.DryRun != nil {
+		return opts.DryRun.collect(src, opts, DefaultCodec, flate.DefaultCompression)
+	}
 	tw := tar.NewWriter(w)
 	defer tw.Close()
 
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+	return newTreeWalker(tarEntryWriter{tw, w, opts.Reproducible != nil}, opts).run(src)
+}
+
+// tarEntryWriter stores walked entries in a tar stream. raw is the writer
+// under tw, for the headers archive/tar cannot write. dense stores files
+// with holes whole, as reproducible archives do: where the holes are
+// depends on the file system, not on the content.
+type tarEntryWriter struct {
+	tw    *tar.Writer
+	raw   io.Writer
+	dense bool
+}
+
+func (t tarEntryWriter) writeEntry(hdr *tar.Header, path string) error {
+	return t.writeFile(hdr, path, nil)
+}
+
+// writeFile is writeEntry that also passes the data of a regular file to
+// digest, when set, as it is stored.
+func (t tarEntryWriter) writeFile(hdr *tar.Header, path string, digest io.Writer) error {
+	if hdr.Typeflag != tar.TypeReg {
+		return t.tw.WriteHeader(hdr)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if hdr.Size > 0 && !t.dense && canWriteSparse(hdr.Format) {
+		regions, err := dataRegions(f, hdr.Size)
+		if err != nil {
+			return err
+		}
+		if regions != nil {
+			return t.writeSparse(hdr, f, regions, digest)
+		}
+	}
+	var body io.Reader = f
+	if digest != nil {
+		body = io.TeeReader(f, digest)
+	}
+	return t.writeBody(hdr, body)
+}
+
+// writeBody stores a member whose data does not come from the tree.
+func (t tarEntryWriter) writeBody(hdr *tar.Header, body io.Reader) error {
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.tw, body)
+	return err
+}
+
+// paxXattrPrefix marks PAX records carrying extended attributes, the same
+// convention GNU tar and bsdtar use.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// addXattrs records the extended attributes of path as PAX records.
+func addXattrs(hdr *tar.Header, path string) error {
+	attrs, err := readXattrs(path)
+	if err != nil || len(attrs) == 0 {
+		return err
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = make(map[string]string)
+	}
+	for name, value := range attrs {
+		hdr.PAXRecords[paxXattrPrefix+name] = value
+	}
+	return nil
+}
+
+// entryWriter receives the entries found by a treeWalker. path names the
+// file on disk the entry was made from.
+type entryWriter interface {
+	writeEntry(hdr *tar.Header, path string) error
+}
+
+// treeWalker turns a source tree into tar headers for an entryWriter, so
+// that every archive format sees the same filtering and link handling.
+type treeWalker struct {
+	out     entryWriter
+	opts    TarOptions
+	links   map[fileID]string // first archived name per hardlinked inode
+	ignores map[string]*Rules // ignore file rules per directory
+	descent []os.FileInfo     // symlinked directories being walked
+	skipped skipStats
+	preview *Preview  // set for dry runs, which bypass out
+	epoch   time.Time // modification time for reproducible output
+}
+
+// skipStats counts what the filters left out.
+type skipStats struct {
+	files, dirs, pruned int
+}
+
+func newTreeWalker(out entryWriter, opts TarOptions) *treeWalker {
+	return &treeWalker{
+		out:     out,
+		opts:    opts,
+		links:   make(map[fileID]string),
+		ignores: make(map[string]*Rules),
+		preview: opts.DryRun,
+	}
+}
+
+// run archives the contents of src and reports what the filters skipped.
+func (t *treeWalker) run(src string) error {
+	if r := t.opts.Reproducible; r != nil {
+		epoch, err := r.modTime()
+		if err != nil {
+			return err
+		}
+		t.epoch = epoch
+	}
+	err := t.walk(src, "")
+	if s := t.skipped; s != (skipStats{}) {
+		slog.Info("Skipped filtered entries", "files", s.files, "dirs", s.dirs, "pruned_dirs", s.pruned)
+	}
+	return err
+}
+
+// walk archives the contents of dir, naming entries relative to prefix.
+// Entries are only stat'ed once the filters have included them.
+func (t *treeWalker) walk(dir, prefix string) error {
+	if err := t.loadIgnoreFile(dir, prefix); err != nil {
+		return err
+	}
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if path == src {
+		if path == dir {
 			return nil // skip the root directory itself
 		}
 
-		relPath, err := filepath.Rel(src, path)
+		relPath, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
-		relPath = filepath.ToSlash(relPath) // Normalize to forward slashes
+		relPath = filepath.ToSlash(filepath.Join(prefix, relPath)) // Normalize to forward slashes
 
-		if filter != nil && !filter(relPath) {
-			if info.Mode().IsRegular() {
-				slog.Info("Skipping file: " + relPath)
-				return nil // skip file
+		verdict, rule := t.verdict(relPath, d.IsDir())
+		if verdict == ExcludeTree && d.IsDir() {
+			t.skip(relPath, d.Type(), true, rule)
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			if err := t.loadIgnoreFile(path, relPath); err != nil {
+				return err
 			}
-			slog.Info("Skipping dir (but still walk): " + relPath)
-			return nil // don't skip dirs entirely
+		}
+		if verdict != Include {
+			t.skip(relPath, d.Type(), false, rule)
+			return nil
 		}
 
-		hdr, err := tar.FileInfoHeader(info, "")
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		hdr.Name = filepath.ToSlash(relPath)
+		return t.add(path, relPath, info, rule)
+	})
+}
 
-		if info.IsDir() {
-			hdr.Typeflag = tar.TypeDir
-			hdr.Name += "/" // ensure directories are recognized
+// verdict combines Filter, Rules and Select; the strictest one wins. It
+// also names what decided: "filter", "select", or the rule, which for an
+// included path is a negated rule or empty.
+func (t *treeWalker) verdict(relPath string, isDir bool) (Verdict, string) {
+	v, by := Include, ""
+	if t.opts.Filter != nil && !t.opts.Filter(relPath) {
+		v, by = Exclude, "filter"
+	}
+	if t.opts.Select != nil {
+		if sv := t.opts.Select(relPath, isDir); sv > v {
+			v, by = sv, "select"
 		}
+	}
+	excluded, rule := t.excluded(relPath, isDir)
+	if excluded {
+		v = ExcludeTree
+	}
+	if rule != nil && (excluded || v == Include) {
+		by = rule.String()
+	}
+	return v, by
+}
+
+// skip counts an entry the filters left out and notes it in a preview.
+func (t *treeWalker) skip(relPath string, mode fs.FileMode, pruned bool, by string) {
+	switch {
+	case pruned:
+		t.skipped.pruned++
+	case mode.IsDir():
+		t.skipped.dirs++
+	default:
+		t.skipped.files++
+	}
+	if t.preview != nil {
+		t.preview.exclude(relPath, mode, by)
+	}
+}
 
-		if err := tw.WriteHeader(hdr); err != nil {
+// emit passes an included entry on, or records it in a preview, after
+// normalizing its header as the options ask.
+func (t *treeWalker) emit(hdr *tar.Header, path, by string) error {
+	if r := t.opts.Reproducible; r != nil {
+		r.normalize(hdr, t.epoch)
+	}
+	if t.opts.Dialect != tar.FormatUnknown {
+		if err := fitDialect(hdr, t.opts.Dialect); err != nil {
 			return err
 		}
+		hdr.Format = t.opts.Dialect
+	}
+	if t.preview != nil {
+		return t.preview.include(hdr, path, by)
+	}
+	return t.out.writeEntry(hdr, path)
+}
 
-		if info.Mode().IsRegular() {
-			f, err := os.Open(path)
-			if err != nil {
+// loadIgnoreFile reads the ignore file of a directory about to be walked.
+func (t *treeWalker) loadIgnoreFile(dir, relPath string) error {
+	if !t.opts.IgnoreFiles {
+		return nil
+	}
+	rules, err := readIgnoreFile(dir, relPath)
+	if err != nil {
+		return err
+	}
+	if rules != nil {
+		t.ignores[relPath] = rules
+	}
+	return nil
+}
+
+// excluded applies the rules and the ignore files of the directories above
+// relPath, returning the rule that decided.
+func (t *treeWalker) excluded(relPath string, isDir bool) (bool, *Rule) {
+	if t.opts.Rules == nil && len(t.ignores) == 0 {
+		return false, nil
+	}
+	sets := []*Rules{t.opts.Rules, t.ignores[""]}
+	for dir := path.Dir(relPath); dir != "."; dir = path.Dir(dir) {
+		if rules, ok := t.ignores[dir]; ok {
+			sets = append(sets, rules)
+		}
+	}
+	// Deeper ignore files take precedence.
+	slices.Reverse(sets[2:])
+	return matchRules(sets, relPath, isDir)
+}
+
+// add archives one included entry; by is what included it, for previews.
+func (t *treeWalker) add(path, relPath string, info os.FileInfo, by string) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if t.opts.FollowSymlinks {
+			target, err := os.Stat(path)
+			if err == nil && target.IsDir() {
+				return t.followDir(path, relPath, target, by)
+			}
+			if err == nil {
+				info = target
+			} else {
+				slog.Warn("Keeping dangling symlink: " + relPath)
+			}
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(path); err != nil {
 				return err
 			}
-			defer f.Close()
+		}
+	}
 
-			if _, err := io.Copy(tw, f); err != nil {
-				return err
+	if info.Mode()&os.ModeSocket != 0 {
+		slog.Warn("Skipping socket: " + relPath)
+		t.skip(relPath, info.Mode(), false, "socket")
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = relPath
+	if err := addXattrs(hdr, path); err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/" // ensure directories are recognized
+	} else if t.opts.Where != nil && !t.opts.Where(headerAttrs(hdr)) {
+		t.skip(relPath, info.Mode(), false, "where")
+		return nil
+	}
+
+	if info.Mode().IsRegular() {
+		if id, ok := hardlinkID(info); ok {
+			if first, seen := t.links[id]; seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				t.links[id] = relPath
 			}
 		}
+	}
 
+	return t.emit(hdr, path, by)
+}
+
+// followDir archives a symlinked directory as a real one and descends into
+// it, refusing links that point back at one of their own ancestors or at a
+// directory already being walked through another link.
+func (t *treeWalker) followDir(path, relPath string, info os.FileInfo, by string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if parent == resolved || strings.HasPrefix(parent, resolved+string(filepath.Separator)) {
+		slog.Warn("Skipping symlink loop: " + relPath)
 		return nil
-	})
+	}
+	for _, dir := range t.descent {
+		if os.SameFile(dir, info) {
+			slog.Warn("Skipping symlink loop: " + relPath)
+			return nil
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = relPath + "/"
+	hdr.Typeflag = tar.TypeDir
+	if err := t.emit(hdr, path, by); err != nil {
+		return err
+	}
+	t.descent = append(t.descent, info)
+	defer func() { t.descent = t.descent[:len(t.descent)-1] }()
+	return t.walk(resolved, relPath)
 }
 
+// UntarStream extracts a tar stream below destDir with default options.
 func UntarStream(input io.Reader, destDir string) error {
-	tr := tar.NewReader(input)
+	return Untar(input, destDir, ExtractOptions{})
+}
+
+// Untar extracts a tar stream below destDir. Members whose path would
+// resolve outside destDir, directly or through previously extracted symlinks,
+// are skipped and reported together in an *UnsafeEntriesError once the rest
+// of the archive has been written.
+func Untar(input io.Reader, destDir string, opts ExtractOptions) error {
+	x, err := newExtractor(destDir, opts)
+	if err != nil {
+		return err
+	}
 
-	for {
+	tr := newTarReader(input)
+	for n := 0; ; n++ {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
@@ -78,27 +459,13 @@ func UntarStream(input io.Reader, destDir string) error {
 		if err != nil {
 			return err
 		}
-
-		target := filepath.Join(destDir, hdr.Name)
-
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			err = os.MkdirAll(target, 0755)
-		case tar.TypeReg:
-			err = os.MkdirAll(filepath.Dir(target), 0755)
-			if err != nil {
-				return err
-			}
-			out, err := os.Create(target)
-			if err != nil {
-				return err
-			}
-			defer out.Close()
-			_, err = io.Copy(out, tr)
+		// The manifest of a snapshot is not part of the tree.
+		if n == 0 && isManifest(hdr) {
+			continue
 		}
-		if err != nil {
+		if err := x.extract(hdr, tr); err != nil {
 			return err
 		}
 	}
-	return nil
+	return x.finish()
 }
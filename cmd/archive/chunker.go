@@ -0,0 +1,74 @@
+package archive
+
+import "io"
+
+// Content-defined chunking cuts where a rolling hash of the last 64 bytes
+// matches a mask, so an insertion only changes the chunks around it and the
+// rest of the file deduplicates against earlier backups.
+const (
+	minChunkSize = 512 << 10
+	maxChunkSize = 8 << 20
+	// chunkBits sets the average chunk size past the minimum to 1 MiB.
+	chunkBits = 20
+)
+
+// gearTable returns the per-byte values of the gear hash. Seeding it per
+// repository keeps chunk boundaries from revealing file contents.
+func gearTable(seed uint64) *[256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return &table
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r    io.Reader
+	gear *[256]uint64
+	buf  []byte
+	eof  bool
+}
+
+func newChunker(r io.Reader, gear *[256]uint64) *chunker {
+	return &chunker{r: r, gear: gear, buf: make([]byte, 0, maxChunkSize)}
+}
+
+// next returns the next chunk, or io.EOF after the last one.
+func (c *chunker) next() ([]byte, error) {
+	for !c.eof && len(c.buf) < maxChunkSize {
+		n, err := c.r.Read(c.buf[len(c.buf):maxChunkSize])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.cut(), nil
+}
+
+// cut removes the next chunk from the buffer and returns a copy of it.
+func (c *chunker) cut() []byte {
+	const mask = (1<<chunkBits - 1) << (64 - chunkBits)
+	n := len(c.buf)
+	var h uint64
+	for i := minChunkSize; i < len(c.buf); i++ {
+		h = h<<1 + c.gear[c.buf[i]]
+		if h&mask == 0 {
+			n = i + 1
+			break
+		}
+	}
+	chunk := append([]byte(nil), c.buf[:n]...)
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+	return chunk
+}
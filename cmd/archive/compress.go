@@ -1,14 +1,175 @@
 package archive
 
 import (
+	"compress/bzip2"
 	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
 	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 )
 
+// DefaultCodec is used when no codec is named. Gzip output can be opened by
+// standard tools such as tar xzf once decrypted.
+const DefaultCodec = "gzip"
+
+// Codec is a named compression format.
+type Codec struct {
+	Name      string
+	Extension string
+	// NewWriter is nil for codecs that can only be read. The meaning of
+	// level follows the underlying library; 0 selects its default for
+	// codecs without a "no compression" level.
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]*Codec)
+)
+
+// RegisterCodec makes a codec available by name, replacing any codec
+// already registered under that name.
+func RegisterCodec(c *Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name] = c
+}
+
+// LookupCodec returns the codec registered under name; empty means
+// DefaultCodec.
+func LookupCodec(name string) (*Codec, error) {
+	if name == "" {
+		name = DefaultCodec
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// Codecs lists the registered codec names in sorted order.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterCodec(&Codec{
+		Name:      "flate",
+		Extension: ".deflate",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:      "gzip",
+		Extension: ".gz",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:      "zlib",
+		Extension: ".zz",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return zlib.NewReader(r)
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:      "zstd",
+		Extension: ".zst",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			opts := []zstd.EOption{}
+			if level > 0 {
+				opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			}
+			return zstd.NewWriter(w, opts...)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:      "xz",
+		Extension: ".xz",
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xr), nil
+		},
+	})
+	RegisterCodec(&Codec{
+		Name:      "bzip2",
+		Extension: ".bz2",
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	})
+}
+
+// NewCompressWriter compresses onto w with the named codec.
+func NewCompressWriter(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	c, err := LookupCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	if c.NewWriter == nil {
+		return nil, fmt.Errorf("codec %q is read-only", c.Name)
+	}
+	return c.NewWriter(w, level)
+}
+
+// NewDecompressReader decompresses r with the named codec. Closing the
+// reader releases codec resources; it does not close r.
+func NewDecompressReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	c, err := LookupCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewReader(r)
+}
+
+// CompressWriter writes raw DEFLATE, as it did before codecs could be
+// chosen; it does not follow DefaultCodec.
 func CompressWriter(w io.Writer, level int) (io.WriteCloser, error) {
-	return flate.NewWriter(w, level)
+	return NewCompressWriter(w, "flate", level)
 }
 
+// DecompressReader reads raw DEFLATE written by CompressWriter.
 func DecompressReader(r io.Reader) (io.Reader, error) {
-	return flate.NewReader(r), nil
+	return NewDecompressReader(r, "flate")
 }
@@ -0,0 +1,78 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	original := bytes.Repeat([]byte("codec registry round trip "), 2000)
+	for _, name := range []string{"flate", "gzip", "zlib", "zstd", "xz"} {
+		var buf bytes.Buffer
+		w, err := NewCompressWriter(&buf, name, 6)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		w.Write(original)
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		r, err := NewDecompressReader(&buf, name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, original) {
+			t.Errorf("%s: roundtrip failed: %v", name, err)
+		}
+	}
+}
+
+func TestBzip2IsReadOnly(t *testing.T) {
+	// Produced by the reference bzip2 implementation.
+	data, _ := hex.DecodeString("425a6839314159265359f7f2c851000002d9800010400010003424c0302000310340d029801ea436623c806c1c2ee48a70a121efe590a2")
+	r, err := NewDecompressReader(bytes.NewReader(data), "bzip2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "bzip2 payload\n" {
+		t.Errorf("bzip2 read = %q, %v", got, err)
+	}
+
+	if _, err := NewCompressWriter(io.Discard, "bzip2", 6); err == nil {
+		t.Error("bzip2 should not be writable")
+	}
+	if _, err := LookupCodec("lzma"); err == nil {
+		t.Error("unknown codec accepted")
+	}
+}
+
+func TestPipelineProducesStandardGzipTar(t *testing.T) {
+	inputDir := t.TempDir()
+	createTestFiles(t, inputDir, map[string]string{"doc.txt": "readable by tar xzf"})
+	pass := []byte("gzip-pass")
+
+	var buf bytes.Buffer
+	if err := ArchiveAndCompressEncrypt(inputDir, &buf, 6, pass, nil); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := DecryptReaderCTR_HMAC(&buf, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(dec)
+	if err != nil {
+		t.Fatalf("decrypted pipeline output is not gzip: %v", err)
+	}
+	hdr, err := tar.NewReader(gz).Next()
+	if err != nil || hdr.Name != "doc.txt" {
+		t.Fatalf("first tar member = %v, %v", hdr, err)
+	}
+}
@@ -1,6 +1,10 @@
 package archive
 
 import (
+	"archive/tar"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -10,32 +14,254 @@ type PipelineWriter func(io.Writer) (io.WriteCloser, error)
 // PipelineReader defines a generic reader step.
 type PipelineReader func(io.Reader) (io.Reader, error)
 
+// ArchiveOptions configures Archive.
+type ArchiveOptions struct {
+	// Format is FormatTar (the default) or FormatZip. Zip compresses its
+	// entries itself, so Codec is not used for it and CompressLevel is the
+	// deflate level.
+	Format Format
+	// Indexed writes a tar archive as an indexed container, whose members
+	// can be read individually with OpenIndexed.
+	Indexed bool
+	Tar     TarOptions
+	// Snapshot starts the archive with a manifest of the tree. With Base
+	// set it only stores what changed since that manifest.
+	Snapshot      bool
+	Base          *Manifest
+	CompressLevel int
+	// Codec names the compression codec; empty means DefaultCodec.
+	Codec string
+	// Passphrase encrypts with keys derived using KDF (DefaultKDFParams when
+	// unset). Recipients encrypt to X25519 public keys instead.
+	Passphrase []byte
+	KDF        KDFParams
+	Recipients []*X25519Recipient
+	// SigningKey signs the finished archive. The signature is appended to
+	// the output unless DetachedSignature is set.
+	SigningKey        ed25519.PrivateKey
+	DetachedSignature io.Writer
+	// Parity adds Reed-Solomon parity worth that percentage of the output,
+	// for RepairArchive. It is appended to the output unless ParitySidecar
+	// is set; appended parity is only skipped when the archive is read from
+	// a file, so streamed archives should use a sidecar, and a VolumeWriter
+	// output needs one.
+	Parity        int
+	ParitySidecar io.Writer
+}
+
+// EncryptWriter encrypts to w as Archive would, with the passphrase or to
+// the recipients, without archiving or compressing.
+func (o ArchiveOptions) EncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	return o.encryptWriter(w)
+}
+
+func (o ArchiveOptions) encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	hdr, encKey, hmacKey, err := o.newStream()
+	if err != nil {
+		return nil, err
+	}
+	return newCTRHMACWriter(w, hdr, encKey, hmacKey)
+}
+
+// newStream sets up encryption to the recipients or with the passphrase.
+func (o ArchiveOptions) newStream() (*streamHeader, []byte, []byte, error) {
+	if len(o.Recipients) > 0 {
+		if len(o.Passphrase) > 0 {
+			return nil, nil, nil, ErrAmbiguousKeys
+		}
+		return newRecipientsStream(o.Recipients)
+	}
+	kdf := o.KDF
+	if kdf.Algorithm == 0 {
+		kdf = DefaultKDFParams
+	}
+	return newPassphraseStream(o.Passphrase, kdf)
+}
+
+// RestoreOptions configures Restore.
+type RestoreOptions struct {
+	Keys Keys
+	// Codec names the compression codec; empty detects it from the data.
+	Codec   string
+	Extract ExtractOptions
+	// TrustedKeys makes Restore verify the archive signature before anything
+	// is decrypted; the input must then be seekable. Signature holds a
+	// detached signature block when the archive does not embed one.
+	TrustedKeys []ed25519.PublicKey
+	Signature   []byte
+}
+
+// ArchiveAndCompressEncrypt is Archive with a filter and a passphrase. For a
+// dry run, call Archive with Tar.DryRun.
 func ArchiveAndCompressEncrypt(inputDir string, output io.Writer, compressLevel int, passphrase []byte, filterFunc func(string) bool) error {
-	encWriter, err := EncryptWriterCTR_HMAC(output, passphrase)
+	return Archive(inputDir, output, ArchiveOptions{
+		Tar:           TarOptions{Filter: filterFunc},
+		CompressLevel: compressLevel,
+		Passphrase:    passphrase,
+	})
+}
+
+// Archive packs inputDir as a tar or zip archive, compresses and encrypts it
+// onto output. With Tar.DryRun set it only fills in the preview, estimating
+// the size with the chosen compression; a snapshot is previewed as a full
+// one, so a Base cannot be previewed.
+func Archive(inputDir string, output io.Writer, opts ArchiveOptions) error {
+	if p := opts.Tar.DryRun; p != nil {
+		if opts.Base != nil {
+			return fmt.Errorf("%w: previews of incremental snapshots", ErrUnsupportedArchive)
+		}
+		if opts.Format == FormatZip {
+			return ZipFolder(inputDir, nil, opts.zipOptions())
+		}
+		return p.collect(inputDir, opts.Tar, opts.Codec, opts.CompressLevel)
+	}
+	if opts.Parity == 0 {
+		return opts.write(inputDir, output)
+	}
+	if _, ok := output.(*VolumeWriter); ok && opts.ParitySidecar == nil {
+		return fmt.Errorf("%w: volume sets need a parity sidecar", ErrUnsupportedArchive)
+	}
+	pw, err := newParityWriter(output, opts.Parity, opts.ParitySidecar)
 	if err != nil {
 		return err
 	}
-	defer encWriter.Close()
+	if err := opts.write(inputDir, pw); err != nil {
+		pw.discard()
+		return err
+	}
+	return pw.Close()
+}
+
+// write produces the signed archive that parity is computed over.
+func (o ArchiveOptions) write(inputDir string, output io.Writer) error {
+	var signer io.WriteCloser
+	if o.SigningKey != nil {
+		signer = SignWriter(output, o.SigningKey, o.DetachedSignature)
+		output = signer
+	}
+
+	if o.Indexed {
+		if o.Format != "" && o.Format != FormatTar {
+			return fmt.Errorf("%w: indexed %s", ErrUnsupportedArchive, o.Format)
+		}
+		if err := o.writeIndexed(inputDir, output); err != nil {
+			return err
+		}
+		if signer != nil {
+			return signer.Close()
+		}
+		return nil
+	}
 
-	compWriter, err := CompressWriter(encWriter, compressLevel)
+	encWriter, err := o.encryptWriter(output)
 	if err != nil {
 		return err
 	}
-	defer compWriter.Close()
 
-	return TarFolderFiltered(inputDir, compWriter, filterFunc)
+	if err := o.writeArchive(inputDir, encWriter); err != nil {
+		return err
+	}
+	if err := encWriter.Close(); err != nil {
+		return err
+	}
+	if signer != nil {
+		return signer.Close()
+	}
+	return nil
+}
+
+// writeArchive writes inputDir to w in the chosen format.
+func (o ArchiveOptions) writeArchive(inputDir string, w io.Writer) error {
+	switch o.Format {
+	case "", FormatTar:
+		compWriter, err := NewCompressWriter(w, o.Codec, o.CompressLevel)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(compWriter)
+		if err := o.walkInto(inputDir, tarEntryWriter{tw, compWriter, o.Tar.Reproducible != nil}); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return compWriter.Close()
+	case FormatZip:
+		if o.snapshot() {
+			return fmt.Errorf("%w: zip snapshots", ErrUnsupportedArchive)
+		}
+		return ZipFolder(inputDir, w, o.zipOptions())
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedArchive, o.Format)
+}
+
+func (o ArchiveOptions) zipOptions() ZipOptions {
+	return ZipOptions{
+		Filter:         o.Tar.Filter,
+		FollowSymlinks: o.Tar.FollowSymlinks,
+		Rules:          o.Tar.Rules,
+		IgnoreFiles:    o.Tar.IgnoreFiles,
+		Select:         o.Tar.Select,
+		Where:          o.Tar.Where,
+		DryRun:         o.Tar.DryRun,
+		Level:          o.CompressLevel,
+	}
 }
 
 func DecryptDecompressExtract(input io.Reader, outputDir string, passphrase []byte) error {
-	decReader, err := DecryptReaderCTR_HMAC(input, passphrase)
+	return Restore(input, outputDir, RestoreOptions{Keys: Keys{Passphrase: passphrase}})
+}
+
+// Restore decrypts, decompresses and extracts an archive made by Archive.
+func Restore(input io.Reader, outputDir string, opts RestoreOptions) error {
+	input, err := opts.verifiedInput(input)
 	if err != nil {
 		return err
 	}
 
-	decompReader, err := DecompressReader(decReader)
+	decReader, err := DecryptReader(input, opts.Keys)
 	if err != nil {
 		return err
 	}
 
-	return UntarStream(decompReader, outputDir)
+	if opts.Codec == "" {
+		inner, err := openLayers(decReader, opts.Keys)
+		if err != nil {
+			return err
+		}
+		defer inner.Close()
+		if err := inner.extract(outputDir, opts.Extract); err != nil {
+			return err
+		}
+	} else {
+		decompReader, err := NewDecompressReader(decReader, opts.Codec)
+		if err != nil {
+			return err
+		}
+		defer decompReader.Close()
+		if err := Untar(decompReader, outputDir, opts.Extract); err != nil {
+			return err
+		}
+	}
+	// Drain what the tar reader left behind so the final chunk is verified
+	// and a truncated stream is reported rather than silently accepted.
+	_, err = io.Copy(io.Discard, decReader)
+	return err
+}
+
+// verifiedInput checks the archive signature when trusted keys are given and
+// returns the archive bytes with any embedded signature removed.
+func (o RestoreOptions) verifiedInput(input io.Reader) (io.Reader, error) {
+	if len(o.TrustedKeys) == 0 {
+		if o.Signature != nil {
+			return input, nil
+		}
+		return stripSignature(input)
+	}
+	rs, ok := input.(io.ReadSeeker)
+	if !ok {
+		return nil, errors.New("signature verification needs a seekable input")
+	}
+	payload, _, err := VerifyArchive(rs, o.Signature, o.TrustedKeys)
+	return payload, err
 }
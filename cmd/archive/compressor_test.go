@@ -2,6 +2,7 @@ package archive
 
 import (
 	"bytes"
+	"compress/flate"
 	"io"
 	"os"
 	"path/filepath"
@@ -110,6 +111,9 @@ func TestDeflateRoundTrip(t *testing.T) {
 	if err := w.Close(); err != nil {
 		t.Fatal(err)
 	}
+	if raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(buf.Bytes()))); err != nil || string(raw) != original {
+		t.Fatalf("CompressWriter output is not raw deflate: %q, %v", raw, err)
+	}
 
 	r, err := DecompressReader(&buf)
 	if err != nil {
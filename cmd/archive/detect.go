@@ -0,0 +1,280 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Format names one layer of an archive as found by Open. Compression layers
+// use the name of their codec.
+type Format string
+
+const (
+	FormatEncrypted Format = "encrypted"
+	FormatLegacy    Format = "legacy-encrypted"
+	FormatGzip      Format = "gzip"
+	FormatZstd      Format = "zstd"
+	FormatXz        Format = "xz"
+	FormatBzip2     Format = "bzip2"
+	FormatFlate     Format = "flate"
+	FormatZip       Format = "zip"
+	FormatTar       Format = "tar"
+	FormatIndexed   Format = "indexed"
+)
+
+const (
+	// sniffSize covers the tar magic, which sits furthest into the data.
+	sniffSize      = tarMagicOffset + 5
+	tarMagicOffset = 257
+
+	// maxLayers stops nested compression from being unwrapped forever.
+	maxLayers = 8
+)
+
+var (
+	// ErrUnknownFormat is returned when no supported layer is recognised.
+	ErrUnknownFormat = errors.New("unrecognised archive format")
+	// ErrUnsupportedArchive is returned for container formats that are
+	// recognised but cannot be read this way.
+	ErrUnsupportedArchive = errors.New("unsupported archive format")
+)
+
+var magics = []struct {
+	format Format
+	magic  []byte
+}{
+	{FormatEncrypted, headerMagic},
+	{FormatIndexed, indexMagic},
+	{FormatGzip, []byte{0x1f, 0x8b}},
+	{FormatZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{FormatXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{FormatBzip2, []byte("BZh")},
+	{FormatZip, []byte("PK\x03\x04")},
+	{FormatZip, []byte("PK\x05\x06")},
+}
+
+// sniff identifies a layer from its leading bytes, or returns "".
+func sniff(head []byte) Format {
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+	if len(head) >= sniffSize && bytes.Equal(head[tarMagicOffset:sniffSize], []byte("ustar")) {
+		return FormatTar
+	}
+	return ""
+}
+
+// Opened is an archive with its encryption and compression layers removed.
+// Reading it yields the innermost tar, zip or indexed container.
+type Opened struct {
+	// Layers lists the formats found, outermost first. The last one is
+	// FormatTar, FormatZip or FormatIndexed.
+	Layers []Format
+
+	keys      Keys
+	src       io.Reader
+	r         io.Reader
+	closers   []io.Closer
+	decrypted []io.Reader
+}
+
+// Open sniffs r layer by layer and builds the matching chain of decrypting
+// and decompressing readers. Keys are only needed for encrypted archives. A
+// trailing signature is skipped but not checked. Data that matches no known
+// layer is tried as a legacy encrypted stream when a passphrase is given and
+// as raw flate otherwise, the formats written before headers existed.
+func Open(r io.Reader, keys Keys) (*Opened, error) {
+	r, err := stripSignature(r)
+	if err != nil {
+		return nil, err
+	}
+	return openLayers(r, keys)
+}
+
+func openLayers(r io.Reader, keys Keys) (*Opened, error) {
+	o := &Opened{keys: keys, src: r}
+	for len(o.Layers) < maxLayers {
+		br := bufio.NewReaderSize(r, bufferSize)
+		head, err := br.Peek(sniffSize)
+		if err != nil && err != io.EOF {
+			o.Close()
+			return nil, err
+		}
+		if len(head) == 0 {
+			o.Close()
+			return nil, ErrUnknownFormat
+		}
+
+		format := sniff(head)
+		if format == "" {
+			format = o.fallback(keys)
+		}
+		o.Layers = append(o.Layers, format)
+
+		switch format {
+		case FormatTar, FormatZip, FormatIndexed:
+			o.r = br
+			return o, nil
+		case FormatEncrypted, FormatLegacy:
+			dec, err := DecryptReader(br, keys)
+			if err != nil {
+				o.Close()
+				return nil, err
+			}
+			o.decrypted = append(o.decrypted, dec)
+			r = dec
+		default:
+			dec, err := NewDecompressReader(br, string(format))
+			if err != nil {
+				o.Close()
+				return nil, err
+			}
+			o.closers = append(o.closers, dec)
+			r = dec
+		}
+	}
+	o.Close()
+	return nil, fmt.Errorf("%w: more than %d layers", ErrUnknownFormat, maxLayers)
+}
+
+// fallback picks the format for data without a recognised magic number.
+// Only the outermost layer can be a legacy stream and compressed data must
+// hold an archive, which leaves tar without the ustar magic.
+func (o *Opened) fallback(keys Keys) Format {
+	if len(o.Layers) == 0 && keys.Passphrase != nil {
+		return FormatLegacy
+	}
+	if len(o.Layers) > 0 && o.Layers[len(o.Layers)-1] != FormatEncrypted &&
+		o.Layers[len(o.Layers)-1] != FormatLegacy {
+		return FormatTar
+	}
+	return FormatFlate
+}
+
+// Format returns the innermost layer, FormatTar, FormatZip or FormatIndexed.
+func (o *Opened) Format() Format {
+	return o.Layers[len(o.Layers)-1]
+}
+
+func (o *Opened) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+// verify drains the decrypting layers, innermost first, so that their final
+// chunks are authenticated even when the archive reader stopped early.
+func (o *Opened) verify() error {
+	for i := len(o.decrypted) - 1; i >= 0; i-- {
+		if _, err := io.Copy(io.Discard, o.decrypted[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close releases the decompressors. It does not close the source reader.
+func (o *Opened) Close() error {
+	var first error
+	for i := len(o.closers) - 1; i >= 0; i-- {
+		if err := o.closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Extract opens an archive of any supported layout and extracts it into
+// destDir.
+func Extract(input io.Reader, destDir string, keys Keys, opts ExtractOptions) error {
+	o, err := Open(input, keys)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+	return o.extract(destDir, opts)
+}
+
+func (o *Opened) extract(destDir string, opts ExtractOptions) error {
+	if o.Format() != FormatTar {
+		// Zip and indexed layers may be spooled under the destination.
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return err
+		}
+	}
+	switch o.Format() {
+	case FormatTar:
+		if err := Untar(o, destDir, opts); err != nil {
+			return err
+		}
+	case FormatZip:
+		ra, size, cleanup, err := o.readerAt(destDir)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if err := Unzip(ra, size, destDir, opts); err != nil {
+			return err
+		}
+	case FormatIndexed:
+		ir, cleanup, err := o.indexed(destDir)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		if err := Untar(ir.tarStream(), destDir, opts); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedArchive, o.Format())
+	}
+	return o.verify()
+}
+
+// indexed opens an indexed container layer, spooling under dir as
+// readerAt does.
+func (o *Opened) indexed(dir string) (*IndexedReader, func(), error) {
+	ra, size, cleanup, err := o.readerAt(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	ir, err := OpenIndexed(ra, size, o.keys)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return ir, cleanup, nil
+}
+
+// readerAt gives random access to a zip or indexed layer. Both keep their
+// directory at the end, so unless the layer is the outermost one of a file
+// it is spooled, under dir when there is an extraction destination and in
+// the temporary directory otherwise. Spool files are readable only by the
+// owner and removed by cleanup.
+func (o *Opened) readerAt(dir string) (io.ReaderAt, int64, func(), error) {
+	if ra, ok := o.src.(interface {
+		io.ReaderAt
+		Size() int64
+	}); ok && len(o.Layers) == 1 {
+		return ra, ra.Size(), func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp(dir, ".tartarus-spool-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, o)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return tmp, size, cleanup, nil
+}
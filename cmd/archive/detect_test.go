@@ -0,0 +1,90 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func compressBytes(t *testing.T, data []byte, codec string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewCompressWriter(&buf, codec, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenDetectsLayers(t *testing.T) {
+	pass := []byte("sniff")
+	tarball := buildTar(t, []tarEntry{{name: "a.txt", typeflag: tar.TypeReg, body: "detected"}}).Bytes()
+
+	cases := []struct {
+		name   string
+		data   []byte
+		keys   Keys
+		layers []Format
+	}{
+		{"tar", tarball, Keys{}, []Format{FormatTar}},
+		{"tar.gz", compressBytes(t, tarball, "gzip"), Keys{}, []Format{FormatGzip, FormatTar}},
+		{"tar.zst", compressBytes(t, tarball, "zstd"), Keys{}, []Format{FormatZstd, FormatTar}},
+		{"tar.xz", compressBytes(t, tarball, "xz"), Keys{}, []Format{FormatXz, FormatTar}},
+		{"raw flate", compressBytes(t, tarball, "flate"), Keys{}, []Format{FormatFlate, FormatTar}},
+		{"encrypted gzip", encryptBytes(t, compressBytes(t, tarball, "gzip"), pass),
+			Keys{Passphrase: pass}, []Format{FormatEncrypted, FormatGzip, FormatTar}},
+		{"legacy flate", encryptLegacy(t, compressBytes(t, tarball, "flate"), pass),
+			Keys{Passphrase: pass}, []Format{FormatLegacy, FormatFlate, FormatTar}},
+	}
+	for _, c := range cases {
+		o, err := Open(bytes.NewReader(c.data), c.keys)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(o.Layers, c.layers) {
+			t.Errorf("%s: layers = %v, want %v", c.name, o.Layers, c.layers)
+		}
+		dest := t.TempDir()
+		if err := o.extract(dest, ExtractOptions{}); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		o.Close()
+		if got := readFile(t, filepath.Join(dest, "a.txt")); got != "detected" {
+			t.Errorf("%s: extracted %q", c.name, got)
+		}
+	}
+}
+
+func TestOpenRejectsUnknownData(t *testing.T) {
+	if _, err := Open(bytes.NewReader(nil), Keys{}); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("empty input: got %v, want ErrUnknownFormat", err)
+	}
+	if _, err := Open(bytes.NewReader(bytes.Repeat([]byte{0}, 600)), Keys{}); err == nil {
+		t.Error("zero bytes opened as an archive")
+	}
+}
+
+func TestRestoreDetectsCodec(t *testing.T) {
+	inputDir := t.TempDir()
+	createTestFiles(t, inputDir, map[string]string{"z.txt": "zstd inside"})
+	pass := []byte("codec-sniff")
+
+	var buf bytes.Buffer
+	if err := Archive(inputDir, &buf, ArchiveOptions{Codec: "zstd", Passphrase: pass}); err != nil {
+		t.Fatal(err)
+	}
+	outputDir := t.TempDir()
+	if err := Restore(&buf, outputDir, RestoreOptions{Keys: Keys{Passphrase: pass}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(outputDir, "z.txt")); got != "zstd inside" {
+		t.Errorf("restored %q", got)
+	}
+}
@@ -0,0 +1,221 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// tarDialects names the formats accepted by ParseDialect.
+var tarDialects = map[string]tar.Format{
+	"":      tar.FormatUnknown,
+	"ustar": tar.FormatUSTAR,
+	"pax":   tar.FormatPAX,
+	"gnu":   tar.FormatGNU,
+}
+
+// ParseDialect parses a tar format name: ustar, pax or gnu. Empty leaves
+// the choice to the tar writer, which picks the simplest format that can
+// hold each header.
+func ParseDialect(name string) (tar.Format, error) {
+	f, ok := tarDialects[strings.ToLower(name)]
+	if !ok {
+		return tar.FormatUnknown, fmt.Errorf("unknown tar format %q", name)
+	}
+	return f, nil
+}
+
+// ErrUnrepresentable is returned for entries the chosen tar format cannot
+// store.
+var ErrUnrepresentable = errors.New("entry does not fit the tar format")
+
+// USTAR field limits.
+const (
+	ustarNameSize   = 100
+	ustarPrefixSize = 155
+	ustarOwnerSize  = 32
+	ustarMaxID      = 07777777
+	ustarMaxSize    = 077777777777
+	ustarMaxTime    = 077777777777
+)
+
+// fitDialect prepares hdr for the format and reports what in it the format
+// cannot store. USTAR has no access or change times and keeps modification
+// times in whole seconds; dropping those is not an error.
+func fitDialect(hdr *tar.Header, f tar.Format) error {
+	var why string
+	switch f {
+	case tar.FormatUSTAR:
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		why = ustarProblem(hdr)
+	case tar.FormatGNU:
+		switch {
+		case len(hdr.PAXRecords) > 0:
+			why = "GNU format cannot store extended attributes"
+		case len(hdr.Uname) > ustarOwnerSize || len(hdr.Gname) > ustarOwnerSize:
+			why = "GNU user and group names are limited to 32 bytes"
+		}
+	}
+	if why == "" {
+		return nil
+	}
+	return fmt.Errorf("%w: %s: %s", ErrUnrepresentable, hdr.Name, why)
+}
+
+func ustarProblem(hdr *tar.Header) string {
+	switch {
+	case !isASCII(hdr.Name):
+		return "USTAR names must be ASCII"
+	case len(hdr.Name) > ustarNameSize && !splitsUSTAR(hdr.Name):
+		return "USTAR names are limited to 100 bytes, or 256 split at a slash"
+	case !isASCII(hdr.Linkname) || len(hdr.Linkname) > ustarNameSize:
+		return "USTAR link targets are limited to 100 ASCII bytes"
+	case hdr.Size > ustarMaxSize:
+		return "USTAR files are limited to 8 GiB"
+	case hdr.Uid > ustarMaxID || hdr.Gid > ustarMaxID || hdr.Uid < 0 || hdr.Gid < 0:
+		return "USTAR owner ids are limited to 2097151"
+	case !isASCII(hdr.Uname) || !isASCII(hdr.Gname) || len(hdr.Uname) > ustarOwnerSize || len(hdr.Gname) > ustarOwnerSize:
+		return "USTAR user and group names are limited to 32 ASCII bytes"
+	case !hdr.ModTime.IsZero() && (hdr.ModTime.Unix() < 0 || hdr.ModTime.Unix() > ustarMaxTime):
+		return "USTAR times must be between 1970 and 2242"
+	case hdr.Devmajor > ustarMaxID || hdr.Devminor > ustarMaxID:
+		return "USTAR device numbers are limited to 2097151"
+	case len(hdr.PAXRecords) > 0:
+		return "USTAR cannot store extended attributes"
+	}
+	return ""
+}
+
+// splitsUSTAR reports whether a long name fits the prefix and name fields,
+// split at a slash the way archive/tar does it.
+func splitsUSTAR(name string) bool {
+	length := len(name)
+	if length > ustarPrefixSize+1 {
+		length = ustarPrefixSize + 1
+	} else if name[length-1] == '/' {
+		length--
+	}
+	i := strings.LastIndex(name[:length], "/")
+	suffix := len(name) - i - 1
+	return i > 0 && i <= ustarPrefixSize && suffix > 0 && suffix <= ustarNameSize
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf || s[i] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tarReader is a tar.Reader that applies PAX global headers to the members
+// that follow them, which archive/tar leaves to the caller. GNU long names
+// and links and PAX extended headers of single members are resolved by
+// archive/tar itself.
+type tarReader struct {
+	*tar.Reader
+	global map[string]string
+}
+
+func newTarReader(r io.Reader) *tarReader {
+	return &tarReader{Reader: tar.NewReader(r)}
+}
+
+// Next returns the next member with the global records in effect applied.
+// Global headers themselves are not returned.
+func (t *tarReader) Next() (*tar.Header, error) {
+	for {
+		hdr, err := t.Reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeXGlobalHeader {
+			if len(t.global) > 0 {
+				applyGlobalPAX(hdr, t.global)
+			}
+			return hdr, nil
+		}
+		if t.global == nil {
+			t.global = make(map[string]string)
+		}
+		for key, value := range hdr.PAXRecords {
+			if value == "" {
+				delete(t.global, key) // an empty value cancels the record
+			} else {
+				t.global[key] = value
+			}
+		}
+	}
+}
+
+// applyGlobalPAX fills in what a member's own records do not set. Paths,
+// link targets and sizes only make sense per member and are ignored.
+func applyGlobalPAX(hdr *tar.Header, global map[string]string) {
+	for key, value := range global {
+		if _, local := hdr.PAXRecords[key]; local {
+			continue
+		}
+		switch key {
+		case "uid", "gid":
+			id, err := strconv.Atoi(value)
+			if err != nil {
+				continue
+			}
+			if key == "uid" {
+				hdr.Uid = id
+			} else {
+				hdr.Gid = id
+			}
+		case "uname":
+			hdr.Uname = value
+		case "gname":
+			hdr.Gname = value
+		case "mtime", "atime", "ctime":
+			t, err := parsePAXTime(value)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "mtime":
+				hdr.ModTime = t
+			case "atime":
+				hdr.AccessTime = t
+			default:
+				hdr.ChangeTime = t
+			}
+		default:
+			if strings.HasPrefix(key, paxXattrPrefix) {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = make(map[string]string)
+				}
+				hdr.PAXRecords[key] = value
+			}
+		}
+	}
+}
+
+// parsePAXTime parses a PAX time, seconds with an optional fraction.
+func parsePAXTime(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	sec, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var nsec int64
+	if frac != "" {
+		frac = (frac + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil || nsec < 0 {
+			return time.Time{}, fmt.Errorf("invalid PAX time %q", s)
+		}
+	}
+	if strings.HasPrefix(secs, "-") && nsec > 0 {
+		sec, nsec = sec-1, 1e9-nsec
+	}
+	return time.Unix(sec, nsec), nil
+}
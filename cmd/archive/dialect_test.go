@@ -0,0 +1,130 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarDialects(t *testing.T) {
+	src := t.TempDir()
+	long := strings.Repeat("n", 120)
+	mtime := time.Date(2023, 3, 4, 5, 6, 7, 890000000, time.UTC)
+	os.WriteFile(filepath.Join(src, long), []byte("long"), 0644)
+	os.Chtimes(filepath.Join(src, long), mtime, mtime)
+	os.Symlink(strings.Repeat("t", 150), filepath.Join(src, "link"))
+
+	short := t.TempDir()
+	os.MkdirAll(filepath.Join(short, "dir"), 0755)
+	os.WriteFile(filepath.Join(short, "dir", "file"), []byte("short"), 0644)
+	if err := TarFolder(short, &bytes.Buffer{}, TarOptions{Dialect: tar.FormatUSTAR}); err != nil {
+		t.Errorf("USTAR with short names: %v", err)
+	}
+
+	err := TarFolder(src, &bytes.Buffer{}, TarOptions{Dialect: tar.FormatUSTAR})
+	if !errors.Is(err, ErrUnrepresentable) || !strings.Contains(err.Error(), "limited to 100") {
+		t.Errorf("USTAR error = %v", err)
+	}
+
+	for _, dialect := range []tar.Format{tar.FormatPAX, tar.FormatGNU} {
+		var buf bytes.Buffer
+		if err := TarFolder(src, &buf, TarOptions{Dialect: dialect}); err != nil {
+			t.Fatalf("%v: %v", dialect, err)
+		}
+		if dialect == tar.FormatGNU && !bytes.Contains(buf.Bytes(), []byte("././@LongLink")) {
+			t.Error("GNU archive without long name entries")
+		}
+		dest := t.TempDir()
+		if err := Untar(&buf, dest, ExtractOptions{}); err != nil {
+			t.Fatalf("%v: %v", dialect, err)
+		}
+		info, err := os.Stat(filepath.Join(dest, long))
+		if err != nil {
+			t.Fatalf("%v: %v", dialect, err)
+		}
+		want := mtime.Truncate(time.Second)
+		if dialect == tar.FormatPAX {
+			want = mtime
+		}
+		if !info.ModTime().Equal(want) {
+			t.Errorf("%v: mtime %v, want %v", dialect, info.ModTime(), want)
+		}
+		if target, _ := os.Readlink(filepath.Join(dest, "link")); len(target) != 150 {
+			t.Errorf("%v: link target %q", dialect, target)
+		}
+	}
+}
+
+func TestFitDialect(t *testing.T) {
+	split := strings.Repeat("d", 150) + "/" + strings.Repeat("f", 90)
+	tests := []struct {
+		hdr tar.Header
+		ok  bool
+	}{
+		{tar.Header{Name: split}, true},
+		{tar.Header{Name: strings.Repeat("d", 160) + "/f"}, false},
+		{tar.Header{Name: "café"}, false},
+		{tar.Header{Name: "big", Size: 1 << 34}, false},
+		{tar.Header{Name: "uid", Uid: 1 << 22}, false},
+		{tar.Header{Name: "x", PAXRecords: map[string]string{paxXattrPrefix + "user.a": "b"}}, false},
+	}
+	for _, tt := range tests {
+		if err := fitDialect(&tt.hdr, tar.FormatUSTAR); (err == nil) != tt.ok {
+			t.Errorf("%.20q: %v", tt.hdr.Name, err)
+		}
+		if err := fitDialect(&tt.hdr, tar.FormatPAX); err != nil {
+			t.Errorf("PAX %.20q: %v", tt.hdr.Name, err)
+		}
+	}
+	xattr := tar.Header{Name: "x", PAXRecords: map[string]string{paxXattrPrefix + "user.a": "b"}}
+	if err := fitDialect(&xattr, tar.FormatGNU); !errors.Is(err, ErrUnrepresentable) {
+		t.Errorf("GNU with xattrs: %v", err)
+	}
+}
+
+func TestUntarGlobalPAXHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	global := time.Unix(1600000000, 500000000)
+	own := time.Date(2022, 1, 1, 0, 0, 0, 250000000, time.UTC)
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"mtime": "1600000000.5"}},
+		{Name: "inherits", Typeflag: tar.TypeReg, Mode: 0644, ModTime: time.Unix(1, 0)},
+		{Name: "own", Typeflag: tar.TypeReg, Mode: 0644, ModTime: own, Format: tar.FormatPAX},
+		{Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"mtime": ""}},
+		{Name: "after", Typeflag: tar.TypeReg, Mode: 0644, ModTime: time.Unix(1, 0)},
+	}
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	members, err := List(bytes.NewReader(buf.Bytes()), Keys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Errorf("members %+v", members)
+	}
+
+	dest := t.TempDir()
+	if err := Untar(&buf, dest, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]time.Time{"inherits": global, "own": own, "after": time.Unix(1, 0)} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(want) {
+			t.Errorf("%s: mtime %v, want %v", name, info.ModTime(), want)
+		}
+	}
+}
@@ -1,12 +1,12 @@
 package archive
 
 import (
-	"bytes"
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"hash"
 	"io"
@@ -17,40 +17,94 @@ const (
 	nonceSize  = 16
 	hmacSize   = 32
 	bufferSize = 32 * 1024
+
+	// chunkSize is the plaintext size of every chunk but the last. Each
+	// chunk is authenticated on its own so decryption can release verified
+	// plaintext without holding the whole stream.
+	chunkSize = 64 * 1024
+)
+
+var (
+	// ErrAuthentication is returned when a chunk fails HMAC verification,
+	// either because the passphrase is wrong or the data was modified.
+	ErrAuthentication = errors.New("HMAC verification failed")
+	// ErrTruncated is returned when the stream ends before its final chunk.
+	ErrTruncated = errors.New("encrypted stream is truncated")
 )
 
-func deriveKeys(passphrase []byte) (encKey, hmacKey []byte) {
-	hash := sha256.Sum256(passphrase)
-	return hash[:16], hash[16:]
+// chunkMAC authenticates one chunk. Binding the chunk index and a final flag
+// into the tag makes reordered, dropped or truncated chunks fail to verify.
+type chunkMAC struct {
+	hmac  hash.Hash
+	nonce []byte
+	index uint64
 }
 
-// EncryptWriterCTR_HMAC returns a WriteCloser that encrypts and HMACs the data
+func (m *chunkMAC) sum(ciphertext []byte, final bool) []byte {
+	var meta [9]byte
+	binary.BigEndian.PutUint64(meta[:8], m.index)
+	if final {
+		meta[8] = 1
+	}
+	m.hmac.Reset()
+	m.hmac.Write(m.nonce)
+	m.hmac.Write(meta[:])
+	m.hmac.Write(ciphertext)
+	return m.hmac.Sum(nil)
+}
+
+// EncryptWriterCTR_HMAC returns a WriteCloser that encrypts with AES-256-CTR
+// and authenticates the data in chunks, deriving keys with DefaultKDFParams.
+// The stream is a header followed by chunks of ciphertext || HMAC; Close must
+// be called to emit the final chunk.
 func EncryptWriterCTR_HMAC(w io.Writer, passphrase []byte) (io.WriteCloser, error) {
-	encKey, hmacKey := deriveKeys(passphrase)
+	return EncryptWriterWithKDF(w, passphrase, DefaultKDFParams)
+}
 
-	block, err := aes.NewCipher(encKey)
+// EncryptWriterWithKDF is EncryptWriterCTR_HMAC with explicit KDF parameters.
+// They are recorded in the header, so decryption needs only the passphrase.
+func EncryptWriterWithKDF(w io.Writer, passphrase []byte, params KDFParams) (io.WriteCloser, error) {
+	hdr, encKey, hmacKey, err := newPassphraseStream(passphrase, params)
 	if err != nil {
 		return nil, err
 	}
+	return newCTRHMACWriter(w, hdr, encKey, hmacKey)
+}
 
-	nonce := make([]byte, nonceSize)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, err
+// newPassphraseStream creates a header for passphrase encryption and derives
+// the keys it describes.
+func newPassphraseStream(passphrase []byte, params KDFParams) (*streamHeader, []byte, []byte, error) {
+	hdr, err := newStreamHeader(params)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	encKey, hmacKey, err := deriveKeys(passphrase, hdr.salt, hdr.kdf)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return hdr, encKey, hmacKey, nil
+}
 
-	// Write nonce first
-	if _, err := w.Write(nonce); err != nil {
+func newCTRHMACWriter(w io.Writer, hdr *streamHeader, encKey, hmacKey []byte) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
 		return nil, err
 	}
 
-	stream := cipher.NewCTR(block, nonce)
-	h := hmac.New(sha256.New, hmacKey)
+	// Write header and its MAC first
+	encoded := hdr.marshal()
+	if _, err := w.Write(encoded); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(headerMAC(hmacKey, encoded)); err != nil {
+		return nil, err
+	}
 
 	writer := &ctrHMACWriter{
 		dst:    w,
-		stream: stream,
-		hmac:   h,
-		buf:    make([]byte, bufferSize),
+		stream: cipher.NewCTR(block, hdr.nonce),
+		mac:    chunkMAC{hmac: hmac.New(sha256.New, hmacKey), nonce: hdr.nonce},
+		buf:    make([]byte, 0, chunkSize),
 	}
 	return writer, nil
 }
@@ -58,69 +112,173 @@ func EncryptWriterCTR_HMAC(w io.Writer, passphrase []byte) (io.WriteCloser, erro
 type ctrHMACWriter struct {
 	dst    io.Writer
 	stream cipher.Stream
-	hmac   hash.Hash
+	mac    chunkMAC
 	buf    []byte
+	closed bool
 }
 
 func (w *ctrHMACWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
 	n := len(p)
-	out := make([]byte, n)
-	w.stream.XORKeyStream(out, p)
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so the
+		// last chunk is always the one written by Close.
+		if len(w.buf) == chunkSize {
+			if err := w.flush(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		k := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (w *ctrHMACWriter) flush(final bool) error {
+	w.stream.XORKeyStream(w.buf, w.buf)
+	tag := w.mac.sum(w.buf, final)
+	w.mac.index++
 
-	// Write to HMAC and dst
-	if _, err := w.hmac.Write(out); err != nil {
-		return 0, err
+	if _, err := w.dst.Write(w.buf); err != nil {
+		return err
 	}
-	_, err := w.dst.Write(out)
-	return n, err
+	_, err := w.dst.Write(tag)
+	w.buf = w.buf[:0]
+	return err
 }
 
 func (w *ctrHMACWriter) Close() error {
-	_, err := w.dst.Write(w.hmac.Sum(nil))
-	return err
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
 }
 
+// DecryptReaderCTR_HMAC returns a reader over the plaintext of a stream
+// written by EncryptWriterCTR_HMAC. The header MAC is checked up front, which
+// makes a wrong passphrase fail here. Chunks are verified before any of their
+// plaintext is returned, so memory use is bounded by the chunk size. Streams
+// in the legacy headerless layout are detected and decrypted as well.
 func DecryptReaderCTR_HMAC(r io.Reader, passphrase []byte) (io.Reader, error) {
-	encKey, hmacKey := deriveKeys(passphrase)
+	return DecryptReader(r, Keys{Passphrase: passphrase})
+}
 
-	// Read nonce
-	nonce := make([]byte, nonceSize)
-	if _, err := io.ReadFull(r, nonce); err != nil {
+// DecryptReader decrypts a stream encrypted either with a passphrase or to
+// X25519 recipients, using whichever of keys the stream header asks for.
+func DecryptReader(r io.Reader, keys Keys) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, bufferSize)
+	legacy, err := isLegacy(br)
+	if err != nil {
 		return nil, err
 	}
+	if legacy {
+		if keys.Passphrase == nil {
+			return nil, ErrPassphraseRequired
+		}
+		return decryptLegacy(r, br, keys.Passphrase)
+	}
 
-	// Buffer the rest to verify HMAC at the end
-	var buf bytes.Buffer
-	tee := io.TeeReader(r, &buf)
+	hdr, encKey, hmacKey, err := openStream(br, keys)
+	if err != nil {
+		return nil, err
+	}
 
-	encryptedData, err := io.ReadAll(tee)
+	block, err := aes.NewCipher(encKey)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(encryptedData) < hmacSize {
-		return nil, errors.New("data too short for HMAC")
+	reader := &ctrHMACReader{
+		src:    br,
+		stream: cipher.NewCTR(block, hdr.nonce),
+		mac:    chunkMAC{hmac: hmac.New(sha256.New, hmacKey), nonce: hdr.nonce},
+		buf:    make([]byte, chunkSize+hmacSize),
+	}
+	return reader, nil
+}
+
+// openStream reads a stream header and its MAC from r and returns the
+// header with the stream keys, once the MAC shows the keys are right.
+func openStream(r io.Reader, keys Keys) (*streamHeader, []byte, []byte, error) {
+	hdr, encoded, err := readStreamHeader(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	encKey, hmacKey, err := hdr.streamKeys(keys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tag := make([]byte, hmacSize)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return nil, nil, nil, ErrTruncated
 	}
+	if !hmac.Equal(headerMAC(hmacKey, encoded), tag) {
+		return nil, nil, nil, ErrAuthentication
+	}
+	return hdr, encKey, hmacKey, nil
+}
 
-	data := encryptedData[:len(encryptedData)-hmacSize]
-	expectedMAC := encryptedData[len(encryptedData)-hmacSize:]
+type ctrHMACReader struct {
+	src    *bufio.Reader
+	stream cipher.Stream
+	mac    chunkMAC
+	buf    []byte
+	plain  []byte // verified plaintext not yet returned
+	final  bool
+	err    error
+}
 
-	// Verify HMAC
-	h := hmac.New(sha256.New, hmacKey)
-	h.Write(data)
-	if !hmac.Equal(h.Sum(nil), expectedMAC) {
-		return nil, errors.New("HMAC verification failed")
+func (r *ctrHMACReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.final {
+			return 0, io.EOF
+		}
+		r.err = r.next()
 	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
 
-	block, err := aes.NewCipher(encKey)
-	if err != nil {
-		return nil, err
+// next reads, verifies and decrypts the following chunk.
+func (r *ctrHMACReader) next() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		r.final = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is the last one only if nothing follows it.
+		if _, err := r.src.Peek(1); err == io.EOF {
+			r.final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < hmacSize {
+		return ErrTruncated
 	}
-	stream := cipher.NewCTR(block, nonce)
 
-	streamReader := &cipher.StreamReader{
-		S: stream,
-		R: bytes.NewReader(data),
+	ciphertext := r.buf[:n-hmacSize]
+	tag := r.buf[n-hmacSize : n]
+	if !hmac.Equal(r.mac.sum(ciphertext, r.final), tag) {
+		if r.final && hmac.Equal(r.mac.sum(ciphertext, false), tag) {
+			return ErrTruncated
+		}
+		return ErrAuthentication
 	}
-	return streamReader, nil
+	r.mac.index++
+
+	r.stream.XORKeyStream(ciphertext, ciphertext)
+	r.plain = ciphertext
+	return nil
 }
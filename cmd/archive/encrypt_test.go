@@ -0,0 +1,122 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encryptBytes(t *testing.T, plaintext, pass []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc, err := EncryptWriterCTR_HMAC(&buf, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBytes(data, pass []byte) ([]byte, error) {
+	dec, err := DecryptReaderCTR_HMAC(bytes.NewReader(data), pass)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dec)
+}
+
+func TestChunkedEncryptionBoundaries(t *testing.T) {
+	pass := []byte("chunks")
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		got, err := decryptBytes(encryptBytes(t, plaintext, pass), pass)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: roundtrip mismatch", size)
+		}
+	}
+}
+
+func TestChunkedEncryptionRejectsTampering(t *testing.T) {
+	pass := []byte("chunks")
+	plaintext := make([]byte, 3*chunkSize+100)
+	rand.Read(plaintext)
+	data := encryptBytes(t, plaintext, pass)
+	start := headerSize + hmacSize
+	stride := chunkSize + hmacSize
+
+	truncated := data[:start+2*stride]
+	if _, err := decryptBytes(truncated, pass); !errors.Is(err, ErrTruncated) {
+		t.Errorf("truncated stream: got %v, want ErrTruncated", err)
+	}
+
+	reordered := append([]byte{}, data...)
+	first := start
+	second := start + stride
+	copy(reordered[first:first+stride], data[second:second+stride])
+	copy(reordered[second:second+stride], data[first:first+stride])
+	if _, err := decryptBytes(reordered, pass); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("reordered stream: got %v, want ErrAuthentication", err)
+	}
+
+	flipped := append([]byte{}, data...)
+	flipped[len(flipped)-hmacSize-1] ^= 1
+	if _, err := decryptBytes(flipped, pass); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("flipped bit: got %v, want ErrAuthentication", err)
+	}
+
+	if _, err := decryptBytes(data, []byte("wrong")); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("wrong passphrase: got %v, want ErrAuthentication", err)
+	}
+}
+
+func TestKDFHeader(t *testing.T) {
+	pass := []byte("same passphrase")
+	a := encryptBytes(t, []byte("x"), pass)
+	b := encryptBytes(t, []byte("x"), pass)
+	if bytes.Equal(a[:headerSize], b[:headerSize]) {
+		t.Error("identical passphrases produced identical headers")
+	}
+
+	var buf bytes.Buffer
+	enc, err := EncryptWriterWithKDF(&buf, pass, KDFParams{Algorithm: KDFArgon2id, Time: 1, Memory: 8 * 1024, Parallelism: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write([]byte("argon"))
+	enc.Close()
+	got, err := decryptBytes(buf.Bytes(), pass)
+	if err != nil || string(got) != "argon" {
+		t.Fatalf("argon2id roundtrip = %q, %v", got, err)
+	}
+
+	tampered := append([]byte{}, a...)
+	tampered[len(headerMagic)+5] ^= 1 // scrypt N stays in range but changes
+	if _, err := decryptBytes(tampered, pass); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("tampered header: got %v, want ErrAuthentication", err)
+	}
+
+	costly := append([]byte{}, a...)
+	binary.BigEndian.PutUint32(costly[len(headerMagic)+2:], 21) // scrypt N=2^21, r=8: 2 GiB
+	if _, err := decryptBytes(costly, pass); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("2 GiB KDF: got %v, want ErrUnsupportedFormat", err)
+	}
+
+	future := append([]byte{}, a...)
+	future[len(headerMagic)] = 0xff
+	if _, err := decryptBytes(future, pass); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("future version: got %v, want ErrUnsupportedFormat", err)
+	}
+}
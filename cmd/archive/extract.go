@@ -0,0 +1,246 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExtractOptions controls how archive members are restored on disk.
+type ExtractOptions struct {
+	// UIDMap and GIDMap translate archived owner ids before they are applied.
+	// Ownership is only restored when running as root.
+	UIDMap map[int]int
+	GIDMap map[int]int
+
+	// Members limits extraction to these paths and everything below them.
+	Members []string
+	// Include and Exclude select members by pattern. A pattern matches a
+	// member's base name or full path, and matching a directory selects
+	// everything below it. Exclude wins over Include.
+	Include []string
+	Exclude []string
+	// StripComponents drops that many leading path elements from member
+	// names, skipping members with nothing left, like tar --strip-components.
+	StripComponents int
+	// Remap moves members below one path prefix to another, applied after
+	// StripComponents. The longest matching prefix is used.
+	Remap map[string]string
+}
+
+// extractor writes archive members below a fixed root and restores their
+// metadata. Directory metadata is deferred until finish so that writing
+// their contents cannot disturb permissions or timestamps.
+type extractor struct {
+	root     string
+	opts     ExtractOptions
+	chown    bool
+	rejected []string
+	dirs     []deferredDir
+}
+
+type deferredDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+func newExtractor(destDir string, opts ExtractOptions) (*extractor, error) {
+	root, err := extractRoot(destDir)
+	if err != nil {
+		return nil, err
+	}
+	return &extractor{
+		root:  root,
+		opts:  opts,
+		chown: os.Geteuid() == 0,
+	}, nil
+}
+
+func (x *extractor) reject(name string) {
+	slog.Warn("Rejecting unsafe member: " + name)
+	x.rejected = append(x.rejected, name)
+}
+
+// extract restores one member; body supplies the data of regular files.
+// Members not selected by the options are skipped.
+func (x *extractor) extract(hdr *tar.Header, body io.Reader) error {
+	name, ok := x.opts.targetName(hdr.Name)
+	if !ok {
+		return nil
+	}
+	if name != hdr.Name || hdr.Typeflag == tar.TypeLink {
+		renamed := *hdr
+		renamed.Name = name
+		if hdr.Typeflag == tar.TypeLink {
+			if renamed.Linkname, ok = x.opts.targetName(hdr.Linkname); !ok {
+				slog.Warn("Skipping hardlink to unselected member: " + hdr.Name)
+				return nil
+			}
+		}
+		hdr = &renamed
+	}
+
+	target, err := resolveInRoot(x.root, hdr.Name, hdr.Typeflag == tar.TypeDir)
+	if errors.Is(err, ErrPathEscapes) {
+		x.reject(hdr.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		x.dirs = append(x.dirs, deferredDir{path: target, hdr: hdr})
+		return nil
+	case tar.TypeReg, tar.TypeGNUSparse:
+		if isSparse(hdr) {
+			err = writeSparseFile(target, body)
+		} else {
+			err = writeRegular(target, body)
+		}
+	case tar.TypeSymlink:
+		err = writeSymlink(target, hdr.Linkname)
+	case tar.TypeLink:
+		source, err := resolveInRoot(x.root, hdr.Linkname, false)
+		if errors.Is(err, ErrPathEscapes) {
+			x.reject(hdr.Name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// The link shares its inode, and so its metadata, with source.
+		return writeHardlink(target, source)
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		if err = writeSpecial(target, hdr); errors.Is(err, os.ErrPermission) {
+			slog.Warn("Skipping special file without permission: " + hdr.Name)
+			return nil
+		}
+	default:
+		slog.Warn("Skipping unsupported member: " + hdr.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return x.applyMetadata(target, hdr)
+}
+
+// finish applies deferred directory metadata, deepest directories first,
+// and reports any members rejected along the way.
+func (x *extractor) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		if err := x.applyMetadata(x.dirs[i].path, x.dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	if len(x.rejected) > 0 {
+		return &UnsafeEntriesError{Members: x.rejected}
+	}
+	return nil
+}
+
+// applyMetadata restores ownership, mode, extended attributes and times in
+// that order: chown clears setuid bits, and every change bumps ctime.
+func (x *extractor) applyMetadata(target string, hdr *tar.Header) error {
+	isLink := hdr.Typeflag == tar.TypeSymlink
+
+	if x.chown {
+		uid, gid := hdr.Uid, hdr.Gid
+		if mapped, ok := x.opts.UIDMap[uid]; ok {
+			uid = mapped
+		}
+		if mapped, ok := x.opts.GIDMap[gid]; ok {
+			gid = mapped
+		}
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if !isLink {
+		if err := os.Chmod(target, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		if err := writeXattr(target, name, value); err != nil {
+			slog.Warn("Failed to restore xattr " + name + " on " + hdr.Name + ": " + err.Error())
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	mtime := hdr.ModTime
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+	return lchtimes(target, atime, mtime)
+}
+
+// prepareTarget creates the parent of target and removes any non-directory
+// already there, so a new entry never writes through an old link.
+func prepareTarget(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		return os.Remove(target)
+	}
+	return nil
+}
+
+// writeRegular replaces whatever is at target with the contents of r. The
+// file starts owner-only; applyMetadata sets the archived mode afterwards.
+func writeRegular(target string, r io.Reader) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func writeSymlink(target, linkname string) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	return os.Symlink(linkname, target)
+}
+
+func writeHardlink(target, source string) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	return os.Link(source, target)
+}
+
+// writeSpecial recreates FIFOs and device nodes.
+func writeSpecial(target string, hdr *tar.Header) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	return mknod(target, hdr)
+}
@@ -0,0 +1,58 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	createTestFiles(t, src, map[string]string{"tagged.txt": "x"})
+	if err := unix.Setxattr(filepath.Join(src, "tagged.txt"), "user.origin", []byte("backup"), 0); err != nil {
+		t.Skipf("user xattrs unsupported here: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UntarStream(&buf, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	val := make([]byte, 64)
+	n, err := unix.Getxattr(filepath.Join(dest, "tagged.txt"), "user.origin", val)
+	if err != nil || string(val[:n]) != "backup" {
+		t.Errorf("xattr = %q, %v", val[:n], err)
+	}
+}
+
+func TestUntarRemapsOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership is only restored as root")
+	}
+	dest := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "owned.txt", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000})
+	tw.Close()
+
+	opts := ExtractOptions{UIDMap: map[int]int{1000: 4242}, GIDMap: map[int]int{1000: 4343}}
+	if err := Untar(&buf, dest, opts); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(filepath.Join(dest, "owned.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 4242 || st.Gid != 4343 {
+		t.Errorf("owner = %d:%d, want 4242:4343", st.Uid, st.Gid)
+	}
+}
@@ -0,0 +1,54 @@
+package archive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUntarRestoresMetadata(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	createTestFiles(t, src, map[string]string{
+		"bin/run.sh":     "#!/bin/sh\n",
+		"bin/secret.key": "key",
+	})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chmod(filepath.Join(src, "bin/run.sh"), 0750)
+	os.Chmod(filepath.Join(src, "bin/secret.key"), 0400)
+	os.Chmod(filepath.Join(src, "bin"), 0511)
+	for _, p := range []string{"bin/run.sh", "bin/secret.key", "bin"} {
+		if err := os.Chtimes(filepath.Join(src, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { os.Chmod(filepath.Join(dest, "bin"), 0755) })
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UntarStream(&buf, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	wantModes := map[string]os.FileMode{
+		"bin/run.sh":     0750,
+		"bin/secret.key": 0400,
+		"bin":            0511,
+	}
+	for p, want := range wantModes {
+		fi, err := os.Stat(filepath.Join(dest, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Errorf("%s mode = %v, want %v", p, fi.Mode().Perm(), want)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s mtime = %v, want %v", p, fi.ModTime(), mtime)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux && !darwin
+
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"os"
+	"time"
+)
+
+type fileID struct{}
+
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func inode(info os.FileInfo) uint64 {
+	return 0
+}
+
+func mknod(target string, hdr *tar.Header) error {
+	return errors.New("special files are not supported on this platform")
+}
+
+func lchtimes(path string, atime, mtime time.Time) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chtimes(path, atime, mtime)
+}
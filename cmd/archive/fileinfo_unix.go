@@ -0,0 +1,62 @@
+//go:build linux || darwin
+
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies an inode so hardlinked files can be stored once.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardlinkID returns the inode identity of info when the file has more than
+// one link and may therefore appear again elsewhere in the tree.
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || uint64(st.Nlink) < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// inode returns the inode number of info, which snapshot manifests use to
+// notice files replaced by others with the same size and time.
+func inode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// mknod recreates a FIFO or device node described by hdr.
+func mknod(target string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeFifo:
+		return unix.Mkfifo(target, mode)
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	}
+	dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+	return unix.Mknod(target, mode, int(dev))
+}
+
+// lchtimes sets access and modification times without following a final
+// symlink, so links keep their own timestamps.
+func lchtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
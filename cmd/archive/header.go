@@ -0,0 +1,303 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// headerMagic opens every encrypted stream in the current format.
+var headerMagic = []byte("TRTS")
+
+const (
+	// formatVersion is written for passphrase encryption; the header holds
+	// the KDF and salt the stream keys are derived from.
+	formatVersion = 1
+	// recipientsVersion is written for public-key encryption; the header
+	// holds a random file key wrapped once per recipient.
+	recipientsVersion = 2
+
+	saltSize = 16
+
+	// headerSize is the size of a version 1 header: magic, version, KDF id,
+	// three cost parameters, salt and nonce. The header HMAC follows it.
+	headerSize = 4 + 1 + 1 + 3*4 + saltSize + nonceSize
+)
+
+var (
+	// ErrNotEncrypted is returned when a stream does not start with the
+	// encryption header.
+	ErrNotEncrypted = errors.New("not a tartarus encrypted stream")
+	// ErrUnsupportedFormat is returned for headers written by a newer
+	// version or naming an unknown KDF.
+	ErrUnsupportedFormat = errors.New("unsupported encryption format")
+	// ErrPassphraseRequired is returned when a passphrase-encrypted stream
+	// is opened without a passphrase.
+	ErrPassphraseRequired = errors.New("stream is encrypted with a passphrase")
+)
+
+// KDF identifies the password-based key derivation function in a header.
+type KDF uint8
+
+const (
+	KDFScrypt   KDF = 1
+	KDFArgon2id KDF = 2
+)
+
+func (k KDF) String() string {
+	switch k {
+	case KDFScrypt:
+		return "scrypt"
+	case KDFArgon2id:
+		return "argon2id"
+	}
+	return fmt.Sprintf("kdf(%d)", uint8(k))
+}
+
+// KDFParams selects a KDF and its cost. The three cost fields are stored in
+// the header as-is and interpreted per algorithm.
+type KDFParams struct {
+	Algorithm KDF
+	// Time is log2(N) for scrypt and the number of passes for Argon2id.
+	Time uint32
+	// Memory is the block size r for scrypt and KiB of memory for Argon2id.
+	Memory uint32
+	// Parallelism is p for scrypt and the thread count for Argon2id.
+	Parallelism uint32
+}
+
+// DefaultKDFParams is used by EncryptWriterCTR_HMAC: scrypt with N=2^15, r=8,
+// p=1, which needs 32 MiB and a fraction of a second per derivation.
+var DefaultKDFParams = KDFParams{Algorithm: KDFScrypt, Time: 15, Memory: 8, Parallelism: 1}
+
+// Argon2idKDFParams follows the RFC 9106 second recommended option.
+var Argon2idKDFParams = KDFParams{Algorithm: KDFArgon2id, Time: 3, Memory: 64 * 1024, Parallelism: 4}
+
+// ParseKDF returns the default parameters for a KDF name; empty means the
+// package default.
+func ParseKDF(name string) (KDFParams, error) {
+	switch name {
+	case "", KDFScrypt.String():
+		return DefaultKDFParams, nil
+	case KDFArgon2id.String():
+		return Argon2idKDFParams, nil
+	}
+	return KDFParams{}, fmt.Errorf("unknown kdf %q", name)
+}
+
+// validate bounds the cost parameters so that a crafted header cannot make
+// decryption allocate unbounded memory.
+func (p KDFParams) validate() error {
+	switch p.Algorithm {
+	case KDFScrypt:
+		if p.Time < 10 || p.Time > 22 || p.Memory == 0 || p.Parallelism == 0 ||
+			uint64(p.Memory)*uint64(p.Parallelism) >= 1<<30 ||
+			(uint64(128)*uint64(p.Memory))<<p.Time > 4<<30 {
+			return fmt.Errorf("%w: scrypt parameters out of range", ErrUnsupportedFormat)
+		}
+	case KDFArgon2id:
+		if p.Time == 0 || p.Time > 64 || p.Memory < 8*1024 || p.Memory > 4<<20 ||
+			p.Parallelism == 0 || p.Parallelism > 255 {
+			return fmt.Errorf("%w: argon2id parameters out of range", ErrUnsupportedFormat)
+		}
+	default:
+		return fmt.Errorf("%w: %v", ErrUnsupportedFormat, p.Algorithm)
+	}
+	return nil
+}
+
+// maxDecryptMemory caps what a header may make decryption allocate. It is
+// checked apart from validate, which bounds what may be written, so that
+// raising the encryption limits never raises what an untrusted header can
+// demand.
+const maxDecryptMemory = 1 << 30
+
+// memory returns the bytes a derivation with p allocates. p must be valid.
+func (p KDFParams) memory() uint64 {
+	switch p.Algorithm {
+	case KDFScrypt:
+		return 128 * uint64(p.Memory) * (uint64(1)<<p.Time + uint64(p.Parallelism))
+	case KDFArgon2id:
+		return uint64(p.Memory) << 10
+	}
+	return 0
+}
+
+// deriveKeys stretches the passphrase into independent AES-256 and HMAC keys.
+func deriveKeys(passphrase, salt []byte, p KDFParams) (encKey, hmacKey []byte, err error) {
+	if err := p.validate(); err != nil {
+		return nil, nil, err
+	}
+	var key []byte
+	switch p.Algorithm {
+	case KDFScrypt:
+		key, err = scrypt.Key(passphrase, salt, 1<<p.Time, int(p.Memory), int(p.Parallelism), aesKeySize+hmacSize)
+	case KDFArgon2id:
+		key = argon2.IDKey(passphrase, salt, p.Time, p.Memory, uint8(p.Parallelism), aesKeySize+hmacSize)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return key[:aesKeySize], key[aesKeySize:], nil
+}
+
+// streamHeader is the versioned preamble of an encrypted stream. It is
+// followed by an HMAC over its encoding so that parameters cannot be
+// altered and wrong keys are detected before any data is read.
+type streamHeader struct {
+	version uint8
+	nonce   []byte
+
+	// version 1
+	kdf  KDFParams
+	salt []byte
+
+	// version 2
+	stanzas []recipientStanza
+}
+
+func newStreamHeader(p KDFParams) (*streamHeader, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	h := &streamHeader{
+		version: formatVersion,
+		kdf:     p,
+		salt:    make([]byte, saltSize),
+		nonce:   make([]byte, nonceSize),
+	}
+	if _, err := rand.Read(h.salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(h.nonce); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *streamHeader) marshal() []byte {
+	b := append([]byte{}, headerMagic...)
+	b = append(b, h.version)
+	switch h.version {
+	case formatVersion:
+		b = append(b, byte(h.kdf.Algorithm))
+		b = binary.BigEndian.AppendUint32(b, h.kdf.Time)
+		b = binary.BigEndian.AppendUint32(b, h.kdf.Memory)
+		b = binary.BigEndian.AppendUint32(b, h.kdf.Parallelism)
+		b = append(b, h.salt...)
+	case recipientsVersion:
+		b = append(b, byte(len(h.stanzas)))
+		for _, st := range h.stanzas {
+			b = append(b, st.ephemeral...)
+			b = append(b, st.wrapped...)
+		}
+	}
+	return append(b, h.nonce...)
+}
+
+// streamKeys returns the encryption and HMAC keys for the stream, using
+// whichever of the supplied keys the header calls for.
+func (h *streamHeader) streamKeys(keys Keys) (encKey, hmacKey []byte, err error) {
+	if h.version == recipientsVersion {
+		fileKey, err := unwrapFileKey(h.stanzas, keys.Identities)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fileKeyStreamKeys(fileKey, h.nonce)
+	}
+	if keys.Passphrase == nil {
+		return nil, nil, ErrPassphraseRequired
+	}
+	if err := h.kdf.validate(); err != nil {
+		return nil, nil, err
+	}
+	if m := h.kdf.memory(); m > maxDecryptMemory {
+		return nil, nil, fmt.Errorf("%w: %v needs %d MiB, at most %d MiB is accepted when decrypting",
+			ErrUnsupportedFormat, h.kdf.Algorithm, m>>20, maxDecryptMemory>>20)
+	}
+	return deriveKeys(keys.Passphrase, h.salt, h.kdf)
+}
+
+func headerMAC(hmacKey, encoded []byte) []byte {
+	m := hmac.New(sha256.New, hmacKey)
+	m.Write(encoded)
+	return m.Sum(nil)
+}
+
+// readStreamHeader reads and parses the header, leaving its HMAC unread. The
+// raw header bytes are returned for verifying that HMAC.
+func readStreamHeader(r io.Reader) (*streamHeader, []byte, error) {
+	var encoded []byte
+	read := func(n int) ([]byte, error) {
+		start := len(encoded)
+		encoded = append(encoded, make([]byte, n)...)
+		if _, err := io.ReadFull(r, encoded[start:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, ErrTruncated
+			}
+			return nil, err
+		}
+		return encoded[start:], nil
+	}
+
+	magic, err := read(len(headerMagic))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(magic, headerMagic) {
+		return nil, nil, ErrNotEncrypted
+	}
+	version, err := read(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &streamHeader{version: version[0]}
+
+	switch h.version {
+	case formatVersion:
+		b, err := read(1 + 3*4 + saltSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.kdf = KDFParams{
+			Algorithm:   KDF(b[0]),
+			Time:        binary.BigEndian.Uint32(b[1:]),
+			Memory:      binary.BigEndian.Uint32(b[5:]),
+			Parallelism: binary.BigEndian.Uint32(b[9:]),
+		}
+		h.salt = b[13:]
+	case recipientsVersion:
+		count, err := read(1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if count[0] == 0 {
+			return nil, nil, fmt.Errorf("%w: no recipients", ErrUnsupportedFormat)
+		}
+		b, err := read(int(count[0]) * stanzaSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		for ; len(b) > 0; b = b[stanzaSize:] {
+			h.stanzas = append(h.stanzas, recipientStanza{
+				ephemeral: b[:x25519KeySize],
+				wrapped:   b[x25519KeySize:stanzaSize],
+			})
+		}
+	default:
+		return nil, nil, fmt.Errorf("%w: version %d", ErrUnsupportedFormat, h.version)
+	}
+
+	if h.nonce, err = read(nonceSize); err != nil {
+		return nil, nil, err
+	}
+	return h, encoded, nil
+}
@@ -0,0 +1,451 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// An indexed container stores the tar stream in blocks that are compressed
+// and authenticated independently, followed by an encrypted index of the
+// blocks and members, so that one member can be read without the data
+// before it:
+//
+//	"TRTX" | version | stream header | header HMAC
+//	block 0 .. block n-1    each ciphertext || HMAC
+//	index                   ciphertext || HMAC
+//	index position (8) | index length (8) | "TRTX"
+//
+// The stream header is the one used by encrypted streams, so passphrases and
+// recipients work the same way. Block i is encrypted with AES-256-CTR from
+// its own counter range and authenticated like chunk i of a stream; the
+// index uses the last index and the final flag.
+
+var indexMagic = []byte("TRTX")
+
+const (
+	indexVersion = 1
+	// indexBlockSize is the amount of tar data compressed into one block.
+	indexBlockSize  = 1 << 20
+	indexFooterSize = 8 + 8 + 4
+	// indexBlockIndex authenticates the index itself.
+	indexBlockIndex = math.MaxUint64
+	// maxIndexSize bounds the index read from a footer.
+	maxIndexSize = 1 << 30
+)
+
+var (
+	// ErrNotIndexed is returned when a file is not an indexed container.
+	ErrNotIndexed = errors.New("not an indexed archive")
+	// ErrMemberNotFound is returned for names missing from the index.
+	ErrMemberNotFound = errors.New("archive member not found")
+)
+
+// IndexedMember is a Member with the position of its tar header in the
+// uncompressed stream.
+type IndexedMember struct {
+	Member
+	Offset int64 `json:"offset"`
+}
+
+type indexBlock struct {
+	Offset int64 `json:"offset"` // first tar byte held by the block
+	Pos    int64 `json:"pos"`    // position of the sealed block in the file
+	Length int64 `json:"length"` // sealed length, HMAC included
+}
+
+type containerIndex struct {
+	Codec   string          `json:"codec"`
+	Blocks  []indexBlock    `json:"blocks"`
+	Members []IndexedMember `json:"members"`
+}
+
+// blockSealer encrypts and authenticates blocks with the stream keys.
+type blockSealer struct {
+	block cipher.Block
+	mac   chunkMAC
+}
+
+func newBlockSealer(hdr *streamHeader, encKey, hmacKey []byte) (*blockSealer, error) {
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	return &blockSealer{
+		block: block,
+		mac:   chunkMAC{hmac: hmac.New(sha256.New, hmacKey), nonce: hdr.nonce},
+	}, nil
+}
+
+// stream returns the keystream for block index: the nonce prefix, the index
+// and a 32-bit block counter, so blocks up to 64 GiB never share counters.
+func (s *blockSealer) stream(index uint64) cipher.Stream {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, s.mac.nonce[:4])
+	binary.BigEndian.PutUint64(iv[4:], index)
+	return cipher.NewCTR(s.block, iv)
+}
+
+func (s *blockSealer) seal(index uint64, plain []byte, final bool) []byte {
+	out := make([]byte, len(plain), len(plain)+hmacSize)
+	s.stream(index).XORKeyStream(out, plain)
+	s.mac.index = index
+	return append(out, s.mac.sum(out, final)...)
+}
+
+func (s *blockSealer) open(index uint64, sealed []byte, final bool) ([]byte, error) {
+	if len(sealed) < hmacSize {
+		return nil, ErrTruncated
+	}
+	ciphertext := sealed[:len(sealed)-hmacSize]
+	s.mac.index = index
+	if !hmac.Equal(s.mac.sum(ciphertext, final), sealed[len(ciphertext):]) {
+		return nil, ErrAuthentication
+	}
+	plain := make([]byte, len(ciphertext))
+	s.stream(index).XORKeyStream(plain, ciphertext)
+	return plain, nil
+}
+
+// countingWriter tracks the position in the output.
+type countingWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// indexWriter receives the tar stream and cuts it into sealed blocks.
+type indexWriter struct {
+	out    *countingWriter
+	sealer *blockSealer
+	codec  *Codec
+	level  int
+	buf    []byte
+	offset int64 // tar bytes written so far
+	index  containerIndex
+}
+
+func (w *indexWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := copy(w.buf[len(w.buf):indexBlockSize], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		w.offset += int64(k)
+		p = p[k:]
+		if len(w.buf) == indexBlockSize {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *indexWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var compressed bytes.Buffer
+	cw, err := w.codec.NewWriter(&compressed, w.level)
+	if err != nil {
+		return err
+	}
+	if _, err := cw.Write(w.buf); err != nil {
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	sealed := w.sealer.seal(uint64(len(w.index.Blocks)), compressed.Bytes(), false)
+	w.index.Blocks = append(w.index.Blocks, indexBlock{
+		Offset: w.offset - int64(len(w.buf)),
+		Pos:    w.out.pos,
+		Length: int64(len(sealed)),
+	})
+	w.buf = w.buf[:0]
+	_, err = w.out.Write(sealed)
+	return err
+}
+
+// finish writes the last block, the index and the footer.
+func (w *indexWriter) finish() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(w.index)
+	if err != nil {
+		return err
+	}
+	sealed := w.sealer.seal(indexBlockIndex, encoded, true)
+	footer := binary.BigEndian.AppendUint64(nil, uint64(w.out.pos))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(len(sealed)))
+	footer = append(footer, indexMagic...)
+	if _, err := w.out.Write(sealed); err != nil {
+		return err
+	}
+	_, err = w.out.Write(footer)
+	return err
+}
+
+// indexEntryWriter records where each member starts before writing it.
+type indexEntryWriter struct {
+	tarEntryWriter
+	iw *indexWriter
+}
+
+func (e indexEntryWriter) writeEntry(hdr *tar.Header, path string) error {
+	return e.writeFile(hdr, path, nil)
+}
+
+func (e indexEntryWriter) writeFile(hdr *tar.Header, path string, digest io.Writer) error {
+	// Flush pads the previous member so the offset is that of the header.
+	if err := e.tw.Flush(); err != nil {
+		return err
+	}
+	e.iw.index.Members = append(e.iw.index.Members, IndexedMember{
+		Member: newMember(hdr),
+		Offset: e.iw.offset,
+	})
+	return e.tarEntryWriter.writeFile(hdr, path, digest)
+}
+
+// writeIndexed writes inputDir to w as an indexed container.
+func (o ArchiveOptions) writeIndexed(inputDir string, w io.Writer) error {
+	codec, err := LookupCodec(o.Codec)
+	if err != nil {
+		return err
+	}
+	if codec.NewWriter == nil {
+		return fmt.Errorf("codec %q is read-only", codec.Name)
+	}
+	hdr, encKey, hmacKey, err := o.newStream()
+	if err != nil {
+		return err
+	}
+	sealer, err := newBlockSealer(hdr, encKey, hmacKey)
+	if err != nil {
+		return err
+	}
+
+	out := &countingWriter{w: w}
+	encoded := hdr.marshal()
+	prefix := append(append([]byte{}, indexMagic...), indexVersion)
+	for _, b := range [][]byte{prefix, encoded, headerMAC(hmacKey, encoded)} {
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+
+	iw := &indexWriter{
+		out:    out,
+		sealer: sealer,
+		codec:  codec,
+		level:  o.CompressLevel,
+		buf:    make([]byte, 0, indexBlockSize),
+		index:  containerIndex{Codec: codec.Name},
+	}
+	tw := tar.NewWriter(iw)
+	entries := indexEntryWriter{tarEntryWriter{tw, iw, o.Tar.Reproducible != nil}, iw}
+	if err := o.walkInto(inputDir, entries); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return iw.finish()
+}
+
+// IndexedReader reads members of an indexed container directly.
+type IndexedReader struct {
+	r      io.ReaderAt
+	sealer *blockSealer
+	codec  *Codec
+	index  containerIndex
+	byName map[string]int
+}
+
+// OpenIndexed checks the header and index of the container in r, which is
+// size bytes long and may carry a trailing signature, and returns a reader
+// for its members.
+func OpenIndexed(r io.ReaderAt, size int64, keys Keys) (*IndexedReader, error) {
+	stripped, err := stripSignature(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	sr := stripped.(*io.SectionReader)
+	size = sr.Size()
+
+	br := bufio.NewReader(sr)
+	prefix := make([]byte, len(indexMagic)+1)
+	if _, err := io.ReadFull(br, prefix); err != nil || !bytes.Equal(prefix[:4], indexMagic) {
+		return nil, ErrNotIndexed
+	}
+	if prefix[4] != indexVersion {
+		return nil, fmt.Errorf("%w: index version %d", ErrUnsupportedFormat, prefix[4])
+	}
+	hdr, encKey, hmacKey, err := openStream(br, keys)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newBlockSealer(hdr, encKey, hmacKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if size < indexFooterSize {
+		return nil, ErrTruncated
+	}
+	footer := make([]byte, indexFooterSize)
+	if _, err := sr.ReadAt(footer, size-indexFooterSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[16:], indexMagic) {
+		return nil, ErrTruncated
+	}
+	pos, length := binary.BigEndian.Uint64(footer), binary.BigEndian.Uint64(footer[8:])
+	if length > maxIndexSize || pos+length > uint64(size-indexFooterSize) {
+		return nil, ErrTruncated
+	}
+	sealed := make([]byte, length)
+	if _, err := sr.ReadAt(sealed, int64(pos)); err != nil {
+		return nil, err
+	}
+	encoded, err := sealer.open(indexBlockIndex, sealed, true)
+	if err != nil {
+		return nil, err
+	}
+
+	ir := &IndexedReader{r: sr, sealer: sealer, byName: make(map[string]int)}
+	if err := json.Unmarshal(encoded, &ir.index); err != nil {
+		return nil, err
+	}
+	if ir.codec, err = LookupCodec(ir.index.Codec); err != nil {
+		return nil, err
+	}
+	for i, m := range ir.index.Members {
+		ir.byName[memberPath(m.Name)] = i
+	}
+	return ir, nil
+}
+
+// Members lists the members in archive order.
+func (ir *IndexedReader) Members() []IndexedMember {
+	return ir.index.Members
+}
+
+// Open returns the contents of the named regular file, or of the file a
+// hardlink refers to, with its index entry. Only the blocks holding the
+// member are read.
+func (ir *IndexedReader) Open(name string) (io.Reader, *IndexedMember, error) {
+	i, ok := ir.byName[memberPath(name)]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrMemberNotFound, name)
+	}
+	m := ir.index.Members[i]
+	data := m
+	if m.Type == memberTypes[tar.TypeLink] {
+		if j, ok := ir.byName[memberPath(m.Linkname)]; ok {
+			data = ir.index.Members[j]
+			m.Size = data.Size
+		}
+	}
+	if data.Type != memberTypes[tar.TypeReg] {
+		return nil, nil, fmt.Errorf("%s is not a regular file", name)
+	}
+
+	tr := tar.NewReader(ir.streamFrom(data.Offset))
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hdr.Name != data.Name {
+		return nil, nil, fmt.Errorf("%w: index does not match data at %s", ErrAuthentication, name)
+	}
+	return tr, &m, nil
+}
+
+// streamFrom returns the tar stream starting at offset.
+func (ir *IndexedReader) streamFrom(offset int64) io.Reader {
+	first := 0
+	for first+1 < len(ir.index.Blocks) && ir.index.Blocks[first+1].Offset <= offset {
+		first++
+	}
+	return &indexStreamReader{ir: ir, next: first, skip: offset}
+}
+
+// tarStream returns the whole tar stream.
+func (ir *IndexedReader) tarStream() io.Reader {
+	return ir.streamFrom(0)
+}
+
+type indexStreamReader struct {
+	ir    *IndexedReader
+	next  int
+	skip  int64 // tar offset to start at
+	plain []byte
+}
+
+func (s *indexStreamReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.next >= len(s.ir.index.Blocks) {
+			return 0, io.EOF
+		}
+		if err := s.load(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+// load verifies, decrypts and decompresses the next block.
+func (s *indexStreamReader) load() error {
+	b := s.ir.index.Blocks[s.next]
+	sealed := make([]byte, b.Length)
+	if _, err := s.ir.r.ReadAt(sealed, b.Pos); err != nil {
+		if err == io.EOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	compressed, err := s.ir.sealer.open(uint64(s.next), sealed, false)
+	if err != nil {
+		return err
+	}
+	dec, err := s.ir.codec.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	plain, err := io.ReadAll(dec)
+	if err != nil {
+		return err
+	}
+
+	if skip := s.skip - b.Offset; skip > 0 {
+		if skip > int64(len(plain)) {
+			skip = int64(len(plain))
+		}
+		plain = plain[skip:]
+	}
+	s.plain = plain
+	s.next++
+	return nil
+}
@@ -0,0 +1,90 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexedContainer(t *testing.T) {
+	inputDir := t.TempDir()
+	big := make([]byte, 3*indexBlockSize/2)
+	rand.Read(big)
+	createTestFiles(t, inputDir, map[string]string{
+		"a/first.txt": "first",
+		"z/last.txt":  "last member",
+	})
+	if err := os.WriteFile(filepath.Join(inputDir, "m.bin"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pass := []byte("indexed")
+	key, _ := GenerateSigningKey()
+
+	var buf bytes.Buffer
+	opts := ArchiveOptions{Indexed: true, Codec: "zstd", Passphrase: pass, SigningKey: key}
+	if err := Archive(inputDir, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	ir, err := OpenIndexed(bytes.NewReader(data), int64(len(data)), Keys{Passphrase: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ir.index.Blocks) < 2 {
+		t.Fatalf("expected the data to span blocks, got %d", len(ir.index.Blocks))
+	}
+	r, m, err := ir.Open("z/last.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "last member" || m.Size != int64(len("last member")) {
+		t.Errorf("last.txt = %q, %+v, %v", got, m, err)
+	}
+	if r, _, err = ir.Open("m.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("m.bin mismatch: %v", err)
+	}
+	if _, _, err := ir.Open("missing"); !errors.Is(err, ErrMemberNotFound) {
+		t.Errorf("missing member: got %v", err)
+	}
+
+	outputDir := t.TempDir()
+	if err := Extract(bytes.NewReader(data), outputDir, Keys{Passphrase: pass}, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(outputDir, "a/first.txt")); got != "first" {
+		t.Errorf("first.txt = %q", got)
+	}
+
+	if _, err := OpenIndexed(bytes.NewReader(data), int64(len(data)), Keys{Passphrase: []byte("wrong")}); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("wrong passphrase: got %v", err)
+	}
+}
+
+func TestIndexedRejectsTamperedBlock(t *testing.T) {
+	inputDir := t.TempDir()
+	createTestFiles(t, inputDir, map[string]string{"f.txt": "payload"})
+	pass := []byte("indexed")
+
+	var buf bytes.Buffer
+	if err := Archive(inputDir, &buf, ArchiveOptions{Indexed: true, Passphrase: pass}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	ir, err := OpenIndexed(bytes.NewReader(data), int64(len(data)), Keys{Passphrase: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[ir.index.Blocks[0].Pos] ^= 1
+	if _, _, err := ir.Open("f.txt"); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("tampered block: got %v, want ErrAuthentication", err)
+	}
+}
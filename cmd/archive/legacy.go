@@ -0,0 +1,277 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Streams written before the versioned header existed are laid out as
+// nonce || AES-CTR ciphertext || HMAC-SHA256, keyed by a single unsalted
+// SHA-256 of the passphrase. They are still readable but never written.
+
+// ErrNotLegacy is returned by the migration helpers for streams that are
+// already in the current format.
+var ErrNotLegacy = errors.New("stream is already in the current format")
+
+func deriveLegacyKeys(passphrase []byte) (encKey, hmacKey []byte) {
+	hash := sha256.Sum256(passphrase)
+	return hash[:16], hash[16:]
+}
+
+// isLegacy peeks at br and reports whether it holds a stream without the
+// versioned header.
+func isLegacy(br *bufio.Reader) (bool, error) {
+	magic, err := br.Peek(len(headerMagic))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, ErrTruncated
+	}
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(magic, headerMagic), nil
+}
+
+// maxLegacyBuffer bounds how much of a legacy stream that cannot be seeked
+// is buffered to check its HMAC. Anything not starting with the current
+// header looks legacy, so this is also what a stray input can cost.
+const maxLegacyBuffer = 64 << 20
+
+// decryptLegacy verifies and decrypts a legacy stream. The HMAC trails the
+// data, so when src is seekable it is checked in a first pass and the data
+// decrypted in a second; otherwise the ciphertext has to be buffered, up to
+// maxLegacyBuffer.
+func decryptLegacy(src io.Reader, br *bufio.Reader, passphrase []byte) (io.Reader, error) {
+	encKey, hmacKey := deriveLegacyKeys(passphrase)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if rs, ok := src.(io.ReadSeeker); ok {
+		pos, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			return decryptLegacySeekable(rs, pos-int64(br.Buffered()), block, hmacKey)
+		}
+	}
+
+	encryptedData, err := io.ReadAll(io.LimitReader(br, maxLegacyBuffer+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(encryptedData) > maxLegacyBuffer {
+		return nil, fmt.Errorf("%w: legacy stream over %d MiB must be read from a file",
+			ErrUnsupportedFormat, maxLegacyBuffer>>20)
+	}
+	if len(encryptedData) < nonceSize+hmacSize {
+		return nil, errors.New("data too short for HMAC")
+	}
+
+	nonce := encryptedData[:nonceSize]
+	data := encryptedData[nonceSize : len(encryptedData)-hmacSize]
+	expectedMAC := encryptedData[len(encryptedData)-hmacSize:]
+
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(data)
+	if !hmac.Equal(h.Sum(nil), expectedMAC) {
+		return nil, ErrAuthentication
+	}
+
+	return &cipher.StreamReader{
+		S: cipher.NewCTR(block, nonce),
+		R: bytes.NewReader(data),
+	}, nil
+}
+
+func decryptLegacySeekable(rs io.ReadSeeker, start int64, block cipher.Block, hmacKey []byte) (io.Reader, error) {
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	dataLen := end - start - nonceSize - hmacSize
+	if dataLen < 0 {
+		return nil, errors.New("data too short for HMAC")
+	}
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rs, nonce); err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, hmacKey)
+	if _, err := io.CopyN(h, rs, dataLen); err != nil {
+		return nil, err
+	}
+	expectedMAC := make([]byte, hmacSize)
+	if _, err := io.ReadFull(rs, expectedMAC); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(h.Sum(nil), expectedMAC) {
+		return nil, ErrAuthentication
+	}
+
+	if _, err := rs.Seek(start+nonceSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &cipher.StreamReader{
+		S: cipher.NewCTR(block, nonce),
+		R: io.LimitReader(rs, dataLen),
+	}, nil
+}
+
+// legacyStreamReader decrypts a legacy stream in one pass, holding back the
+// trailing HMAC and checking it at EOF. Its output is unverified until Read
+// returns io.EOF, so it is only used where the result is discarded on error.
+type legacyStreamReader struct {
+	src    io.Reader
+	stream cipher.Stream
+	mac    hash.Hash
+	tail   []byte
+	buf    []byte
+}
+
+func newLegacyStreamReader(src io.Reader, passphrase []byte) (*legacyStreamReader, error) {
+	encKey, hmacKey := deriveLegacyKeys(passphrase)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(src, nonce); err != nil {
+		return nil, ErrTruncated
+	}
+	return &legacyStreamReader{
+		src:    src,
+		stream: cipher.NewCTR(block, nonce),
+		mac:    hmac.New(sha256.New, hmacKey),
+		buf:    make([]byte, bufferSize+hmacSize),
+	}, nil
+}
+
+func (r *legacyStreamReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(p) > bufferSize {
+		p = p[:bufferSize]
+	}
+	for {
+		copy(r.buf, r.tail)
+		n, err := r.src.Read(r.buf[len(r.tail) : len(r.tail)+len(p)])
+		data := r.buf[:len(r.tail)+n]
+
+		out := 0
+		if len(data) > hmacSize {
+			out = len(data) - hmacSize
+			r.mac.Write(data[:out])
+			r.stream.XORKeyStream(p[:out], data[:out])
+		}
+		r.tail = append(r.tail[:0], data[out:]...)
+
+		if err == io.EOF {
+			if out > 0 {
+				return out, nil
+			}
+			if len(r.tail) < hmacSize {
+				return 0, errors.New("data too short for HMAC")
+			}
+			if !hmac.Equal(r.mac.Sum(nil), r.tail) {
+				return 0, ErrAuthentication
+			}
+			return 0, io.EOF
+		}
+		if err != nil || out > 0 {
+			return out, err
+		}
+	}
+}
+
+// MigrateLegacy re-encrypts a legacy stream from src into the current format
+// on dst in a single streaming pass. The legacy HMAC can only be checked once
+// all input is consumed, so dst must be discarded if an error is returned.
+// The SHA-256 of the plaintext is returned for verifying the new stream.
+func MigrateLegacy(dst io.Writer, src io.Reader, passphrase []byte, params KDFParams) ([]byte, error) {
+	br := bufio.NewReaderSize(src, bufferSize)
+	legacy, err := isLegacy(br)
+	if err != nil {
+		return nil, err
+	}
+	if !legacy {
+		return nil, ErrNotLegacy
+	}
+
+	plain, err := newLegacyStreamReader(br, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := EncryptWriterWithKDF(dst, passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(enc, digest), plain); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
+
+// MigrateLegacyFile migrates the legacy archive at src into dst. The result
+// is written to a temporary file next to dst, decrypted again and compared
+// with the original plaintext digest, and only then renamed into place.
+func MigrateLegacyFile(src, dst string, passphrase []byte, params KDFParams) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".migrate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	want, err := MigrateLegacy(tmp, in, passphrase, params)
+	if err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dec, err := DecryptReaderCTR_HMAC(tmp, passphrase)
+	if err != nil {
+		return err
+	}
+	got := sha256.New()
+	if _, err := io.Copy(got, dec); err != nil {
+		return err
+	}
+	if !bytes.Equal(got.Sum(nil), want) {
+		return errors.New("migrated archive does not match the original plaintext")
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,105 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encryptLegacy reproduces the original nonce || ciphertext || HMAC layout.
+func encryptLegacy(t *testing.T, plaintext, pass []byte) []byte {
+	t.Helper()
+	encKey, hmacKey := deriveLegacyKeys(pass)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, nonceSize)
+	rand.Read(nonce)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, nonce).XORKeyStream(ciphertext, plaintext)
+	h := hmac.New(sha256.New, hmacKey)
+	h.Write(ciphertext)
+
+	out := append(append([]byte{}, nonce...), ciphertext...)
+	return append(out, h.Sum(nil)...)
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	pass := []byte("old-pass")
+	plaintext := bytes.Repeat([]byte("legacy archive "), 10000)
+	data := encryptLegacy(t, plaintext, pass)
+
+	// bytes.Reader is seekable; wrapping it hides that to hit the buffered path.
+	readers := map[string]io.Reader{
+		"seekable": bytes.NewReader(data),
+		"stream":   io.MultiReader(bytes.NewReader(data)),
+	}
+	for name, r := range readers {
+		dec, err := DecryptReaderCTR_HMAC(r, pass)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := io.ReadAll(dec)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%s: legacy roundtrip failed: %v", name, err)
+		}
+	}
+
+	if _, err := DecryptReaderCTR_HMAC(bytes.NewReader(data), []byte("wrong")); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("wrong passphrase: got %v, want ErrAuthentication", err)
+	}
+}
+
+func TestDecryptLegacyStreamBounded(t *testing.T) {
+	// Not the current header, so it is taken for a legacy stream.
+	r := io.MultiReader(bytes.NewReader([]byte("garbage")), io.LimitReader(zeros{}, maxLegacyBuffer+1))
+	if _, err := DecryptReaderCTR_HMAC(r, []byte("pass")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("oversized legacy stream: got %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	pass := []byte("old-pass")
+	plaintext := bytes.Repeat([]byte("migrate me "), 20000)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "old.enc")
+	dst := filepath.Join(dir, "new.enc")
+	if err := os.WriteFile(src, encryptLegacy(t, plaintext, pass), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateLegacyFile(src, dst, pass, DefaultKDFParams); err != nil {
+		t.Fatal(err)
+	}
+	migrated, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(migrated, headerMagic) {
+		t.Fatal("migrated archive lacks the versioned header")
+	}
+	got, err := decryptBytes(migrated, pass)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("migrated archive does not decrypt: %v", err)
+	}
+
+	if err := MigrateLegacyFile(dst, filepath.Join(dir, "again.enc"), pass, DefaultKDFParams); !errors.Is(err, ErrNotLegacy) {
+		t.Errorf("migrating current format: got %v, want ErrNotLegacy", err)
+	}
+
+	corrupt := encryptLegacy(t, plaintext, pass)
+	corrupt[nonceSize+10] ^= 1
+	var out bytes.Buffer
+	if _, err := MigrateLegacy(&out, bytes.NewReader(corrupt), pass, DefaultKDFParams); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("corrupt legacy input: got %v, want ErrAuthentication", err)
+	}
+}
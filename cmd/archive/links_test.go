@@ -0,0 +1,150 @@
+//go:build linux || darwin
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTarPreservesLinks(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	createTestFiles(t, src, map[string]string{"data/file.txt": "payload"})
+	if err := os.Symlink("data/file.txt", filepath.Join(src, "sym")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "data/file.txt"), filepath.Join(src, "hard")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "pipe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	types := map[string]byte{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	var payloads int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types[hdr.Name] = hdr.Typeflag
+		if hdr.Size > 0 {
+			payloads++
+		}
+	}
+	if types["sym"] != tar.TypeSymlink || types["pipe"] != tar.TypeFifo {
+		t.Fatalf("unexpected entry types: %v", types)
+	}
+	if payloads != 1 {
+		t.Errorf("hardlinked data stored %d times, want 1", payloads)
+	}
+
+	if err := UntarStream(&buf, dest); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "sym")); err != nil || link != "data/file.txt" {
+		t.Errorf("symlink = %q, %v", link, err)
+	}
+	a, _ := os.Stat(filepath.Join(dest, "data/file.txt"))
+	b, err := os.Stat(filepath.Join(dest, "hard"))
+	if err != nil || !os.SameFile(a, b) {
+		t.Errorf("hardlink not recreated: %v", err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dest, "pipe")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("fifo not recreated: %v", err)
+	}
+}
+
+func TestTarFollowSymlinks(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	createTestFiles(t, src, map[string]string{"real/inner.txt": "inner"})
+	os.Symlink("real", filepath.Join(src, "alias"))
+	os.Symlink("..", filepath.Join(src, "real", "loop"))
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{FollowSymlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := UntarStream(&buf, dest); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Lstat(filepath.Join(dest, "alias"))
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("alias should be a real directory: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dest, "alias", "inner.txt")); got != "inner" {
+		t.Errorf("alias/inner.txt = %q", got)
+	}
+}
+
+func TestTarFollowSymlinksMutualLoop(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{"a/one.txt": "1", "b/two.txt": "2"})
+	os.Symlink("../b", filepath.Join(src, "a", "l1"))
+	os.Symlink("../a", filepath.Join(src, "b", "l2"))
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{FollowSymlinks: true}); err != nil {
+		t.Fatal(err)
+	}
+	members, err := List(bytes.NewReader(buf.Bytes()), Keys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, m := range members {
+		names[m.Name] = true
+	}
+	if !names["a/l1/two.txt"] || !names["b/l2/one.txt"] || len(members) > 12 {
+		t.Errorf("archived %v", names)
+	}
+}
+
+func TestZipStoresSymlinks(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	createTestFiles(t, src, map[string]string{"data/file.txt": "payload"})
+	if err := os.Symlink("data/file.txt", filepath.Join(src, "sym")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "data/file.txt"), filepath.Join(src, "hard")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(src, "pipe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ZipFolder(src, &buf, ZipOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unzip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dest, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "sym")); err != nil || link != "data/file.txt" {
+		t.Errorf("symlink = %q, %v", link, err)
+	}
+	if got := readFile(t, filepath.Join(dest, "hard")); got != "payload" {
+		t.Errorf("hardlink copy = %q", got)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "pipe")); err == nil {
+		t.Error("fifo should not be stored in zip")
+	}
+}
@@ -0,0 +1,113 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Member describes one entry of an archive.
+type Member struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	ModTime  time.Time   `json:"mtime"`
+	Linkname string      `json:"link,omitempty"`
+}
+
+// memberTypes names tar entry types for listings.
+var memberTypes = map[byte]string{
+	tar.TypeReg:     "file",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeFifo:    "fifo",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+}
+
+func newMember(hdr *tar.Header) Member {
+	typ, ok := memberTypes[hdr.Typeflag]
+	if !ok {
+		typ = fmt.Sprintf("other(%q)", hdr.Typeflag)
+	}
+	return Member{
+		Name:     hdr.Name,
+		Type:     typ,
+		Size:     hdr.Size,
+		Mode:     hdr.FileInfo().Mode(),
+		ModTime:  hdr.ModTime,
+		Linkname: hdr.Linkname,
+	}
+}
+
+// List returns the members of an archive of any supported layout without
+// extracting it. Encrypted archives are read to the end so that a listing
+// is only returned for data that authenticates.
+func List(input io.Reader, keys Keys) ([]Member, error) {
+	o, err := Open(input, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+	return o.list()
+}
+
+func (o *Opened) list() ([]Member, error) {
+	var members []Member
+	switch o.Format() {
+	case FormatTar:
+		tr := newTarReader(o)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, newMember(hdr))
+		}
+	case FormatZip:
+		ra, size, cleanup, err := o.readerAt("")
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		zr, err := zip.NewReader(ra, size)
+		if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			hdr, err := zipHeader(f)
+			if err != nil && !errors.Is(err, errZipLinkTooLong) {
+				return nil, err
+			}
+			if hdr == nil {
+				members = append(members, Member{Name: f.Name, Type: "other", Size: int64(f.UncompressedSize64), Mode: f.Mode(), ModTime: f.Modified})
+				continue
+			}
+			members = append(members, newMember(hdr))
+		}
+	case FormatIndexed:
+		ir, cleanup, err := o.indexed("")
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		for _, m := range ir.Members() {
+			members = append(members, m.Member)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedArchive, o.Format())
+	}
+	if err := o.verify(); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
@@ -0,0 +1,59 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+func TestListPipeline(t *testing.T) {
+	inputDir := t.TempDir()
+	createTestFiles(t, inputDir, map[string]string{
+		"etc/app.conf": "key=value",
+		"readme.txt":   "hello",
+	})
+	pass := []byte("list-pass")
+
+	for _, format := range []Format{FormatTar, FormatZip} {
+		var buf bytes.Buffer
+		if err := Archive(inputDir, &buf, ArchiveOptions{Format: format, Passphrase: pass}); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		members, err := List(bytes.NewReader(data), Keys{Passphrase: pass})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		byName := map[string]Member{}
+		for _, m := range members {
+			byName[m.Name] = m
+		}
+		if m := byName["etc/app.conf"]; m.Type != "file" || m.Size != 9 || m.Mode.Perm() != 0644 {
+			t.Errorf("%s: app.conf = %+v", format, m)
+		}
+		if m := byName["etc/"]; m.Type != "dir" {
+			t.Errorf("%s: etc/ = %+v", format, m)
+		}
+
+		tampered := append([]byte{}, data...)
+		tampered[len(tampered)-1] ^= 1
+		if _, err := List(bytes.NewReader(tampered), Keys{Passphrase: pass}); err == nil {
+			t.Errorf("%s: tampered archive listed", format)
+		}
+	}
+}
+
+func TestListPlainTar(t *testing.T) {
+	buf := buildTar(t, []tarEntry{
+		{name: "dir/", typeflag: tar.TypeDir},
+		{name: "dir/link", typeflag: tar.TypeSymlink, linkname: "../target"},
+	})
+	members, err := List(buf, Keys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || members[1].Type != "symlink" || members[1].Linkname != "../target" {
+		t.Errorf("members = %+v", members)
+	}
+}
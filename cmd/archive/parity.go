@@ -0,0 +1,368 @@
+package archive
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Parity protects the finished archive bytes, after encryption and signing,
+// so damage can be repaired before anything is decrypted. The archive is
+// cut into shards; every stripe of parityDataShards shards gets Reed-Solomon
+// parity shards, and every shard a CRC-32C so that damaged ones can be
+// located. The parity section is
+//
+//	parity shards, stripe by stripe
+//	metadata JSON
+//	metaLen u32 | metaCRC u32 | sectionLen u64 | "TRTP"
+//
+// and is either appended to the archive or written to a sidecar file. The
+// metadata itself is only checksummed, not repairable.
+
+var parityMagic = []byte("TRTP")
+
+const (
+	parityVersion     = 1
+	parityShardSize   = 16 << 10
+	parityDataShards  = 32
+	parityTrailerSize = 4 + 4 + 8 + 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrNoParity is returned when an archive carries no parity data.
+	ErrNoParity = errors.New("no parity data")
+	// ErrUnrepairable is returned when some stripes have more damaged
+	// shards than parity to rebuild them.
+	ErrUnrepairable = errors.New("damage exceeds the parity")
+)
+
+type parityMeta struct {
+	Version      int   `json:"version"`
+	ShardSize    int   `json:"shard_size"`
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	DataSize     int64 `json:"data_size"`
+	// Checksums holds a big-endian CRC-32C per shard, stripe by stripe,
+	// data shards first.
+	Checksums []byte `json:"checksums"`
+}
+
+func (m *parityMeta) stripes() int64 {
+	stripe := int64(m.ShardSize) * int64(m.DataShards)
+	return (m.DataSize + stripe - 1) / stripe
+}
+
+func (m *parityMeta) checksum(stripe int64, shard int) uint32 {
+	i := (stripe*int64(m.DataShards+m.ParityShards) + int64(shard)) * 4
+	return binary.BigEndian.Uint32(m.Checksums[i:])
+}
+
+// parityShards returns how many parity shards a stripe needs for the given
+// redundancy in percent.
+func parityShards(redundancy int) (int, error) {
+	if redundancy < 1 || redundancy > 100 {
+		return 0, fmt.Errorf("parity redundancy must be between 1 and 100 percent, got %d", redundancy)
+	}
+	return (parityDataShards*redundancy + 99) / 100, nil
+}
+
+// parityWriter passes the archive through and computes its parity. Inline
+// parity is spooled to a temporary file until the archive is complete.
+type parityWriter struct {
+	data   io.Writer
+	parity io.Writer
+	spool  *os.File
+	enc    reedsolomon.Encoder
+	meta   parityMeta
+	shards [][]byte
+	n      int
+}
+
+func newParityWriter(w io.Writer, redundancy int, sidecar io.Writer) (*parityWriter, error) {
+	p, err := parityShards(redundancy)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := reedsolomon.New(parityDataShards, p)
+	if err != nil {
+		return nil, err
+	}
+	pw := &parityWriter{
+		data:   w,
+		parity: sidecar,
+		enc:    enc,
+		meta: parityMeta{
+			Version:      parityVersion,
+			ShardSize:    parityShardSize,
+			DataShards:   parityDataShards,
+			ParityShards: p,
+		},
+		shards: make([][]byte, parityDataShards+p),
+	}
+	for i := range pw.shards {
+		pw.shards[i] = make([]byte, parityShardSize)
+	}
+	if sidecar == nil {
+		if pw.spool, err = os.CreateTemp("", "tartarus-parity-*"); err != nil {
+			return nil, err
+		}
+		pw.parity = pw.spool
+	}
+	return pw, nil
+}
+
+func (w *parityWriter) Write(p []byte) (int, error) {
+	n, err := w.data.Write(p)
+	w.meta.DataSize += int64(n)
+	for p = p[:n]; len(p) > 0; {
+		k := copy(w.shards[w.n/parityShardSize][w.n%parityShardSize:], p)
+		w.n += k
+		p = p[k:]
+		if w.n == parityDataShards*parityShardSize {
+			if err := w.encodeStripe(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+func (w *parityWriter) encodeStripe() error {
+	for i := w.n / parityShardSize; i < parityDataShards; i++ {
+		clear(w.shards[i][max(0, w.n-i*parityShardSize):])
+	}
+	if err := w.enc.Encode(w.shards); err != nil {
+		return err
+	}
+	for _, shard := range w.shards {
+		w.meta.Checksums = binary.BigEndian.AppendUint32(w.meta.Checksums, crc32.Checksum(shard, crc32c))
+	}
+	for _, shard := range w.shards[parityDataShards:] {
+		if _, err := w.parity.Write(shard); err != nil {
+			return err
+		}
+	}
+	w.n = 0
+	return nil
+}
+
+// Close finishes the parity section and, for inline parity, appends it to
+// the archive.
+func (w *parityWriter) Close() error {
+	if w.spool != nil {
+		defer os.Remove(w.spool.Name())
+		defer w.spool.Close()
+	}
+	if w.n > 0 {
+		if err := w.encodeStripe(); err != nil {
+			return err
+		}
+	}
+	meta, err := json.Marshal(w.meta)
+	if err != nil {
+		return err
+	}
+	parityBytes := w.meta.stripes() * int64(w.meta.ParityShards) * parityShardSize
+	trailer := make([]byte, 0, parityTrailerSize)
+	trailer = binary.BigEndian.AppendUint32(trailer, uint32(len(meta)))
+	trailer = binary.BigEndian.AppendUint32(trailer, crc32.Checksum(meta, crc32c))
+	trailer = binary.BigEndian.AppendUint64(trailer, uint64(parityBytes)+uint64(len(meta))+parityTrailerSize)
+	trailer = append(trailer, parityMagic...)
+	if _, err := w.parity.Write(append(meta, trailer...)); err != nil {
+		return err
+	}
+
+	if w.spool == nil {
+		return nil
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w.data, w.spool)
+	return err
+}
+
+// discard drops the spooled parity of an archive that failed.
+func (w *parityWriter) discard() {
+	if w.spool != nil {
+		w.spool.Close()
+		os.Remove(w.spool.Name())
+	}
+}
+
+// readParitySection reads the parity metadata ending at end and returns it
+// with the offset the section starts at.
+func readParitySection(r io.ReaderAt, end int64) (*parityMeta, int64, error) {
+	if end < parityTrailerSize {
+		return nil, 0, ErrNoParity
+	}
+	trailer := make([]byte, parityTrailerSize)
+	if _, err := r.ReadAt(trailer, end-parityTrailerSize); err != nil {
+		return nil, 0, err
+	}
+	if string(trailer[16:]) != string(parityMagic) {
+		return nil, 0, ErrNoParity
+	}
+	metaLen := int64(binary.BigEndian.Uint32(trailer))
+	sectionLen := binary.BigEndian.Uint64(trailer[8:])
+	if sectionLen > uint64(end) || uint64(metaLen)+parityTrailerSize > sectionLen {
+		return nil, 0, fmt.Errorf("%w: parity trailer is damaged", ErrNoParity)
+	}
+	start := end - int64(sectionLen)
+
+	encoded := make([]byte, metaLen)
+	if _, err := r.ReadAt(encoded, end-parityTrailerSize-metaLen); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(encoded, crc32c) != binary.BigEndian.Uint32(trailer[4:]) {
+		return nil, 0, fmt.Errorf("%w: parity metadata is damaged", ErrNoParity)
+	}
+	m := new(parityMeta)
+	if err := json.Unmarshal(encoded, m); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrNoParity, err)
+	}
+	if m.Version != parityVersion {
+		return nil, 0, fmt.Errorf("%w: parity version %d", ErrUnsupportedFormat, m.Version)
+	}
+	if m.ShardSize <= 0 || m.DataShards <= 0 || m.ParityShards <= 0 || m.DataShards+m.ParityShards > 256 || m.DataSize < 0 ||
+		int64(len(m.Checksums)) != m.stripes()*int64(m.DataShards+m.ParityShards)*4 ||
+		m.stripes()*int64(m.ParityShards)*int64(m.ShardSize) != int64(sectionLen)-metaLen-parityTrailerSize {
+		return nil, 0, fmt.Errorf("%w: inconsistent parity metadata", ErrNoParity)
+	}
+	return m, start, nil
+}
+
+// dataEnd returns where the archive data in r from begin to end stops,
+// before any inline parity section.
+func dataEnd(r io.ReaderAt, begin, end int64) int64 {
+	m, start, err := readParitySection(r, end)
+	if err != nil || m.DataSize != start-begin {
+		return end
+	}
+	return start
+}
+
+// RepairReport tells how much damage Repair found and fixed, in shards of
+// ShardSize bytes.
+type RepairReport struct {
+	ShardSize    int `json:"shard_size"`
+	Shards       int `json:"shards"`
+	Damaged      int `json:"damaged"`
+	Repaired     int `json:"repaired"`
+	Unrepairable int `json:"unrepairable_stripes"`
+}
+
+// RepairArchive checks the archive at path against its parity and rewrites
+// damaged shards in place, parity shards included. sidecar names the parity
+// file, or is empty when the parity is appended to the archive. Stripes with
+// more damage than parity are left as they are and reported with
+// ErrUnrepairable.
+func RepairArchive(path, sidecar string) (*RepairReport, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pf := f
+	if sidecar != "" {
+		if pf, err = os.OpenFile(sidecar, os.O_RDWR, 0); err != nil {
+			return nil, err
+		}
+		defer pf.Close()
+	}
+	info, err := pf.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m, start, err := readParitySection(pf, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if sidecar == "" && start != m.DataSize {
+		return nil, fmt.Errorf("%w: parity does not follow the archive data", ErrNoParity)
+	}
+
+	enc, err := reedsolomon.New(m.DataShards, m.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	report := &RepairReport{ShardSize: m.ShardSize}
+	total := m.DataShards + m.ParityShards
+	buf := make([][]byte, total)
+	for i := range buf {
+		buf[i] = make([]byte, m.ShardSize)
+	}
+	shards := make([][]byte, total)
+	type location struct {
+		file   *os.File
+		offset int64
+		length int64
+	}
+	locs := make([]location, total)
+
+	for s := int64(0); s < m.stripes(); s++ {
+		var damaged []int
+		for i := 0; i < total; i++ {
+			loc := location{file: pf, length: int64(m.ShardSize)}
+			if i < m.DataShards {
+				loc.file = f
+				loc.offset = (s*int64(m.DataShards) + int64(i)) * int64(m.ShardSize)
+				loc.length = min(max(m.DataSize-loc.offset, 0), int64(m.ShardSize))
+			} else {
+				loc.offset = start + (s*int64(m.ParityShards)+int64(i-m.DataShards))*int64(m.ShardSize)
+			}
+			locs[i] = loc
+
+			shard := buf[i]
+			clear(shard)
+			n, err := loc.file.ReadAt(shard[:loc.length], loc.offset)
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			clear(shard[n:])
+			shards[i] = shard
+			if crc32.Checksum(shard, crc32c) != m.checksum(s, i) {
+				shards[i] = nil
+				damaged = append(damaged, i)
+			}
+		}
+		report.Shards += total
+		report.Damaged += len(damaged)
+		if len(damaged) == 0 {
+			continue
+		}
+		if len(damaged) > m.ParityShards {
+			report.Unrepairable++
+			continue
+		}
+
+		for _, i := range damaged {
+			shards[i] = buf[i][:0]
+		}
+		if err := enc.Reconstruct(shards); err != nil {
+			return nil, err
+		}
+		for _, i := range damaged {
+			if crc32.Checksum(shards[i], crc32c) != m.checksum(s, i) {
+				return nil, fmt.Errorf("%w: stripe %d rebuilt wrongly", ErrUnrepairable, s)
+			}
+			loc := locs[i]
+			if _, err := loc.file.WriteAt(shards[i][:loc.length], loc.offset); err != nil {
+				return nil, err
+			}
+			report.Repaired++
+		}
+	}
+	if report.Unrepairable > 0 {
+		return report, fmt.Errorf("%w: %d stripe(s)", ErrUnrepairable, report.Unrepairable)
+	}
+	return report, nil
+}
@@ -0,0 +1,147 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// parityArchive writes an encrypted archive of a random 1 MiB file with the
+// given parity to a file and returns its path and the file content.
+func parityArchive(t *testing.T, redundancy int, sidecar bool) (string, string) {
+	t.Helper()
+	src := t.TempDir()
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(6)).Read(data)
+	createTestFiles(t, src, map[string]string{"data.bin": string(data)})
+
+	path := filepath.Join(t.TempDir(), "archive.bin")
+	var out, par bytes.Buffer
+	opts := ArchiveOptions{Codec: "flate", Passphrase: []byte("parity"), Parity: redundancy}
+	if sidecar {
+		opts.ParitySidecar = &par
+	}
+	if err := Archive(src, &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, out.Bytes(), 0644)
+	if sidecar {
+		os.WriteFile(path+".par", par.Bytes(), 0644)
+	}
+	return path, string(data)
+}
+
+func corrupt(t *testing.T, path string, offsets ...int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, off := range offsets {
+		b := make([]byte, 1)
+		f.ReadAt(b, off)
+		b[0] ^= 0xff
+		f.WriteAt(b, off)
+	}
+}
+
+func extractFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dest, err := os.MkdirTemp("", "parity-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dest)
+	if err := Extract(f, dest, Keys{Passphrase: []byte("parity")}, ExtractOptions{}); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(filepath.Join(dest, "data.bin"))
+	return string(data), err
+}
+
+func TestRepairInlineParity(t *testing.T) {
+	path, want := parityArchive(t, 10, false)
+	if got, err := extractFile(path); err != nil || got != want {
+		t.Fatalf("extracting archive with inline parity: %v", err)
+	}
+
+	corrupt(t, path, 100, 3*parityShardSize+7)
+	if _, err := extractFile(path); err == nil {
+		t.Fatal("damaged archive extracted")
+	}
+	report, err := RepairArchive(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Damaged != 2 || report.Repaired != 2 {
+		t.Errorf("report = %+v", report)
+	}
+	if got, err := extractFile(path); err != nil || got != want {
+		t.Fatalf("extracting repaired archive: %v", err)
+	}
+}
+
+func TestRepairSidecarParity(t *testing.T) {
+	path, want := parityArchive(t, 5, true)
+	corrupt(t, path, 5000)
+	corrupt(t, path+".par", 10)
+
+	report, err := RepairArchive(path, path+".par")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Damaged != 2 || report.Repaired != 2 {
+		t.Errorf("report = %+v", report)
+	}
+	if got, err := extractFile(path); err != nil || got != want {
+		t.Fatalf("extracting repaired archive: %v", err)
+	}
+	if report, err := RepairArchive(path, path+".par"); err != nil || report.Damaged != 0 {
+		t.Errorf("second repair: %+v, %v", report, err)
+	}
+}
+
+func TestRepairReportsUnrepairable(t *testing.T) {
+	path, _ := parityArchive(t, 5, false) // two parity shards per stripe
+	corrupt(t, path, 0, parityShardSize, 2*parityShardSize)
+
+	report, err := RepairArchive(path, "")
+	if !errors.Is(err, ErrUnrepairable) {
+		t.Fatalf("got %v, want ErrUnrepairable", err)
+	}
+	if report.Unrepairable != 1 || report.Damaged != 3 || report.Repaired != 0 {
+		t.Errorf("report = %+v", report)
+	}
+
+	plain := filepath.Join(t.TempDir(), "plain.bin")
+	os.WriteFile(plain, []byte("no parity here"), 0644)
+	if _, err := RepairArchive(plain, ""); !errors.Is(err, ErrNoParity) {
+		t.Errorf("archive without parity: got %v", err)
+	}
+	if err := Archive(t.TempDir(), &bytes.Buffer{}, ArchiveOptions{Passphrase: []byte("p"), Parity: 101}); err == nil {
+		t.Error("redundancy above 100% accepted")
+	}
+}
+
+func TestInlineParityOnVolumesRejected(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{"a.txt": "a"})
+	base := filepath.Join(t.TempDir(), "archive.bin")
+	vw, err := NewVolumeWriter(base, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vw.Abort()
+	err = Archive(src, vw, ArchiveOptions{Passphrase: []byte("parity"), Parity: 10})
+	if !errors.Is(err, ErrUnsupportedArchive) {
+		t.Errorf("Archive = %v, want ErrUnsupportedArchive", err)
+	}
+}
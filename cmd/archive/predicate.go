@@ -0,0 +1,564 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// FileAttrs are the attributes predicates look at.
+type FileAttrs struct {
+	Name       string
+	Type       string // as in Member.Type
+	Size       int64
+	Mode       os.FileMode
+	ModTime    time.Time
+	ChangeTime time.Time
+	Uid, Gid   int
+}
+
+func headerAttrs(hdr *tar.Header) FileAttrs {
+	return FileAttrs{
+		Name:       strings.TrimSuffix(hdr.Name, "/"),
+		Type:       newMember(hdr).Type,
+		Size:       hdr.Size,
+		Mode:       hdr.FileInfo().Mode(),
+		ModTime:    hdr.ModTime,
+		ChangeTime: hdr.ChangeTime,
+		Uid:        hdr.Uid,
+		Gid:        hdr.Gid,
+	}
+}
+
+// Predicate selects files by their attributes.
+type Predicate func(FileAttrs) bool
+
+// And is true when all predicates are.
+func And(ps ...Predicate) Predicate {
+	return func(a FileAttrs) bool {
+		for _, p := range ps {
+			if !p(a) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or is true when any predicate is.
+func Or(ps ...Predicate) Predicate {
+	return func(a FileAttrs) bool {
+		for _, p := range ps {
+			if p(a) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not negates p.
+func Not(p Predicate) Predicate {
+	return func(a FileAttrs) bool { return !p(a) }
+}
+
+// SizeBetween matches sizes from min up to, but not including, max; a
+// negative max has no upper bound.
+func SizeBetween(min, max int64) Predicate {
+	return func(a FileAttrs) bool { return a.Size >= min && (max < 0 || a.Size < max) }
+}
+
+// ModifiedBetween matches modification times in [from, to); zero times are
+// open ends.
+func ModifiedBetween(from, to time.Time) Predicate {
+	return func(a FileAttrs) bool { return inWindow(a.ModTime, from, to) }
+}
+
+// ChangedBetween matches inode change times in [from, to); zero times are
+// open ends.
+func ChangedBetween(from, to time.Time) Predicate {
+	return func(a FileAttrs) bool { return inWindow(a.ChangeTime, from, to) }
+}
+
+func inWindow(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// TypeIs matches files of the given types, named as in Member.Type.
+func TypeIs(types ...string) Predicate {
+	return func(a FileAttrs) bool {
+		for _, t := range types {
+			if a.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// OwnedBy matches a user ID.
+func OwnedBy(uid int) Predicate {
+	return func(a FileAttrs) bool { return a.Uid == uid }
+}
+
+// InGroup matches a group ID.
+func InGroup(gid int) Predicate {
+	return func(a FileAttrs) bool { return a.Gid == gid }
+}
+
+// PermAll matches files with all of the permission bits set.
+func PermAll(bits os.FileMode) Predicate {
+	return func(a FileAttrs) bool { return a.Mode.Perm()&bits == bits }
+}
+
+// PermAny matches files with any of the permission bits set.
+func PermAny(bits os.FileMode) Predicate {
+	return func(a FileAttrs) bool { return a.Mode.Perm()&bits != 0 }
+}
+
+// NameMatches matches the base name or the relative path like FilterFunc.
+func NameMatches(pattern string) Predicate {
+	match := FilterFunc([]string{pattern})
+	return func(a FileAttrs) bool { return match(a.Name) }
+}
+
+// ErrBadPredicate is returned for predicates that do not parse.
+var ErrBadPredicate = errors.New("invalid predicate")
+
+// predicateAttrs are the attributes a predicate can compare, with the
+// operators each accepts.
+var predicateAttrs = map[string][]string{
+	"size":  {"<", "<=", ">", ">=", "=", "!="},
+	"mtime": {"<", "<=", ">", ">="},
+	"ctime": {"<", "<=", ">", ">="},
+	"type":  {"=", "!="},
+	"uid":   {"=", "!="},
+	"gid":   {"=", "!="},
+	"perm":  {"=", "!=", "has", "any"},
+	"name":  {"=", "!="},
+}
+
+// compare builds the predicate for one comparison. Sizes take K, M, G and T
+// suffixes in powers of 1024. Times are RFC 3339 timestamps, dates, or ages
+// such as 30d, 12h or 2w that count back from now, so "mtime > 30d" means
+// modified in the last 30 days. Permissions are octal.
+func compare(attr, op, value string) (Predicate, error) {
+	ops, ok := predicateAttrs[attr]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown attribute %q", ErrBadPredicate, attr)
+	}
+	if !contains(ops, op) {
+		return nil, fmt.Errorf("%w: %s does not support %q", ErrBadPredicate, attr, op)
+	}
+
+	var p Predicate
+	switch attr {
+	case "size":
+		n, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		p = ordered(op, func(a FileAttrs) int64 { return a.Size }, n)
+	case "mtime", "ctime":
+		t, err := parseTimeValue(value)
+		if err != nil {
+			return nil, err
+		}
+		get := func(a FileAttrs) int64 { return a.ModTime.UnixNano() }
+		if attr == "ctime" {
+			get = func(a FileAttrs) int64 { return a.ChangeTime.UnixNano() }
+		}
+		p = ordered(op, get, t.UnixNano())
+	case "type":
+		if !contains(typeNames(), value) {
+			return nil, fmt.Errorf("%w: unknown type %q", ErrBadPredicate, value)
+		}
+		p = TypeIs(value)
+	case "uid", "gid":
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s %q is not a number", ErrBadPredicate, attr, value)
+		}
+		p = OwnedBy(id)
+		if attr == "gid" {
+			p = InGroup(id)
+		}
+	case "perm":
+		bits, err := strconv.ParseUint(strings.TrimPrefix(value, "0o"), 8, 32)
+		if err != nil || bits > 0777 {
+			return nil, fmt.Errorf("%w: permission %q is not octal", ErrBadPredicate, value)
+		}
+		mode := os.FileMode(bits)
+		switch op {
+		case "has":
+			return PermAll(mode), nil
+		case "any":
+			return PermAny(mode), nil
+		}
+		p = func(a FileAttrs) bool { return a.Mode.Perm() == mode }
+	case "name":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("%w: name pattern %q", ErrBadPredicate, value)
+		}
+		p = NameMatches(value)
+	}
+	if op == "!=" {
+		p = Not(p)
+	}
+	return p, nil
+}
+
+func ordered(op string, get func(FileAttrs) int64, v int64) Predicate {
+	return func(a FileAttrs) bool {
+		x := get(a)
+		switch op {
+		case "<":
+			return x < v
+		case "<=":
+			return x <= v
+		case ">":
+			return x > v
+		case ">=":
+			return x >= v
+		case "=":
+			return x == v
+		}
+		return x != v
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func typeNames() []string {
+	names := make([]string, 0, len(memberTypes))
+	for _, name := range memberTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var sizeUnits = map[string]int64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+func parseSize(s string) (int64, error) {
+	u := strings.TrimSuffix(strings.ToUpper(s), "B")
+	num := strings.TrimRightFunc(u, unicode.IsLetter)
+	unit, ok := sizeUnits[u[len(num):]]
+	n, err := strconv.ParseInt(num, 10, 64)
+	if !ok || err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: size %q", ErrBadPredicate, s)
+	}
+	return n * unit, nil
+}
+
+var ageUnits = map[byte]time.Duration{
+	's': time.Second, 'm': time.Minute, 'h': time.Hour,
+	'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour,
+}
+
+// timeNow is replaced in tests.
+var timeNow = time.Now
+
+func parseTimeValue(s string) (time.Time, error) {
+	if s != "" {
+		if unit, ok := ageUnits[s[len(s)-1]]; ok {
+			if n, err := strconv.ParseInt(s[:len(s)-1], 10, 64); err == nil && n >= 0 {
+				return timeNow().Add(-time.Duration(n) * unit), nil
+			}
+		}
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: time %q", ErrBadPredicate, s)
+}
+
+// ParsePredicate parses an expression such as
+//
+//	size < 500M and mtime > 30d and (uid = 1000 or not type = symlink)
+//
+// Comparisons are attribute, operator and value, see compare; they combine
+// with and, or, not and parentheses. Values with spaces or operator
+// characters are written in double quotes.
+func ParsePredicate(expr string) (Predicate, error) {
+	tokens, err := tokenizePredicate(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &predicateParser{tokens: tokens}
+	pred, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrBadPredicate, p.tokens[p.pos].text)
+	}
+	return pred, nil
+}
+
+type predicateToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizePredicate(s string) ([]predicateToken, error) {
+	var tokens []predicateToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, predicateToken{text: string(c)})
+			i++
+		case strings.ContainsRune("<>=!", rune(c)):
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			tokens = append(tokens, predicateToken{text: s[i:j]})
+			i = j
+		case c == '"':
+			j := strings.IndexByte(s[i+1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("%w: unterminated quote", ErrBadPredicate)
+			}
+			tokens = append(tokens, predicateToken{text: s[i+1 : i+1+j], quoted: true})
+			i += j + 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n()<>=!\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, predicateToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type predicateParser struct {
+	tokens []predicateToken
+	pos    int
+}
+
+func (p *predicateParser) next() (predicateToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return predicateToken{}, false
+	}
+	p.pos++
+	return p.tokens[p.pos-1], true
+}
+
+func (p *predicateParser) keyword(word string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && p.tokens[p.pos].text == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *predicateParser) or() (Predicate, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	ps := []Predicate{left}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, right)
+	}
+	if len(ps) == 1 {
+		return left, nil
+	}
+	return Or(ps...), nil
+}
+
+func (p *predicateParser) and() (Predicate, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	ps := []Predicate{left}
+	for p.keyword("and") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, right)
+	}
+	if len(ps) == 1 {
+		return left, nil
+	}
+	return And(ps...), nil
+}
+
+func (p *predicateParser) unary() (Predicate, error) {
+	if p.keyword("not") {
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(inner), nil
+	}
+	if p.keyword("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("%w: missing )", ErrBadPredicate)
+		}
+		return inner, nil
+	}
+	attr, ok1 := p.next()
+	op, ok2 := p.next()
+	value, ok3 := p.next()
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("%w: incomplete comparison", ErrBadPredicate)
+	}
+	return compare(attr.text, op.text, value.text)
+}
+
+// predicateOps maps the operator names of the JSON form.
+var predicateOps = map[string]string{
+	"lt": "<", "le": "<=", "gt": ">", "ge": ">=", "eq": "=", "ne": "!=",
+	"has": "has", "any": "any",
+}
+
+// ParsePredicateJSON parses the JSON form of a predicate:
+//
+//	{"and": [{"size": {"lt": "500M"}}, {"mtime": {"gt": "30d"}}, {"uid": 1000}]}
+//
+// Objects hold "and" or "or" with a list, "not" with a predicate, or one
+// attribute with either a value to compare for equality or an object of
+// operators lt, le, gt, ge, eq, ne, has and any.
+func ParsePredicateJSON(data []byte) (Predicate, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadPredicate, err)
+	}
+	if len(obj) != 1 {
+		return nil, fmt.Errorf("%w: expected one key, got %d", ErrBadPredicate, len(obj))
+	}
+	for key, raw := range obj {
+		switch key {
+		case "and", "or":
+			var items []json.RawMessage
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil, fmt.Errorf("%w: %s needs a list", ErrBadPredicate, key)
+			}
+			ps := make([]Predicate, len(items))
+			for i, item := range items {
+				var err error
+				if ps[i], err = ParsePredicateJSON(item); err != nil {
+					return nil, err
+				}
+			}
+			if key == "and" {
+				return And(ps...), nil
+			}
+			return Or(ps...), nil
+		case "not":
+			inner, err := ParsePredicateJSON(raw)
+			if err != nil {
+				return nil, err
+			}
+			return Not(inner), nil
+		}
+
+		var ops map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &ops); err != nil {
+			return compare(key, "=", jsonValue(raw))
+		}
+		var ps []Predicate
+		for name, v := range ops {
+			op, ok := predicateOps[name]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown operator %q", ErrBadPredicate, name)
+			}
+			p, err := compare(key, op, jsonValue(v))
+			if err != nil {
+				return nil, err
+			}
+			ps = append(ps, p)
+		}
+		return And(ps...), nil
+	}
+	panic("unreachable")
+}
+
+// jsonValue returns a JSON string's content, or the literal of a number.
+func jsonValue(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// SplitFilters separates the name patterns in filters from predicates.
+// Entries starting with "{" are JSON predicates and entries that start
+// with an attribute comparison, "not" or "(" are expressions; the rest are
+// FilterFunc patterns. All predicates must hold, and combine into one.
+func SplitFilters(filters []string) ([]string, Predicate, error) {
+	var patterns []string
+	var preds []Predicate
+	for _, f := range filters {
+		trimmed := strings.TrimSpace(f)
+		var p Predicate
+		var err error
+		switch {
+		case strings.HasPrefix(trimmed, "{"):
+			p, err = ParsePredicateJSON([]byte(trimmed))
+		case looksLikeExpression(trimmed):
+			p, err = ParsePredicate(trimmed)
+		default:
+			patterns = append(patterns, f)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		preds = append(preds, p)
+	}
+	switch len(preds) {
+	case 0:
+		return patterns, nil, nil
+	case 1:
+		return patterns, preds[0], nil
+	}
+	return patterns, And(preds...), nil
+}
+
+func looksLikeExpression(s string) bool {
+	tokens, err := tokenizePredicate(s)
+	if err != nil || len(tokens) < 2 {
+		return len(tokens) > 0 && (tokens[0].text == "not" || tokens[0].text == "(")
+	}
+	if tokens[0].text == "not" || tokens[0].text == "(" {
+		return true
+	}
+	ops, ok := predicateAttrs[tokens[0].text]
+	return ok && contains(ops, tokens[1].text)
+}
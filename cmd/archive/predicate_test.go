@@ -0,0 +1,121 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParsePredicate(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	small := FileAttrs{Name: "app/data.db", Type: "file", Size: 10 << 20, Mode: 0640, ModTime: now.Add(-24 * time.Hour), Uid: 1000, Gid: 100}
+	big := small
+	big.Size = 600 << 20
+	old := small
+	old.ModTime = now.AddDate(0, -2, 0)
+	link := small
+	link.Type, link.Mode, link.Uid = "symlink", os.ModeSymlink|0777, 0
+
+	tests := []struct {
+		expr string
+		want map[*FileAttrs]bool
+	}{
+		{"size < 500M and mtime > 30d and uid = 1000", map[*FileAttrs]bool{&small: true, &big: false, &old: false, &link: false}},
+		{"not type = symlink", map[*FileAttrs]bool{&small: true, &link: false}},
+		{"(size >= 1G or perm has 0111) and name = *.db", map[*FileAttrs]bool{&small: false, &link: true}},
+		{"perm any 0022 or gid != 100", map[*FileAttrs]bool{&small: false, &link: true}},
+		{`mtime < 2026-05-01 and name != "x y"`, map[*FileAttrs]bool{&small: false, &old: true}},
+	}
+	for _, tt := range tests {
+		p, err := ParsePredicate(tt.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.expr, err)
+		}
+		for attrs, want := range tt.want {
+			if got := p(*attrs); got != want {
+				t.Errorf("%q on %+v = %v, want %v", tt.expr, *attrs, got, want)
+			}
+		}
+	}
+
+	for _, bad := range []string{"size <", "size < lots", "color = red", "type = pipe", "mtime = 3d", "(uid = 1", "uid = 1 gid = 2", "perm has 999"} {
+		if _, err := ParsePredicate(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestParsePredicateJSON(t *testing.T) {
+	p, err := ParsePredicateJSON([]byte(`{"and": [{"size": {"ge": "1k", "lt": 4096}}, {"not": {"type": "dir"}}, {"or": [{"uid": 0}, {"perm": {"has": "0600"}}]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := FileAttrs{Type: "file", Size: 2048, Mode: 0644, Uid: 1000}
+	if !p(attrs) {
+		t.Error("matching file rejected")
+	}
+	attrs.Size = 4096
+	if p(attrs) {
+		t.Error("upper bound not exclusive")
+	}
+	for _, bad := range []string{`[]`, `{}`, `{"size": {"about": 1}}`, `{"and": {"uid": 0}}`, `{"uid": 0, "gid": 0}`} {
+		if _, err := ParsePredicateJSON([]byte(bad)); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestSplitFilters(t *testing.T) {
+	patterns, where, err := SplitFilters([]string{"*.txt", "size > 1K", `{"type": "file"}`, "nested"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 2 || patterns[0] != "*.txt" || patterns[1] != "nested" {
+		t.Errorf("patterns = %q", patterns)
+	}
+	if where == nil || where(FileAttrs{Type: "file", Size: 10}) || !where(FileAttrs{Type: "file", Size: 2048}) {
+		t.Error("predicates not combined")
+	}
+	if _, _, err := SplitFilters([]string{"size > huge"}); err == nil {
+		t.Error("bad expression taken for a pattern")
+	}
+}
+
+func TestTarFolderWhere(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "small.txt"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(src, "sub", "large.bin"), make([]byte, 4096), 0644)
+	os.WriteFile(filepath.Join(src, "sub", "tiny.bin"), []byte("y"), 0644)
+
+	where, err := ParsePredicate("size < 1K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{Where: where}); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[hdr.Name] = true
+	}
+	if !names["small.txt"] || !names["sub/"] || !names["sub/tiny.bin"] || names["sub/large.bin"] {
+		t.Errorf("archived %v", names)
+	}
+}
@@ -0,0 +1,146 @@
+package archive
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// Sampling bounds for the size estimate: the start of each file is
+// compressed until the budget is spent.
+const (
+	previewSampleSize   = 64 << 10
+	previewSampleBudget = 16 << 20
+)
+
+// tarBlockSize is the unit tar headers and data are padded to.
+const tarBlockSize = 512
+
+// PreviewEntry is one path a dry run looked at.
+type PreviewEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Size int64  `json:"size,omitempty"`
+	// DecidedBy is what included or excluded the path: "filter",
+	// "select", "where", "socket" or a rule. It is empty for paths that
+	// nothing excluded.
+	DecidedBy string `json:"decided_by,omitempty"`
+}
+
+// Preview is what a dry run found. Directories pruned from the walk are
+// listed, but not what is below them.
+type Preview struct {
+	Included   []PreviewEntry `json:"included"`
+	Excluded   []PreviewEntry `json:"excluded"`
+	Files      int            `json:"files"`
+	TotalBytes int64          `json:"total_bytes"`
+	// EstimatedSize is the expected size of the compressed tar stream. Each
+	// sampled file counts at the ratio its sample compressed to; the rest of
+	// the stream counts at the ratio of all samples together.
+	EstimatedSize int64 `json:"estimated_size"`
+
+	stream    int64   // uncompressed tar stream size
+	sampled   int64   // sample bytes compressed
+	packed    int64   // what the samples compressed to
+	covered   int64   // bytes of the sampled files
+	estimated float64 // estimate for the sampled files
+	codec     string
+	level     int
+}
+
+// collect walks src into the preview and works out the estimate for the
+// codec at level.
+func (p *Preview) collect(src string, opts TarOptions, codec string, level int) error {
+	if _, err := NewCompressWriter(io.Discard, codec, level); err != nil {
+		return err
+	}
+	p.codec, p.level = codec, level
+	p.Included, p.Excluded = []PreviewEntry{}, []PreviewEntry{}
+	opts.DryRun = p
+	if err := newTreeWalker(nil, opts).run(src); err != nil {
+		return err
+	}
+
+	p.stream += 2 * tarBlockSize // end-of-archive marker
+	rest := float64(p.stream - p.covered)
+	if p.sampled > 0 {
+		rest *= float64(p.packed) / float64(p.sampled)
+	}
+	p.EstimatedSize = int64(p.estimated + rest)
+	return nil
+}
+
+func (p *Preview) include(hdr *tar.Header, path, by string) error {
+	p.Included = append(p.Included, PreviewEntry{
+		Path:      strings.TrimSuffix(hdr.Name, "/"),
+		Type:      newMember(hdr).Type,
+		Size:      hdr.Size,
+		DecidedBy: by,
+	})
+	p.stream += tarBlockSize + (hdr.Size+tarBlockSize-1)/tarBlockSize*tarBlockSize
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	p.Files++
+	p.TotalBytes += hdr.Size
+	if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 || p.sampled >= previewSampleBudget {
+		return nil
+	}
+	return p.sample(path, hdr.Size)
+}
+
+// sample compresses the start of the file on its own and extrapolates its
+// ratio to the whole file.
+func (p *Preview) sample(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	out := &countingWriter{w: io.Discard}
+	cw, err := NewCompressWriter(out, p.codec, p.level)
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyN(cw, f, min(previewSampleSize, previewSampleBudget-p.sampled))
+	if err != nil && err != io.EOF {
+		cw.Close()
+		return err
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	p.sampled += n
+	p.packed += out.pos
+	p.covered += size
+	p.estimated += float64(size) * float64(out.pos) / float64(n)
+	return nil
+}
+
+func (p *Preview) exclude(relPath string, mode fs.FileMode, by string) {
+	p.Excluded = append(p.Excluded, PreviewEntry{Path: relPath, Type: modeType(mode), DecidedBy: by})
+}
+
+// modeType names the file type of mode as Member.Type does.
+func modeType(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return memberTypes[tar.TypeDir]
+	case mode&fs.ModeSymlink != 0:
+		return memberTypes[tar.TypeSymlink]
+	case mode&fs.ModeNamedPipe != 0:
+		return memberTypes[tar.TypeFifo]
+	case mode&fs.ModeCharDevice != 0:
+		return memberTypes[tar.TypeChar]
+	case mode&fs.ModeDevice != 0:
+		return memberTypes[tar.TypeBlock]
+	case mode&fs.ModeSocket != 0:
+		return "socket"
+	}
+	return memberTypes[tar.TypeReg]
+}
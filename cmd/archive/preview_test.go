@@ -0,0 +1,73 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRunEstimate(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "text.txt"), bytes.Repeat([]byte("all work and no play\n"), 50000), 0644)
+	noise := make([]byte, 256<<10)
+	rand.Read(noise)
+	os.WriteFile(filepath.Join(src, "noise.bin"), noise, 0644)
+	os.WriteFile(filepath.Join(src, "skip.tmp"), []byte("x"), 0644)
+
+	var out bytes.Buffer
+	var preview Preview
+	opts := TarOptions{Filter: func(name string) bool { return filepath.Ext(name) != ".tmp" }, DryRun: &preview}
+	if err := TarFolder(src, &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("dry run wrote %d bytes", out.Len())
+	}
+	if preview.Files != 2 || len(preview.Excluded) != 1 || preview.Excluded[0].DecidedBy != "filter" {
+		t.Errorf("preview = %+v", preview)
+	}
+	total := int64(50000*21 + len(noise))
+	if preview.TotalBytes != total {
+		t.Errorf("total = %d, want %d", preview.TotalBytes, total)
+	}
+	// The text compresses to almost nothing, the noise not at all.
+	if preview.EstimatedSize < int64(len(noise))/2 || preview.EstimatedSize > total*3/4 {
+		t.Errorf("estimate = %d of %d", preview.EstimatedSize, total)
+	}
+
+	var zipPreview Preview
+	err := Archive(src, nil, ArchiveOptions{Format: FormatZip, Tar: TarOptions{DryRun: &zipPreview}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zipPreview.Files != 3 || zipPreview.EstimatedSize <= 0 {
+		t.Errorf("zip preview = %+v", zipPreview)
+	}
+}
+
+func TestDryRunEstimatePerFile(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(filepath.Join(src, "text.txt"), bytes.Repeat([]byte("all work and no play\n"), 200000), 0644)
+	noise := make([]byte, 64<<10)
+	rand.Read(noise)
+	os.WriteFile(filepath.Join(src, "noise.bin"), noise, 0644)
+
+	var preview Preview
+	if err := Archive(src, nil, ArchiveOptions{CompressLevel: -1, Tar: TarOptions{DryRun: &preview}}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the start of the text is sampled; at the ratio of both samples
+	// together the whole text would count as half its size.
+	if preview.EstimatedSize < int64(len(noise)) || preview.EstimatedSize > 2*int64(len(noise)) {
+		t.Errorf("estimate = %d for %d bytes of noise", preview.EstimatedSize, len(noise))
+	}
+
+	base := &Manifest{}
+	err := Archive(src, nil, ArchiveOptions{Snapshot: true, Base: base, Tar: TarOptions{DryRun: &Preview{}}})
+	if !errors.Is(err, ErrUnsupportedArchive) {
+		t.Errorf("preview with a base = %v", err)
+	}
+}
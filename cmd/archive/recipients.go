@@ -0,0 +1,236 @@
+package archive
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Public-key encryption follows age: every stream gets a random file key,
+// which is wrapped once per recipient with a key agreed between a fresh
+// ephemeral X25519 key and the recipient's public key. Any one matching
+// identity can unwrap it.
+
+const (
+	x25519KeySize  = 32
+	fileKeySize    = 32
+	wrappedKeySize = fileKeySize + 16 // AES-GCM tag
+	stanzaSize     = x25519KeySize + wrappedKeySize
+	maxRecipients  = 255
+
+	recipientPrefix = "tartarus-x25519:"
+	identityPrefix  = "TARTARUS-X25519-SECRET:"
+)
+
+var (
+	// ErrNoIdentity is returned when none of the supplied identities can
+	// unwrap the file key of a recipient-encrypted stream.
+	ErrNoIdentity = errors.New("no identity matches the stream recipients")
+	// ErrAmbiguousKeys is returned when both a passphrase and recipients
+	// are given for encryption.
+	ErrAmbiguousKeys = errors.New("use either a passphrase or recipients, not both")
+)
+
+// X25519Recipient is a public key a stream can be encrypted to.
+type X25519Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// X25519Identity is the private key matching an X25519Recipient.
+type X25519Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateX25519Identity creates a new random identity.
+func GenerateX25519Identity() (*X25519Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// Recipient returns the public half of the identity.
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{key: i.key.PublicKey()}
+}
+
+func (i *X25519Identity) String() string {
+	return identityPrefix + base64.RawURLEncoding.EncodeToString(i.key.Bytes())
+}
+
+func (r *X25519Recipient) String() string {
+	return recipientPrefix + base64.RawURLEncoding.EncodeToString(r.key.Bytes())
+}
+
+func decodeX25519Key(s, prefix string) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), prefix)
+	if !ok {
+		return nil, fmt.Errorf("key must start with %q", prefix)
+	}
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
+
+// ParseX25519Recipient parses a recipient in the form produced by String.
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	raw, err := decodeX25519Key(s, recipientPrefix)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Recipient{key: key}, nil
+}
+
+// ParseX25519Identity parses an identity in the form produced by String.
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	raw, err := decodeX25519Key(s, identityPrefix)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// Keys holds the secrets that may open an encrypted stream: a passphrase
+// for passphrase-encrypted streams, identities for recipient-encrypted ones.
+type Keys struct {
+	Passphrase []byte
+	Identities []*X25519Identity
+}
+
+// recipientStanza is one wrapped copy of the file key.
+type recipientStanza struct {
+	ephemeral []byte
+	wrapped   []byte
+}
+
+// wrapKey derives the key-wrapping key for one recipient. Binding both public
+// keys into the derivation ties each stanza to its recipient.
+func wrapKey(shared, ephemeral, recipient []byte) (cipher.AEAD, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key, err := hkdf.Key(sha256.New, shared, salt, "tartarus x25519 wrap", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func wrapFileKey(fileKey []byte, r *X25519Recipient) (recipientStanza, error) {
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	shared, err := eph.ECDH(r.key)
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	aead, err := wrapKey(shared, eph.PublicKey().Bytes(), r.key.Bytes())
+	if err != nil {
+		return recipientStanza{}, err
+	}
+	// The wrapping key is single-use, so a fixed nonce is safe.
+	nonce := make([]byte, aead.NonceSize())
+	return recipientStanza{
+		ephemeral: eph.PublicKey().Bytes(),
+		wrapped:   aead.Seal(nil, nonce, fileKey, nil),
+	}, nil
+}
+
+func unwrapFileKey(stanzas []recipientStanza, identities []*X25519Identity) ([]byte, error) {
+	for _, id := range identities {
+		for _, st := range stanzas {
+			eph, err := ecdh.X25519().NewPublicKey(st.ephemeral)
+			if err != nil {
+				return nil, err
+			}
+			shared, err := id.key.ECDH(eph)
+			if err != nil {
+				continue
+			}
+			aead, err := wrapKey(shared, st.ephemeral, id.key.PublicKey().Bytes())
+			if err != nil {
+				return nil, err
+			}
+			nonce := make([]byte, aead.NonceSize())
+			if fileKey, err := aead.Open(nil, nonce, st.wrapped, nil); err == nil {
+				return fileKey, nil
+			}
+		}
+	}
+	return nil, ErrNoIdentity
+}
+
+// fileKeyStreamKeys expands a file key into the stream encryption and HMAC
+// keys, salted with the stream nonce.
+func fileKeyStreamKeys(fileKey, nonce []byte) (encKey, hmacKey []byte, err error) {
+	key, err := hkdf.Key(sha256.New, fileKey, nonce, "tartarus stream keys", aesKeySize+hmacSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key[:aesKeySize], key[aesKeySize:], nil
+}
+
+// EncryptWriterToRecipients is like EncryptWriterCTR_HMAC but encrypts to
+// X25519 public keys instead of a passphrase. Any identity matching one of
+// the recipients can decrypt the stream.
+func EncryptWriterToRecipients(w io.Writer, recipients ...*X25519Recipient) (io.WriteCloser, error) {
+	hdr, encKey, hmacKey, err := newRecipientsStream(recipients)
+	if err != nil {
+		return nil, err
+	}
+	return newCTRHMACWriter(w, hdr, encKey, hmacKey)
+}
+
+// newRecipientsStream creates a header wrapping a fresh file key for every
+// recipient and returns it with the stream keys.
+func newRecipientsStream(recipients []*X25519Recipient) (*streamHeader, []byte, []byte, error) {
+	if len(recipients) == 0 {
+		return nil, nil, nil, errors.New("at least one recipient is required")
+	}
+	if len(recipients) > maxRecipients {
+		return nil, nil, nil, fmt.Errorf("at most %d recipients are supported", maxRecipients)
+	}
+
+	fileKey := make([]byte, fileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, nil, nil, err
+	}
+	hdr := &streamHeader{
+		version: recipientsVersion,
+		nonce:   make([]byte, nonceSize),
+	}
+	if _, err := rand.Read(hdr.nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, r := range recipients {
+		st, err := wrapFileKey(fileKey, r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		hdr.stanzas = append(hdr.stanzas, st)
+	}
+
+	encKey, hmacKey, err := fileKeyStreamKeys(fileKey, hdr.nonce)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return hdr, encKey, hmacKey, nil
+}
@@ -0,0 +1,81 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecipientEncryption(t *testing.T) {
+	alice, _ := GenerateX25519Identity()
+	bob, _ := GenerateX25519Identity()
+	eve, _ := GenerateX25519Identity()
+	plaintext := bytes.Repeat([]byte("for alice and bob "), 5000)
+
+	var buf bytes.Buffer
+	enc, err := EncryptWriterToRecipients(&buf, alice.Recipient(), bob.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(plaintext)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, id := range map[string]*X25519Identity{"alice": alice, "bob": bob} {
+		parsed, err := ParseX25519Identity(id.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := DecryptReader(bytes.NewReader(buf.Bytes()), Keys{Identities: []*X25519Identity{eve, parsed}})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := io.ReadAll(dec)
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Errorf("%s: roundtrip failed: %v", name, err)
+		}
+	}
+
+	if _, err := DecryptReader(bytes.NewReader(buf.Bytes()), Keys{Identities: []*X25519Identity{eve}}); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("unrelated identity: got %v, want ErrNoIdentity", err)
+	}
+	if _, err := DecryptReaderCTR_HMAC(bytes.NewReader(buf.Bytes()), []byte("pass")); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("passphrase only: got %v, want ErrNoIdentity", err)
+	}
+}
+
+func TestParseRecipient(t *testing.T) {
+	id, _ := GenerateX25519Identity()
+	r, err := ParseX25519Recipient(id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != id.Recipient().String() {
+		t.Errorf("recipient did not round-trip: %s", r)
+	}
+	if _, err := ParseX25519Recipient(id.String()); err == nil {
+		t.Error("identity accepted as recipient")
+	}
+}
+
+func TestPipelineToRecipients(t *testing.T) {
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	createTestFiles(t, inputDir, map[string]string{"secret.txt": "for the restore host"})
+	id, _ := GenerateX25519Identity()
+
+	var buf bytes.Buffer
+	opts := ArchiveOptions{CompressLevel: 5, Recipients: []*X25519Recipient{id.Recipient()}}
+	if err := Archive(inputDir, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := Restore(&buf, outputDir, RestoreOptions{Keys: Keys{Identities: []*X25519Identity{id}}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(outputDir, "secret.txt")); got != "for the restore host" {
+		t.Errorf("secret.txt = %q", got)
+	}
+}
@@ -0,0 +1,670 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A repository stores backups deduplicated, restic style:
+//
+//	config              repository keys, encrypted like an archive
+//	data/ab/abcdef...   chunks, named by the HMAC-SHA256 of their plaintext
+//	snapshots/<id>      snapshot trees listing the chunks of every file
+//	locks/              lock files of running backups and prunes
+//
+// Chunks are compressed and sealed once under the repository keys, so
+// backing up data that is already stored only adds a new snapshot. Their
+// names are keyed too, so that they do not reveal which known files the
+// repository holds. Objects
+// are written to a temporary name and renamed into place. Backups take a
+// shared lock and may run together; Prune takes an exclusive one, so that
+// it cannot delete chunks a running backup is about to refer to.
+
+const repositoryVersion = 1
+
+var (
+	// ErrNotRepository is returned when a directory holds no repository.
+	ErrNotRepository = errors.New("not a tartarus repository")
+	// ErrSnapshotNotFound is returned for unknown snapshot IDs.
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrRepositoryLocked is returned when a backup and a prune would run
+	// at the same time.
+	ErrRepositoryLocked = errors.New("repository is locked")
+	// ErrRepositoryExists is returned when initialising a directory that
+	// is not empty.
+	ErrRepositoryExists = errors.New("repository directory is not empty")
+)
+
+// RepositoryOptions configures a new repository.
+type RepositoryOptions struct {
+	// Codec compresses chunks; empty means DefaultCodec.
+	Codec         string
+	CompressLevel int
+	// Passphrase, KDF and Recipients protect the repository keys as in
+	// ArchiveOptions.
+	Passphrase []byte
+	KDF        KDFParams
+	Recipients []*X25519Recipient
+}
+
+type repositoryConfig struct {
+	Version     int    `json:"version"`
+	ID          string `json:"id"`
+	Codec       string `json:"codec"`
+	Level       int    `json:"level,omitempty"`
+	ChunkerSeed uint64 `json:"chunker_seed"`
+	EncKey      []byte `json:"enc_key"`
+	MACKey      []byte `json:"mac_key"`
+	IDKey       []byte `json:"id_key"`
+}
+
+// Repository is an open backup repository.
+type Repository struct {
+	dir    string
+	config repositoryConfig
+	codec  *Codec
+	block  cipher.Block
+	gear   *[256]uint64
+}
+
+// InitRepository creates an empty repository in dir, which must not exist
+// or be empty.
+func InitRepository(dir string, opts RepositoryOptions) (*Repository, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryExists, dir)
+	}
+	codec, err := LookupCodec(opts.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if codec.NewWriter == nil {
+		return nil, fmt.Errorf("codec %s cannot compress", codec.Name)
+	}
+
+	keys := make([]byte, 3*aesKeySize+16+8)
+	if _, err := rand.Read(keys); err != nil {
+		return nil, err
+	}
+	config := repositoryConfig{
+		Version:     repositoryVersion,
+		ID:          hex.EncodeToString(keys[3*aesKeySize : 3*aesKeySize+16]),
+		Codec:       codec.Name,
+		Level:       opts.CompressLevel,
+		ChunkerSeed: binary.BigEndian.Uint64(keys[3*aesKeySize+16:]),
+		EncKey:      keys[:aesKeySize],
+		MACKey:      keys[aesKeySize : 2*aesKeySize],
+		IDKey:       keys[2*aesKeySize : 3*aesKeySize],
+	}
+
+	for _, sub := range []string{"data", "snapshots", "locks"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	archiveOpts := ArchiveOptions{Passphrase: opts.Passphrase, KDF: opts.KDF, Recipients: opts.Recipients}
+	w, err := archiveOpts.encryptWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, "config"), buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return newRepository(dir, config)
+}
+
+// OpenRepository opens the repository in dir with keys.
+func OpenRepository(dir string, keys Keys) (*Repository, error) {
+	f, err := os.Open(filepath.Join(dir, "config"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotRepository, dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := DecryptReader(f, keys)
+	if err != nil {
+		return nil, err
+	}
+	var config repositoryConfig
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotRepository, err)
+	}
+	// Read to the end so the final chunk is authenticated.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	if config.Version != repositoryVersion {
+		return nil, fmt.Errorf("%w: repository version %d", ErrUnsupportedFormat, config.Version)
+	}
+	return newRepository(dir, config)
+}
+
+func newRepository(dir string, config repositoryConfig) (*Repository, error) {
+	if len(config.IDKey) == 0 {
+		return nil, fmt.Errorf("%w: repository has no chunk id key", ErrUnsupportedFormat)
+	}
+	codec, err := LookupCodec(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(config.EncKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{
+		dir:    dir,
+		config: config,
+		codec:  codec,
+		block:  block,
+		gear:   gearTable(config.ChunkerSeed),
+	}, nil
+}
+
+// seal encrypts an object under a fresh nonce: nonce || ciphertext || HMAC.
+func (r *Repository) seal(plain []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, nonceSize+len(plain), nonceSize+len(plain)+hmacSize)
+	copy(out, nonce)
+	cipher.NewCTR(r.block, nonce).XORKeyStream(out[nonceSize:], plain)
+	mac := chunkMAC{hmac: hmac.New(sha256.New, r.config.MACKey), nonce: nonce}
+	return append(out, mac.sum(out[nonceSize:], true)...), nil
+}
+
+func (r *Repository) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < nonceSize+hmacSize {
+		return nil, ErrTruncated
+	}
+	nonce := sealed[:nonceSize]
+	ciphertext := sealed[nonceSize : len(sealed)-hmacSize]
+	mac := chunkMAC{hmac: hmac.New(sha256.New, r.config.MACKey), nonce: nonce}
+	if !hmac.Equal(mac.sum(ciphertext, true), sealed[len(sealed)-hmacSize:]) {
+		return nil, ErrAuthentication
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCTR(r.block, nonce).XORKeyStream(plain, ciphertext)
+	return plain, nil
+}
+
+// chunkID names a chunk by the HMAC-SHA256 of its plaintext.
+func (r *Repository) chunkID(data []byte) []byte {
+	m := hmac.New(sha256.New, r.config.IDKey)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.dir, "data", id[:2], id)
+}
+
+// storeChunk saves a chunk unless the repository has it already and reports
+// the bytes it added.
+func (r *Repository) storeChunk(data []byte) (string, int64, error) {
+	id := hex.EncodeToString(r.chunkID(data))
+	path := r.chunkPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return id, 0, nil
+	}
+
+	var buf bytes.Buffer
+	cw, err := NewCompressWriter(&buf, r.codec.Name, r.config.Level)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := cw.Write(data); err != nil {
+		return "", 0, err
+	}
+	if err := cw.Close(); err != nil {
+		return "", 0, err
+	}
+	sealed, err := r.seal(buf.Bytes())
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", 0, err
+	}
+	if err := writeFileAtomic(path, sealed); err != nil {
+		return "", 0, err
+	}
+	return id, int64(len(sealed)), nil
+}
+
+// loadChunk reads a chunk and checks it against its ID.
+func (r *Repository) loadChunk(id string) ([]byte, error) {
+	want, err := hex.DecodeString(id)
+	if err != nil || len(want) != sha256.Size {
+		return nil, fmt.Errorf("invalid chunk id %q", id)
+	}
+	sealed, err := os.ReadFile(r.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := r.open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	dr, err := NewDecompressReader(bytes.NewReader(compressed), r.codec.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	data, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	if !hmac.Equal(r.chunkID(data), want) {
+		return nil, fmt.Errorf("%w: chunk %s does not match its id", ErrAuthentication, id)
+	}
+	return data, nil
+}
+
+// exclusiveLock is the name of the lock file Prune holds.
+const exclusiveLock = "exclusive"
+
+// lock takes a shared or the exclusive lock on the repository and returns
+// the function that releases it. A lock is a file in locks/; one left by a
+// process that died has to be removed by hand.
+func (r *Repository) lock(exclusive bool) (func(), error) {
+	dir := filepath.Join(r.dir, "locks")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var f *os.File
+	var err error
+	if exclusive {
+		path := filepath.Join(dir, exclusiveLock)
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			return nil, fmt.Errorf("%w: %s exists", ErrRepositoryLocked, path)
+		}
+	} else {
+		f, err = os.CreateTemp(dir, "shared-*")
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	f.Close()
+	unlock := func() { os.Remove(f.Name()) }
+
+	// Look for conflicting locks only once ours is in place, so that of two
+	// processes starting together at least one sees the other.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.Name() != filepath.Base(f.Name()) && (exclusive || e.Name() == exclusiveLock) {
+			unlock()
+			return nil, fmt.Errorf("%w: %s exists", ErrRepositoryLocked, filepath.Join(dir, e.Name()))
+		}
+	}
+	return unlock, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partial object.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// RepoSnapshot describes a snapshot in a repository.
+type RepoSnapshot struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Files  int       `json:"files"`
+	// Size is the total size of the files; Added is what storing the
+	// snapshot's new chunks took.
+	Size  int64 `json:"size"`
+	Added int64 `json:"added"`
+}
+
+// repoNode is one entry of a snapshot tree.
+type repoNode struct {
+	Name     string            `json:"name"`
+	Type     byte              `json:"type"`
+	Mode     int64             `json:"mode"`
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	Uname    string            `json:"uname,omitempty"`
+	Gname    string            `json:"gname,omitempty"`
+	ModTime  time.Time         `json:"mtime"`
+	Size     int64             `json:"size,omitempty"`
+	Link     string            `json:"link,omitempty"`
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	PAX      map[string]string `json:"pax,omitempty"`
+	Chunks   []string          `json:"chunks,omitempty"`
+}
+
+func newRepoNode(hdr *tar.Header) repoNode {
+	return repoNode{
+		Name:     hdr.Name,
+		Type:     hdr.Typeflag,
+		Mode:     hdr.Mode,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+		ModTime:  hdr.ModTime,
+		Size:     hdr.Size,
+		Link:     hdr.Linkname,
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+		PAX:      hdr.PAXRecords,
+	}
+}
+
+func (n repoNode) header() *tar.Header {
+	return &tar.Header{
+		Name:       n.Name,
+		Typeflag:   n.Type,
+		Mode:       n.Mode,
+		Uid:        n.Uid,
+		Gid:        n.Gid,
+		Uname:      n.Uname,
+		Gname:      n.Gname,
+		ModTime:    n.ModTime,
+		Size:       n.Size,
+		Linkname:   n.Link,
+		Devmajor:   n.Devmajor,
+		Devminor:   n.Devminor,
+		PAXRecords: n.PAX,
+	}
+}
+
+type repoSnapshotFile struct {
+	RepoSnapshot
+	Tree []repoNode `json:"tree"`
+}
+
+// repoEntryWriter chunks walked files into the repository.
+type repoEntryWriter struct {
+	repo *Repository
+	snap *repoSnapshotFile
+}
+
+func (w repoEntryWriter) writeEntry(hdr *tar.Header, path string) error {
+	node := newRepoNode(hdr)
+	if hdr.Typeflag == tar.TypeReg {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		node.Size = 0
+		c := newChunker(f, w.repo.gear)
+		for {
+			data, err := c.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			id, added, err := w.repo.storeChunk(data)
+			if err != nil {
+				return err
+			}
+			node.Chunks = append(node.Chunks, id)
+			node.Size += int64(len(data))
+			w.snap.Added += added
+		}
+		w.snap.Files++
+		w.snap.Size += node.Size
+	}
+	w.snap.Tree = append(w.snap.Tree, node)
+	return nil
+}
+
+// Backup stores the tree below src as a new snapshot, walking it as
+// TarFolder does.
+func (r *Repository) Backup(src string, opts TarOptions) (*RepoSnapshot, error) {
+	unlock, err := r.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	snap := &repoSnapshotFile{RepoSnapshot: RepoSnapshot{
+		ID:     hex.EncodeToString(id),
+		Time:   time.Now().UTC(),
+		Source: src,
+	}}
+	if err := newTreeWalker(repoEntryWriter{r, snap}, opts).run(src); err != nil {
+		return nil, err
+	}
+
+	encoded, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := r.seal(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(r.dir, "snapshots", snap.ID), sealed); err != nil {
+		return nil, err
+	}
+	return &snap.RepoSnapshot, nil
+}
+
+func (r *Repository) loadSnapshot(id string) (*repoSnapshotFile, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, id)
+	}
+	sealed, err := os.ReadFile(filepath.Join(r.dir, "snapshots", id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	plain, err := r.open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	snap := new(repoSnapshotFile)
+	if err := json.Unmarshal(plain, snap); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", id, err)
+	}
+	if snap.ID != id {
+		return nil, fmt.Errorf("%w: snapshot %s is stored as %s", ErrAuthentication, snap.ID, id)
+	}
+	return snap, nil
+}
+
+func (r *Repository) loadSnapshots() ([]*repoSnapshotFile, error) {
+	entries, err := os.ReadDir(filepath.Join(r.dir, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var snaps []*repoSnapshotFile
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		snap, err := r.loadSnapshot(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool { return snaps[i].Time.Before(snaps[j].Time) })
+	return snaps, nil
+}
+
+// Snapshots lists the snapshots in the repository, oldest first.
+func (r *Repository) Snapshots() ([]RepoSnapshot, error) {
+	snaps, err := r.loadSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]RepoSnapshot, len(snaps))
+	for i, s := range snaps {
+		list[i] = s.RepoSnapshot
+	}
+	return list, nil
+}
+
+// chunkReader streams the chunks of one file.
+type chunkReader struct {
+	repo   *Repository
+	chunks []string
+	buf    []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := c.repo.loadChunk(c.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		c.buf, c.chunks = data, c.chunks[1:]
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// Restore writes a snapshot below destDir with the same confinement,
+// selection and ownership handling as Untar.
+func (r *Repository) Restore(id, destDir string, opts ExtractOptions) error {
+	snap, err := r.loadSnapshot(id)
+	if err != nil {
+		return err
+	}
+	x, err := newExtractor(destDir, opts)
+	if err != nil {
+		return err
+	}
+	for _, node := range snap.Tree {
+		body := &chunkReader{repo: r, chunks: node.Chunks}
+		if err := x.extract(node.header(), body); err != nil {
+			return err
+		}
+	}
+	return x.finish()
+}
+
+// Forget removes snapshots. The chunks only they used stay until Prune.
+func (r *Repository) Forget(ids ...string) error {
+	for _, id := range ids {
+		if _, err := r.loadSnapshot(id); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if err := os.Remove(filepath.Join(r.dir, "snapshots", id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneStats reports what Prune did.
+type PruneStats struct {
+	Kept    int   `json:"kept"`
+	Removed int   `json:"removed"`
+	Freed   int64 `json:"freed"`
+}
+
+// Prune deletes the chunks no snapshot refers to. It does not wait for
+// running backups but fails with ErrRepositoryLocked.
+func (r *Repository) Prune() (PruneStats, error) {
+	var stats PruneStats
+	unlock, err := r.lock(true)
+	if err != nil {
+		return stats, err
+	}
+	defer unlock()
+
+	snaps, err := r.loadSnapshots()
+	if err != nil {
+		return stats, err
+	}
+	used := make(map[string]bool)
+	for _, s := range snaps {
+		for _, node := range s.Tree {
+			for _, id := range node.Chunks {
+				used[id] = true
+			}
+		}
+	}
+
+	err = filepath.WalkDir(filepath.Join(r.dir, "data"), func(path string, d fs.DirEntry, err error) error {
+		// Temporary names are objects still being written.
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return err
+		}
+		if used[d.Name()] {
+			stats.Kept++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		stats.Removed++
+		stats.Freed += info.Size()
+		return nil
+	})
+	return stats, err
+}
@@ -0,0 +1,165 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkerBounds(t *testing.T) {
+	data := make([]byte, 20<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	c := newChunker(bytes.NewReader(data), gearTable(42))
+	var joined []byte
+	for {
+		chunk, err := c.next()
+		if err != nil {
+			break
+		}
+		if len(chunk) > maxChunkSize || (len(chunk) < minChunkSize && len(joined)+len(chunk) != len(data)) {
+			t.Errorf("chunk of %d bytes", len(chunk))
+		}
+		joined = append(joined, chunk...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not reassemble the input")
+	}
+}
+
+func TestRepositoryBackupRestore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "repo")
+	src := t.TempDir()
+	pass := []byte("repository")
+	if _, err := InitRepository(dir, RepositoryOptions{Passphrase: pass}); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := OpenRepository(dir, Keys{Passphrase: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fixed chunker seed keeps the chunk boundaries, and so the amount
+	// deduplicated, the same on every run.
+	repo.gear = gearTable(7)
+
+	big := make([]byte, 8<<20)
+	rand.New(rand.NewSource(2)).Read(big)
+	createTestFiles(t, src, map[string]string{"small.txt": "small", "sub/big.bin": string(big)})
+	first, err := repo.Backup(src, TarOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunk names are keyed, so they do not give away known content.
+	sum := sha256.Sum256([]byte("small"))
+	if _, err := os.Stat(repo.chunkPath(hex.EncodeToString(sum[:]))); err == nil {
+		t.Error("chunk stored under the plain SHA-256 of its content")
+	}
+	if _, err := os.Stat(repo.chunkPath(hex.EncodeToString(repo.chunkID([]byte("small"))))); err != nil {
+		t.Error(err)
+	}
+
+	// Shifting the data only changes the chunk around the insertion.
+	createTestFiles(t, src, map[string]string{"sub/big.bin": "inserted" + string(big)})
+	second, err := repo.Backup(src, TarOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Added > first.Added/2 {
+		t.Errorf("second snapshot added %d bytes, first %d", second.Added, first.Added)
+	}
+
+	snaps, err := repo.Snapshots()
+	if err != nil || len(snaps) != 2 {
+		t.Fatalf("snapshots = %v, %v", snaps, err)
+	}
+
+	if err := repo.Forget(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := repo.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed == 0 || stats.Kept == 0 {
+		t.Errorf("prune stats = %+v", stats)
+	}
+	if err := repo.Restore(first.ID, t.TempDir(), ExtractOptions{}); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("restoring forgotten snapshot: got %v", err)
+	}
+
+	dest := t.TempDir()
+	if err := repo.Restore(second.ID, dest, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dest, "small.txt")); got != "small" {
+		t.Errorf("small.txt = %q", got)
+	}
+	if got := readFile(t, filepath.Join(dest, "sub/big.bin")); got != "inserted"+string(big) {
+		t.Error("big.bin does not match")
+	}
+}
+
+func TestRepositoryLocks(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "repo")
+	repo, err := InitRepository(dir, RepositoryOptions{Passphrase: []byte("locks")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{"a.txt": "a"})
+
+	unlock, err := repo.lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Backup(src, TarOptions{}); err != nil {
+		t.Fatalf("backup beside another backup: %v", err)
+	}
+	if _, err := repo.Prune(); !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("prune during a backup: got %v, want ErrRepositoryLocked", err)
+	}
+	unlock()
+
+	unlock, err = repo.lock(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Backup(src, TarOptions{}); !errors.Is(err, ErrRepositoryLocked) {
+		t.Errorf("backup during a prune: got %v, want ErrRepositoryLocked", err)
+	}
+	unlock()
+
+	// An object being written is not an unused chunk.
+	tmp := filepath.Join(dir, "data", "ab", ".tmp-123")
+	os.MkdirAll(filepath.Dir(tmp), 0700)
+	os.WriteFile(tmp, []byte("partial"), 0600)
+	if _, err := repo.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("prune removed a temporary object: %v", err)
+	}
+}
+
+func TestOpenRepositoryErrors(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "repo")
+	if _, err := InitRepository(dir, RepositoryOptions{Passphrase: []byte("right")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenRepository(dir, Keys{Passphrase: []byte("wrong")}); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("wrong passphrase: got %v", err)
+	}
+	if _, err := OpenRepository(t.TempDir(), Keys{Passphrase: []byte("right")}); !errors.Is(err, ErrNotRepository) {
+		t.Errorf("empty directory: got %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "stray"), nil, 0600)
+	if _, err := InitRepository(dir, RepositoryOptions{Passphrase: []byte("x")}); err == nil {
+		t.Error("init over a non-empty directory succeeded")
+	}
+}
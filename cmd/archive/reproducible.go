@@ -0,0 +1,73 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Reproducible configures headers that depend only on the tree's contents.
+// The walk is in lexical order already; reproducible mode also stores every
+// entry as owned by root with no user or group names, normalizes
+// permissions to 0755 for directories and executables and 0644 for other
+// files, drops access and change times and stores modification times in
+// whole seconds. Files with holes are stored whole, since which parts read
+// as holes depends on the file system. Snapshot manifests still record
+// when they were made.
+type Reproducible struct {
+	// ModTime is stored for every entry, or with Clamp only for entries
+	// modified later. Zero uses SOURCE_DATE_EPOCH, and keeps the times as
+	// found when that is unset too.
+	ModTime time.Time
+	Clamp   bool
+}
+
+// SourceDateEpoch returns the time in SOURCE_DATE_EPOCH, the convention
+// for reproducible builds, and whether it is set.
+func SourceDateEpoch() (time.Time, bool, error) {
+	s := os.Getenv("SOURCE_DATE_EPOCH")
+	if s == "" {
+		return time.Time{}, false, nil
+	}
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q", s)
+	}
+	return time.Unix(secs, 0).UTC(), true, nil
+}
+
+// modTime resolves the time to store, zero meaning the times as found.
+func (r Reproducible) modTime() (time.Time, error) {
+	if !r.ModTime.IsZero() {
+		return r.ModTime, nil
+	}
+	t, _, err := SourceDateEpoch()
+	return t, err
+}
+
+// normalize rewrites hdr for reproducible output, with epoch from modTime.
+func (r Reproducible) normalize(hdr *tar.Header, epoch time.Time) {
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		hdr.Mode = 0755
+	case tar.TypeSymlink:
+		hdr.Mode = 0777
+	default:
+		if hdr.Mode&0111 != 0 {
+			hdr.Mode = 0755
+		} else {
+			hdr.Mode = 0644
+		}
+	}
+
+	if !epoch.IsZero() && (!r.Clamp || hdr.ModTime.After(epoch)) {
+		hdr.ModTime = epoch
+	}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second).UTC()
+}
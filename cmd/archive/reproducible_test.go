@@ -0,0 +1,125 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reproTree writes the same contents with different metadata each call.
+func reproTree(t *testing.T, perm os.FileMode, mtime time.Time) string {
+	t.Helper()
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "b", "c"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"a.txt": "alpha", "b/c/d.txt": "delta", "b/run.sh": "#!/bin/sh\n"}
+	for name, data := range files {
+		p := filepath.Join(src, name)
+		mode := perm
+		if filepath.Ext(name) == ".sh" {
+			mode |= 0100
+		}
+		if err := os.WriteFile(p, []byte(data), mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(p, mode)
+		os.Chtimes(p, mtime, mtime)
+	}
+	os.Symlink("a.txt", filepath.Join(src, "link"))
+	return src
+}
+
+func TestReproducibleTar(t *testing.T) {
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tarOf := func(src string, r *Reproducible, dialect tar.Format) []byte {
+		var buf bytes.Buffer
+		if err := TarFolder(src, &buf, TarOptions{Reproducible: r, Dialect: dialect}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	first := reproTree(t, 0600, time.Now().Add(-time.Hour))
+	second := reproTree(t, 0640, time.Now().Add(-123456789*time.Nanosecond))
+	for _, dialect := range []tar.Format{tar.FormatUSTAR, tar.FormatPAX, tar.FormatGNU} {
+		r := &Reproducible{ModTime: fixed}
+		a, b := tarOf(first, r, dialect), tarOf(second, r, dialect)
+		if !bytes.Equal(a, b) {
+			t.Errorf("%v: streams differ", dialect)
+		}
+	}
+
+	tr := tar.NewReader(bytes.NewReader(tarOf(first, &Reproducible{ModTime: fixed}, tar.FormatPAX)))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Uid != 0 || hdr.Uname != "" || !hdr.ModTime.Equal(fixed) {
+			t.Errorf("%s: %+v", hdr.Name, hdr)
+		}
+		want := int64(0644)
+		switch hdr.Name {
+		case "b/", "b/c/", "b/run.sh":
+			want = 0755
+		case "link":
+			want = 0777
+		}
+		if hdr.Mode != want {
+			t.Errorf("%s: mode %o, want %o", hdr.Name, hdr.Mode, want)
+		}
+	}
+	want := []string{"a.txt", "b/", "b/c/", "b/c/d.txt", "b/run.sh", "link"}
+	if len(names) != len(want) {
+		t.Fatalf("entries %q", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("entries %q, want %q", names, want)
+			break
+		}
+	}
+}
+
+func TestReproducibleClamp(t *testing.T) {
+	old := time.Date(2020, 5, 5, 0, 0, 0, 0, time.UTC)
+	src := reproTree(t, 0644, old)
+	t.Setenv("SOURCE_DATE_EPOCH", "1650000000")
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{Reproducible: &Reproducible{Clamp: true}}); err != nil {
+		t.Fatal(err)
+	}
+	epoch := time.Unix(1650000000, 0)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "a.txt" && !hdr.ModTime.Equal(old) {
+			t.Errorf("older time clamped: %v", hdr.ModTime)
+		}
+		if hdr.Name == "b/" && !hdr.ModTime.Equal(epoch) {
+			t.Errorf("newer time not clamped: %v", hdr.ModTime)
+		}
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	if err := TarFolder(src, io.Discard, TarOptions{Reproducible: &Reproducible{}}); err == nil {
+		t.Error("invalid SOURCE_DATE_EPOCH accepted")
+	}
+}
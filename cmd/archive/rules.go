@@ -0,0 +1,204 @@
+package archive
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the per-directory rules file read when
+// TarOptions.IgnoreFiles is set.
+const IgnoreFileName = ".tartarusignore"
+
+// Rule is one exclusion pattern with .gitignore semantics. A pattern without
+// a slash, other than a trailing one, matches at any depth below the rule's
+// directory; any other pattern is anchored to it. "**" matches any number of
+// directories, though a trailing "/**" only matches what is inside one. A
+// trailing "/" only matches directories and a leading "!" re-includes what
+// earlier rules excluded.
+type Rule struct {
+	// Pattern is the rule as written.
+	Pattern string `json:"pattern"`
+	// Source names the ignore file the rule was read from; it is empty for
+	// rules given in the options.
+	Source string `json:"source,omitempty"`
+
+	base     string
+	negate   bool
+	dirOnly  bool
+	segments []string
+}
+
+func (r *Rule) String() string {
+	if r.Source == "" {
+		return r.Pattern
+	}
+	return r.Source + ": " + r.Pattern
+}
+
+// parseRule parses one line, returning nil for blank lines and comments.
+func parseRule(line, base, source string) (*Rule, error) {
+	p := strings.TrimRight(line, " \t\r")
+	if strings.HasSuffix(p, `\`) && len(p) < len(strings.TrimRight(line, "\r")) {
+		p += " " // an escaped trailing space
+	}
+	if p == "" || strings.HasPrefix(p, "#") {
+		return nil, nil
+	}
+	r := &Rule{Pattern: p, Source: source, base: base}
+	if strings.HasPrefix(p, "!") {
+		r.negate = true
+		p = p[1:]
+	} else if strings.HasPrefix(p, `\!`) || strings.HasPrefix(p, `\#`) {
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		r.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	if p == "" {
+		return nil, fmt.Errorf("empty pattern %q", line)
+	}
+
+	anchored := strings.Contains(p, "/")
+	r.segments = strings.Split(strings.TrimPrefix(p, "/"), "/")
+	if !anchored {
+		r.segments = append([]string{"**"}, r.segments...)
+	}
+	for _, seg := range r.segments {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", line, err)
+		}
+	}
+	return r, nil
+}
+
+// matches reports whether the rule matches a path relative to the archive
+// root.
+func (r *Rule) matches(name string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		rest, ok := strings.CutPrefix(name, r.base+"/")
+		if !ok {
+			return false
+		}
+		name = rest
+	}
+	return matchSegments(r.segments, strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// A trailing "**" matches what is inside a directory, not the
+			// directory itself, so later rules can re-include from it.
+			skip := 0
+			if len(pattern) == 1 {
+				skip = 1
+			}
+			for ; skip <= len(parts); skip++ {
+				if matchSegments(pattern[1:], parts[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
+
+// Rules is an ordered list of rules; the last one matching a path decides.
+type Rules struct {
+	rules []*Rule
+}
+
+// ParseRules parses rules given one per line, as in an ignore file.
+func ParseRules(lines []string) (*Rules, error) {
+	return parseRules(lines, "", "")
+}
+
+func parseRules(lines []string, base, source string) (*Rules, error) {
+	rs := new(Rules)
+	for _, line := range lines {
+		r, err := parseRule(line, base, source)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			rs.rules = append(rs.rules, r)
+		}
+	}
+	return rs, nil
+}
+
+// readIgnoreFile reads the ignore file of the directory dir, whose path in
+// the archive is base. A missing file gives nil rules.
+func readIgnoreFile(dir, base string) (*Rules, error) {
+	f, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return parseRules(lines, base, path.Join(base, IgnoreFileName))
+}
+
+// Match reports whether the rules exclude the path, and the rule that
+// decided. As with .gitignore, nothing below an excluded directory can be
+// re-included.
+func (rs *Rules) Match(name string, isDir bool) (bool, *Rule) {
+	return matchRules([]*Rules{rs}, name, isDir)
+}
+
+// matchRules applies the rule sets in order to name and the directories it
+// is in.
+func matchRules(sets []*Rules, name string, isDir bool) (bool, *Rule) {
+	name = strings.Trim(name, "/")
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if excluded, rule := decide(sets, strings.Join(parts[:i], "/"), true); excluded {
+			return true, rule
+		}
+	}
+	return decide(sets, name, isDir)
+}
+
+func decide(sets []*Rules, name string, isDir bool) (bool, *Rule) {
+	var excluded bool
+	var decided *Rule
+	for _, rs := range sets {
+		if rs == nil {
+			continue
+		}
+		for _, r := range rs.rules {
+			if r.matches(name, isDir) {
+				excluded, decided = !r.negate, r
+			}
+		}
+	}
+	return excluded, decided
+}
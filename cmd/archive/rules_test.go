@@ -0,0 +1,174 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRulesMatch(t *testing.T) {
+	rules, err := ParseRules([]string{
+		"# build output",
+		"*.log",
+		"!keep.log",
+		"**/node_modules",
+		"/build/",
+		"docs/**/*.tmp",
+		`\#literal`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		isDir    bool
+		excluded bool
+	}{
+		{"app.log", false, true},
+		{"sub/dir/app.log", false, true},
+		{"keep.log", false, false},
+		{"sub/keep.log", false, false},
+		{"node_modules", true, true},
+		{"a/b/node_modules/pkg/index.js", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/out.bin", false, true},
+		{"src/build", true, false},
+		{"docs/x.tmp", false, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"x.tmp", false, false},
+		{"#literal", false, true},
+		{"main.go", false, false},
+	}
+	for _, tt := range tests {
+		if got, _ := rules.Match(tt.name, tt.isDir); got != tt.excluded {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.name, tt.isDir, got, tt.excluded)
+		}
+	}
+	if _, rule := rules.Match("sub/keep.log", false); rule == nil || rule.Pattern != "!keep.log" {
+		t.Errorf("deciding rule = %v", rule)
+	}
+	if _, err := ParseRules([]string{"[unclosed"}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestRulesNoReincludeBelowExcludedDir(t *testing.T) {
+	rules, _ := ParseRules([]string{"cache/", "!cache/keep.txt"})
+	if excluded, _ := rules.Match("cache/keep.txt", false); !excluded {
+		t.Error("file below an excluded directory was re-included")
+	}
+}
+
+func TestRulesReincludeFromTrailingDoubleStar(t *testing.T) {
+	rules, _ := ParseRules([]string{"build/**", "!build/keep.txt"})
+	tests := []struct {
+		name     string
+		isDir    bool
+		excluded bool
+	}{
+		{"build", true, false},
+		{"build/out.bin", false, true},
+		{"build/sub", true, true},
+		{"build/keep.txt", false, false},
+		{"build/sub/keep.txt", false, true},
+	}
+	for _, tt := range tests {
+		if got, _ := rules.Match(tt.name, tt.isDir); got != tt.excluded {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.name, tt.isDir, got, tt.excluded)
+		}
+	}
+}
+
+func TestTarFolderIgnoreFiles(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{
+		IgnoreFileName:          "*.tmp\nvendor/\n",
+		"a.txt":                 "a",
+		"a.tmp":                 "tmp",
+		"vendor/lib.go":         "lib",
+		"sub/" + IgnoreFileName: "!keep.tmp\n/local.txt\n",
+		"sub/keep.tmp":          "kept",
+		"sub/drop.tmp":          "dropped",
+		"sub/local.txt":         "local",
+		"sub/deeper/local.txt":  "deeper",
+		"other/local.txt":       "other",
+	})
+	rules, _ := ParseRules([]string{"other/"})
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{Rules: rules, IgnoreFiles: true}); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			names = append(names, hdr.Name)
+		}
+	}
+	sort.Strings(names)
+	want := []string{IgnoreFileName, "a.txt", "sub/" + IgnoreFileName, "sub/deeper/local.txt", "sub/keep.tmp"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("archived %v, want %v", names, want)
+	}
+}
+
+func TestTarFolderPrunesExcludedTrees(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{
+		"keep/a.txt":           "a",
+		"cache/x/1.bin":        "1",
+		"cache/x/2.bin":        "2",
+		"build/out/app":        "app",
+		"logs/today.log":       "log",
+		"logs/archive/old.log": "old",
+	})
+	rules, _ := ParseRules([]string{"cache/"})
+	var asked []string
+	opts := TarOptions{
+		Filter: func(p string) bool { return !strings.HasPrefix(p, "logs/archive") },
+		Rules:  rules,
+		Select: func(p string, isDir bool) Verdict {
+			asked = append(asked, p)
+			return ExcludeTrees([]string{"build"})(p, isDir)
+		},
+	}
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range asked {
+		if strings.HasPrefix(p, "build/") {
+			t.Errorf("walked into pruned directory: %s", p)
+		}
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	want := []string{"keep/", "keep/a.txt", "logs/", "logs/today.log"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("archived %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,109 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinkHops bounds how many symlinks are followed while resolving a
+// single member path, guarding against loops planted by earlier members.
+const maxSymlinkHops = 255
+
+// ErrPathEscapes is returned when a member path resolves outside the
+// extraction root.
+var ErrPathEscapes = errors.New("path escapes destination root")
+
+// UnsafeEntriesError reports archive members that were not extracted
+// because they would have been written outside the destination root.
+type UnsafeEntriesError struct {
+	Members []string
+}
+
+func (e *UnsafeEntriesError) Error() string {
+	return fmt.Sprintf("rejected %d unsafe archive member(s): %s", len(e.Members), strings.Join(e.Members, ", "))
+}
+
+// extractRoot prepares destDir for extraction and returns its absolute,
+// symlink-free form so that resolved member paths can be compared to it.
+func extractRoot(destDir string) (string, error) {
+	root, err := filepath.Abs(destDir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+func splitMemberPath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == filepath.Separator
+	})
+}
+
+// resolveInRoot maps an archive member name onto the filesystem below root.
+// Every existing component is checked with Lstat and symlinks (including ones
+// created by earlier members) are expanded, so the result can never point
+// outside root. When followLast is false a symlink in the final component is
+// left alone, which is what callers that replace the entry itself want.
+func resolveInRoot(root, name string, followLast bool) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", ErrPathEscapes
+	}
+
+	pending := splitMemberPath(name)
+	var resolved []string
+	hops := 0
+
+	for len(pending) > 0 {
+		comp := pending[0]
+		pending = pending[1:]
+
+		switch comp {
+		case ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", ErrPathEscapes
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		if len(pending) == 0 && !followLast {
+			resolved = append(resolved, comp)
+			break
+		}
+
+		current := filepath.Join(root, filepath.Join(append(resolved, comp)...))
+		info, err := os.Lstat(current)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, comp)
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links in %q", name)
+		}
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			rel, err := filepath.Rel(root, filepath.Clean(target))
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return "", ErrPathEscapes
+			}
+			resolved = nil
+			target = rel
+		}
+		pending = append(splitMemberPath(target), pending...)
+	}
+
+	return filepath.Join(root, filepath.Join(resolved...)), nil
+}
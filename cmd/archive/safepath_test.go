@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			Size:     int64(len(e.body)),
+		}
+		if e.typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root, err := extractRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(root, "inside"), 0755)
+	os.Symlink("inside", filepath.Join(root, "good"))
+	os.Symlink("../..", filepath.Join(root, "bad"))
+	os.Symlink("/etc", filepath.Join(root, "abs"))
+
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a/b.txt", "a/b.txt", true},
+		{"a/../b.txt", "b.txt", true},
+		{"good/x", "inside/x", true},
+		{"../x", "", false},
+		{"a/../../x", "", false},
+		{"/etc/passwd", "", false},
+		{"bad/x", "", false},
+		{"abs/passwd", "", false},
+	}
+	for _, tt := range tests {
+		got, err := resolveInRoot(root, tt.name, false)
+		if !tt.ok {
+			if !errors.Is(err, ErrPathEscapes) {
+				t.Errorf("resolveInRoot(%q) = %q, %v; want ErrPathEscapes", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != filepath.Join(root, tt.want) {
+			t.Errorf("resolveInRoot(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestUntarRejectsEscapingMembers(t *testing.T) {
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+
+	buf := buildTar(t, []tarEntry{
+		{name: "ok.txt", typeflag: tar.TypeReg, body: "fine"},
+		{name: "../evil.txt", typeflag: tar.TypeReg, body: "evil"},
+		{name: "/tmp/abs.txt", typeflag: tar.TypeReg, body: "evil"},
+	})
+
+	err := UntarStream(buf, dest)
+	var unsafe *UnsafeEntriesError
+	if !errors.As(err, &unsafe) {
+		t.Fatalf("expected UnsafeEntriesError, got %v", err)
+	}
+	if len(unsafe.Members) != 2 {
+		t.Errorf("expected 2 rejected members, got %v", unsafe.Members)
+	}
+	if got := readFile(t, filepath.Join(dest, "ok.txt")); got != "fine" {
+		t.Errorf("ok.txt = %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "evil.txt")); err == nil {
+		t.Errorf("evil.txt escaped the destination")
+	}
+}
+
+func TestUntarRejectsWritesThroughSymlink(t *testing.T) {
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A link planted before extraction must not redirect member writes.
+	if err := os.Symlink(parent, filepath.Join(dest, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := buildTar(t, []tarEntry{
+		{name: "link/escaped.txt", typeflag: tar.TypeReg, body: "evil"},
+	})
+
+	err := UntarStream(buf, dest)
+	var unsafe *UnsafeEntriesError
+	if !errors.As(err, &unsafe) {
+		t.Fatalf("expected UnsafeEntriesError, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escaped.txt")); err == nil {
+		t.Errorf("escaped.txt was written through the symlink")
+	}
+}
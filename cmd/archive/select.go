@@ -0,0 +1,103 @@
+package archive
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// memberPath normalises an archive member name for matching: no leading
+// "./" or "/", no trailing slash.
+func memberPath(name string) string {
+	return strings.Join(splitMemberPath(path.Clean("/"+name)), "/")
+}
+
+// matchesTree reports whether name, or one of the directories it is in,
+// matches a pattern. Patterns are compared with the base name and the full
+// path like archive filters are, so "*.conf" and "etc/app" both work.
+func matchesTree(patterns []string, name string) bool {
+	for p := name; p != "" && p != "."; p = path.Dir(p) {
+		for _, pat := range patterns {
+			if ok, _ := path.Match(pat, path.Base(p)); ok {
+				return true
+			}
+			if ok, _ := path.Match(memberPath(pat), p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inMembers reports whether name is one of members or lies below one.
+func inMembers(members []string, name string) bool {
+	for _, m := range members {
+		m = memberPath(m)
+		if m == "" || name == m || strings.HasPrefix(name, m+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// selected reports whether the options pick the member called name.
+func (o ExtractOptions) selected(name string) bool {
+	name = memberPath(name)
+	if len(o.Members) > 0 && !inMembers(o.Members, name) {
+		return false
+	}
+	if len(o.Include) > 0 && !matchesTree(o.Include, name) {
+		return false
+	}
+	return !matchesTree(o.Exclude, name)
+}
+
+// targetName returns where a member is written relative to the destination
+// once StripComponents and Remap are applied, and false when nothing of the
+// name is left or the member is not selected. Names that point outside the
+// archive root are returned as they are, for the extractor to reject.
+func (o ExtractOptions) targetName(name string) (string, bool) {
+	if len(o.Members) == 0 && len(o.Include) == 0 && len(o.Exclude) == 0 &&
+		o.StripComponents == 0 && len(o.Remap) == 0 {
+		return name, true
+	}
+	if path.IsAbs(name) || strings.HasPrefix(path.Clean(name)+"/", "../") {
+		return name, true
+	}
+	if !o.selected(name) {
+		return "", false
+	}
+	parts := splitMemberPath(path.Clean("/" + name))
+	if o.StripComponents > 0 {
+		if len(parts) <= o.StripComponents {
+			return "", false
+		}
+		parts = parts[o.StripComponents:]
+	}
+	target := strings.Join(parts, "/")
+
+	// The longest matching prefix wins.
+	prefixes := make([]string, 0, len(o.Remap))
+	for from := range o.Remap {
+		prefixes = append(prefixes, from)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+	for _, from := range prefixes {
+		prefix := memberPath(from)
+		if prefix == "" {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(target, prefix); ok && (rest == "" || rest[0] == '/') {
+			target = memberPath(o.Remap[from] + rest)
+			break
+		}
+	}
+	if target == "" {
+		return "", false
+	}
+
+	if strings.HasSuffix(name, "/") {
+		target += "/"
+	}
+	return target, true
+}
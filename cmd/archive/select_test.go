@@ -0,0 +1,71 @@
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTargetName(t *testing.T) {
+	cases := []struct {
+		opts ExtractOptions
+		name string
+		want string
+		ok   bool
+	}{
+		{ExtractOptions{}, "./a/b", "./a/b", true},
+		{ExtractOptions{Members: []string{"etc"}}, "etc/app.conf", "etc/app.conf", true},
+		{ExtractOptions{Members: []string{"etc/"}}, "etc", "etc", true},
+		{ExtractOptions{Members: []string{"etc"}}, "etcetera/x", "", false},
+		{ExtractOptions{Include: []string{"*.conf"}}, "etc/app.conf", "etc/app.conf", true},
+		{ExtractOptions{Include: []string{"*.conf"}}, "etc/app.log", "", false},
+		{ExtractOptions{Include: []string{"etc"}, Exclude: []string{"secret*"}}, "etc/secret.key", "", false},
+		{ExtractOptions{Exclude: []string{"cache"}}, "home/cache/blob", "", false},
+		{ExtractOptions{StripComponents: 1}, "backup/etc/app.conf", "etc/app.conf", true},
+		{ExtractOptions{StripComponents: 1}, "backup/", "", false},
+		{ExtractOptions{StripComponents: 1}, "backup/etc/", "etc/", true},
+		{ExtractOptions{Remap: map[string]string{"etc": "restored/etc", "etc/app": "app"}}, "etc/app/x", "app/x", true},
+		{ExtractOptions{Remap: map[string]string{"etc": "restored"}}, "etcetera", "etcetera", true},
+		{ExtractOptions{Remap: map[string]string{"etc": "../../up"}}, "etc/x", "up/x", true},
+		{ExtractOptions{Members: []string{"etc"}}, "../evil", "../evil", true},
+	}
+	for _, c := range cases {
+		got, ok := c.opts.targetName(c.name)
+		if got != c.want || ok != c.ok {
+			t.Errorf("%+v %q: got %q, %v; want %q, %v", c.opts, c.name, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestUntarSelected(t *testing.T) {
+	dest := t.TempDir()
+	buf := buildTar(t, []tarEntry{
+		{name: "backup/", typeflag: tar.TypeDir},
+		{name: "backup/etc/", typeflag: tar.TypeDir},
+		{name: "backup/etc/app.conf", typeflag: tar.TypeReg, body: "config"},
+		{name: "backup/etc/hosts", typeflag: tar.TypeReg, body: "hosts"},
+		{name: "backup/etc/app.link", typeflag: tar.TypeLink, linkname: "backup/etc/app.conf"},
+		{name: "backup/var/data", typeflag: tar.TypeReg, body: "data"},
+	})
+	opts := ExtractOptions{
+		Members:         []string{"backup/etc"},
+		Exclude:         []string{"hosts"},
+		StripComponents: 1,
+		Remap:           map[string]string{"etc": "restored"},
+	}
+	if err := Untar(buf, dest, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dest, "restored/app.conf")); got != "config" {
+		t.Errorf("app.conf = %q", got)
+	}
+	if got := readFile(t, filepath.Join(dest, "restored/app.link")); got != "config" {
+		t.Errorf("app.link = %q", got)
+	}
+	for _, skipped := range []string{"restored/hosts", "var", "etc", "backup"} {
+		if _, err := os.Lstat(filepath.Join(dest, skipped)); err == nil {
+			t.Errorf("%s should not have been extracted", skipped)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// An archive signature is an Ed25519 signature over the SHA-512 digest of
+// the archive bytes. It is stored in a fixed-size block of public key,
+// signature and magic, either appended to the archive or in a detached file.
+
+var signatureMagic = []byte("TSIG")
+
+const (
+	signatureBlockSize = ed25519.PublicKeySize + ed25519.SignatureSize + 4
+
+	signerPrefix     = "tartarus-ed25519:"
+	signingKeyPrefix = "TARTARUS-ED25519-SECRET:"
+
+	// signatureContext separates archive signatures from anything else
+	// signed with the same key.
+	signatureContext = "tartarus archive signature v1\x00"
+)
+
+var (
+	// ErrUnsigned is returned when verification is requested for an archive
+	// that carries no signature.
+	ErrUnsigned = errors.New("archive is not signed")
+	// ErrBadSignature is returned when the signature does not match the data.
+	ErrBadSignature = errors.New("archive signature is invalid")
+	// ErrUntrustedSigner is returned when a valid signature was made by a key
+	// outside the trusted set.
+	ErrUntrustedSigner = errors.New("archive is signed by an untrusted key")
+)
+
+// SignatureInfo identifies who signed an archive.
+type SignatureInfo struct {
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Embedded  bool   `json:"embedded"`
+}
+
+// GenerateSigningKey creates a new Ed25519 signing key.
+func GenerateSigningKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// EncodeSigningKey formats a signing key for storage.
+func EncodeSigningKey(key ed25519.PrivateKey) string {
+	return signingKeyPrefix + base64.RawURLEncoding.EncodeToString(key.Seed())
+}
+
+// EncodeSignerKey formats a public verification key.
+func EncodeSignerKey(key ed25519.PublicKey) string {
+	return signerPrefix + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// ParseSigningKey parses a key produced by EncodeSigningKey.
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), signingKeyPrefix)
+	if !ok {
+		return nil, fmt.Errorf("signing key must start with %q", signingKeyPrefix)
+	}
+	seed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid signing key length")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseSignerKey parses a key produced by EncodeSignerKey.
+func ParseSignerKey(s string) (ed25519.PublicKey, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(s), signerPrefix)
+	if !ok {
+		return nil, fmt.Errorf("public key must start with %q", signerPrefix)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key length")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// KeyID returns a short fingerprint of a verification key.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func signatureMessage(digest []byte) []byte {
+	return append([]byte(signatureContext), digest...)
+}
+
+// SignWriter returns a WriteCloser that passes data through to w and signs
+// it on Close. The signature block is appended to w, or written to detached
+// when that is non-nil.
+func SignWriter(w io.Writer, key ed25519.PrivateKey, detached io.Writer) io.WriteCloser {
+	return &signingWriter{dst: w, detached: detached, key: key, digest: sha512.New()}
+}
+
+type signingWriter struct {
+	dst      io.Writer
+	detached io.Writer
+	key      ed25519.PrivateKey
+	digest   hash.Hash
+}
+
+func (w *signingWriter) Write(p []byte) (int, error) {
+	n, err := w.dst.Write(p)
+	w.digest.Write(p[:n])
+	return n, err
+}
+
+func (w *signingWriter) Close() error {
+	sig := ed25519.Sign(w.key, signatureMessage(w.digest.Sum(nil)))
+	block := make([]byte, 0, signatureBlockSize)
+	block = append(block, w.key.Public().(ed25519.PublicKey)...)
+	block = append(block, sig...)
+	block = append(block, signatureMagic...)
+
+	dst := w.dst
+	if w.detached != nil {
+		dst = w.detached
+	}
+	_, err := dst.Write(block)
+	return err
+}
+
+// isSignatureBlock reports whether b looks like a signature block.
+func isSignatureBlock(b []byte) bool {
+	return len(b) == signatureBlockSize && bytes.HasSuffix(b, signatureMagic)
+}
+
+// checkSignature verifies block against digest and the trusted keys.
+func checkSignature(block, digest []byte, trusted []ed25519.PublicKey, embedded bool) (*SignatureInfo, error) {
+	if !isSignatureBlock(block) {
+		return nil, ErrUnsigned
+	}
+	pub := ed25519.PublicKey(block[:ed25519.PublicKeySize])
+	sig := block[ed25519.PublicKeySize : ed25519.PublicKeySize+ed25519.SignatureSize]
+	if !ed25519.Verify(pub, signatureMessage(digest), sig) {
+		return nil, ErrBadSignature
+	}
+	info := &SignatureInfo{KeyID: KeyID(pub), PublicKey: EncodeSignerKey(pub), Embedded: embedded}
+	for _, key := range trusted {
+		if key.Equal(pub) {
+			return info, nil
+		}
+	}
+	return info, ErrUntrustedSigner
+}
+
+// VerifyArchive checks the signature of the archive in r against the trusted
+// keys. With a detached signature block the whole of r is the archive;
+// otherwise the signature is expected at its end. On success r is left
+// positioned at the start of the archive and the returned reader yields the
+// archive bytes without any embedded signature.
+func VerifyArchive(r io.ReadSeeker, detached []byte, trusted []ed25519.PublicKey) (io.Reader, *SignatureInfo, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ra, ok := r.(io.ReaderAt); ok {
+		end = dataEnd(ra, start, end)
+	}
+
+	size := end - start
+	block := detached
+	if block == nil {
+		if size < signatureBlockSize {
+			return nil, nil, ErrUnsigned
+		}
+		size -= signatureBlockSize
+		block = make([]byte, signatureBlockSize)
+		if _, err := r.Seek(start+size, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	digest := sha512.New()
+	if _, err := io.CopyN(digest, r, size); err != nil {
+		return nil, nil, err
+	}
+	info, err := checkSignature(block, digest.Sum(nil), trusted, detached == nil)
+	if err != nil {
+		return nil, info, err
+	}
+
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	return io.LimitReader(r, size), info, nil
+}
+
+// stripSignature returns a reader over r without a trailing signature block
+// or inline parity; the signature itself is not checked. Files are trimmed with a section
+// reader so they stay seekable, other streams hold back the last block-sized
+// window until EOF.
+func stripSignature(r io.Reader) (io.Reader, error) {
+	if f, ok := r.(interface {
+		io.ReadSeeker
+		io.ReaderAt
+	}); ok {
+		start, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		end, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		end = dataEnd(f, start, end)
+		size := end - start
+		if size >= signatureBlockSize {
+			block := make([]byte, signatureBlockSize)
+			if _, err := f.ReadAt(block, end-signatureBlockSize); err != nil {
+				return nil, err
+			}
+			if isSignatureBlock(block) {
+				size -= signatureBlockSize
+			}
+		}
+		return io.NewSectionReader(f, start, size), nil
+	}
+	return &trailerReader{src: r, buf: make([]byte, bufferSize+signatureBlockSize)}, nil
+}
+
+type trailerReader struct {
+	src  io.Reader
+	buf  []byte
+	tail []byte
+	eof  bool
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if r.eof {
+		if len(r.tail) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, r.tail)
+		r.tail = r.tail[n:]
+		return n, nil
+	}
+	if len(p) > bufferSize {
+		p = p[:bufferSize]
+	}
+	for {
+		copy(r.buf, r.tail)
+		n, err := r.src.Read(r.buf[len(r.tail) : len(r.tail)+len(p)])
+		data := r.buf[:len(r.tail)+n]
+
+		out := 0
+		if len(data) > signatureBlockSize {
+			out = len(data) - signatureBlockSize
+			copy(p, data[:out])
+		}
+		r.tail = append(r.tail[:0], data[out:]...)
+
+		if err == io.EOF {
+			r.eof = true
+			if isSignatureBlock(r.tail) {
+				r.tail = nil
+			}
+			if out > 0 {
+				return out, nil
+			}
+			return r.Read(p)
+		}
+		if err != nil || out > 0 {
+			return out, err
+		}
+	}
+}
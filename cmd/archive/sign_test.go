@@ -0,0 +1,73 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignedArchive(t *testing.T) {
+	inputDir := t.TempDir()
+	createTestFiles(t, inputDir, map[string]string{"signed.txt": "trust me"})
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	other, _ := GenerateSigningKey()
+	pass := []byte("sign-pass")
+
+	var embedded bytes.Buffer
+	if err := Archive(inputDir, &embedded, ArchiveOptions{Passphrase: pass, SigningKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	var detached, sig bytes.Buffer
+	if err := Archive(inputDir, &detached, ArchiveOptions{Passphrase: pass, SigningKey: key, DetachedSignature: &sig}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, info, err := VerifyArchive(bytes.NewReader(embedded.Bytes()), nil, []ed25519.PublicKey{pub})
+	if err != nil {
+		t.Fatalf("embedded: %v", err)
+	}
+	if info.KeyID != KeyID(pub) || !info.Embedded {
+		t.Errorf("unexpected signer info: %+v", info)
+	}
+	if _, _, err := VerifyArchive(bytes.NewReader(detached.Bytes()), sig.Bytes(), []ed25519.PublicKey{pub}); err != nil {
+		t.Fatalf("detached: %v", err)
+	}
+
+	untrusted := []ed25519.PublicKey{other.Public().(ed25519.PublicKey)}
+	if _, _, err := VerifyArchive(bytes.NewReader(embedded.Bytes()), nil, untrusted); !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("untrusted key: got %v, want ErrUntrustedSigner", err)
+	}
+	tampered := append([]byte{}, embedded.Bytes()...)
+	tampered[100] ^= 1
+	if _, _, err := VerifyArchive(bytes.NewReader(tampered), nil, []ed25519.PublicKey{pub}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered archive: got %v, want ErrBadSignature", err)
+	}
+	if _, _, err := VerifyArchive(bytes.NewReader(detached.Bytes()), nil, []ed25519.PublicKey{pub}); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("missing signature: got %v, want ErrUnsigned", err)
+	}
+
+	// Verified restore from a seekable input.
+	out := t.TempDir()
+	opts := RestoreOptions{Keys: Keys{Passphrase: pass}, TrustedKeys: []ed25519.PublicKey{pub}}
+	if err := Restore(bytes.NewReader(embedded.Bytes()), out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(out, "signed.txt")); got != "trust me" {
+		t.Errorf("signed.txt = %q", got)
+	}
+
+	// Unverified restore from a plain stream skips the embedded signature.
+	out = t.TempDir()
+	if err := DecryptDecompressExtract(&embedded, out, pass); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(out, "signed.txt")); got != "trust me" {
+		t.Errorf("signed.txt = %q", got)
+	}
+}
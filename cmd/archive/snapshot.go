@@ -0,0 +1,452 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot archives start with a manifest describing the whole source tree
+// at the time of the run. With a base manifest only the entries that differ
+// from it are stored, together with the paths deleted since. Passing the
+// manifest of the last full backup gives a differential archive, passing the
+// previous run's manifest an incremental one; RestoreChain replays either.
+//
+// The manifest has the content hashes of the files stored, so they are
+// hashed ahead of the data and hashed again as they are written; a file
+// that changed in between fails the run with ErrFileChanged.
+
+const (
+	// manifestMember is the name of the manifest, always the first member
+	// of a snapshot archive.
+	manifestMember = ".tartarus-manifest.json"
+
+	// snapshotRecord is a PAX record marking the manifest, so that files of
+	// the same name are not taken for it.
+	snapshotRecord = "TARTARUS.snapshot"
+)
+
+// maxManifestSize bounds the manifest read from an archive.
+const maxManifestSize = 1 << 30
+
+var (
+	// ErrNoManifest is returned for archives made without a snapshot
+	// manifest.
+	ErrNoManifest = errors.New("archive has no snapshot manifest")
+	// ErrBrokenChain is returned when archives are not a full snapshot
+	// followed by snapshots based on earlier ones.
+	ErrBrokenChain = errors.New("archives do not form a snapshot chain")
+	// ErrInconsistentRestore is returned when a restored tree does not match
+	// the manifest of the last snapshot.
+	ErrInconsistentRestore = errors.New("restored tree does not match the snapshot manifest")
+	// ErrFileChanged is returned when a file differs from its manifest
+	// entry by the time it is stored.
+	ErrFileChanged = errors.New("file changed while it was archived")
+)
+
+// ManifestEntry records the state of one path in a snapshot.
+type ManifestEntry struct {
+	Type    string      `json:"type"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Inode   uint64      `json:"inode,omitempty"`
+	SHA256  string      `json:"sha256,omitempty"`
+	Link    string      `json:"link,omitempty"`
+}
+
+// sameAs reports whether nothing but possibly the content hash differs.
+func (e ManifestEntry) sameAs(o ManifestEntry) bool {
+	return e.Type == o.Type && e.Size == o.Size && e.Mode == o.Mode &&
+		e.ModTime.Equal(o.ModTime) && e.Inode == o.Inode && e.Link == o.Link
+}
+
+// Manifest describes a source tree at the time of a snapshot.
+type Manifest struct {
+	ID      string                   `json:"id"`
+	BaseID  string                   `json:"base_id,omitempty"`
+	Created time.Time                `json:"created"`
+	Entries map[string]ManifestEntry `json:"entries"`
+	// Deleted lists the paths of the base manifest that are gone.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// Full reports whether the snapshot holds the whole tree.
+func (m *Manifest) Full() bool {
+	return m.BaseID == ""
+}
+
+// snapshotSink is where a snapshot is written: a tar stream that can hash
+// files as it stores them, and take the manifest, which does not come from
+// the tree.
+type snapshotSink interface {
+	entryWriter
+	writeFile(hdr *tar.Header, path string, digest io.Writer) error
+	writeBody(hdr *tar.Header, body io.Reader) error
+}
+
+type walkedEntry struct {
+	hdr  *tar.Header
+	path string
+}
+
+// entryCollector records the walked tree so that the manifest can be
+// written ahead of the data.
+type entryCollector struct {
+	entries []walkedEntry
+}
+
+func (c *entryCollector) writeEntry(hdr *tar.Header, path string) error {
+	c.entries = append(c.entries, walkedEntry{hdr: hdr, path: path})
+	return nil
+}
+
+func (o ArchiveOptions) snapshot() bool {
+	return o.Snapshot || o.Base != nil
+}
+
+// walkInto writes the tree below inputDir to sink, as a snapshot when the
+// options ask for one.
+func (o ArchiveOptions) walkInto(inputDir string, sink snapshotSink) error {
+	if !o.snapshot() {
+		return newTreeWalker(sink, o.Tar).run(inputDir)
+	}
+
+	if f := o.Tar.Dialect; f == tar.FormatUSTAR || f == tar.FormatGNU {
+		return fmt.Errorf("%w: snapshot manifests need the PAX format", ErrUnrepresentable)
+	}
+	var c entryCollector
+	if err := newTreeWalker(&c, o.Tar).run(inputDir); err != nil {
+		return err
+	}
+	m, changed, err := buildManifest(c.entries, o.Base)
+	if err != nil {
+		return err
+	}
+	if err := writeJSONMember(sink, manifestMember, m, m.Created); err != nil {
+		return err
+	}
+	for i, e := range c.entries {
+		if !changed[i] {
+			continue
+		}
+		if e.hdr.Typeflag != tar.TypeReg {
+			if err := sink.writeEntry(e.hdr, e.path); err != nil {
+				return err
+			}
+			continue
+		}
+		h := sha256.New()
+		if err := sink.writeFile(e.hdr, e.path, h); err != nil {
+			return err
+		}
+		name := memberPath(e.hdr.Name)
+		if hex.EncodeToString(h.Sum(nil)) != m.Entries[name].SHA256 {
+			return fmt.Errorf("%w: %s", ErrFileChanged, name)
+		}
+	}
+	return nil
+}
+
+// writeJSONMember stores v, encoded as JSON, as the member name.
+func writeJSONMember(sink snapshotSink, name string, v any, modTime time.Time) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     int64(len(encoded)),
+		ModTime:  modTime,
+		PAXRecords: map[string]string{
+			snapshotRecord: name,
+		},
+	}
+	return sink.writeBody(hdr, bytes.NewReader(encoded))
+}
+
+// isManifest reports whether hdr is the manifest as walkInto writes it,
+// rather than a file from the tree.
+func isManifest(hdr *tar.Header) bool {
+	return hdr.Name == manifestMember && hdr.PAXRecords[snapshotRecord] == manifestMember
+}
+
+// buildManifest describes the walked entries and marks those that have to
+// be stored. Directories are always stored, as are hardlinks whose target
+// is, and files without a hash to carry over. Unchanged files keep the hash
+// of the base; the others are hashed.
+func buildManifest(entries []walkedEntry, base *Manifest) (*Manifest, []bool, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	m := &Manifest{
+		ID:      hex.EncodeToString(id),
+		Created: time.Now().UTC(),
+		Entries: make(map[string]ManifestEntry, len(entries)),
+	}
+	if base != nil {
+		m.BaseID = base.ID
+	}
+
+	changed := make([]bool, len(entries))
+	stored := make(map[string]bool)
+	for i, e := range entries {
+		name := memberPath(e.hdr.Name)
+		entry := ManifestEntry{
+			Type:    newMember(e.hdr).Type,
+			Size:    e.hdr.Size,
+			Mode:    e.hdr.FileInfo().Mode(),
+			ModTime: e.hdr.ModTime,
+			Link:    e.hdr.Linkname,
+		}
+		if e.hdr.Typeflag == tar.TypeReg {
+			info, err := os.Stat(e.path)
+			if err != nil {
+				return nil, nil, err
+			}
+			entry.Inode = inode(info)
+		}
+
+		var prev ManifestEntry
+		var had bool
+		if base != nil {
+			prev, had = base.Entries[name]
+		}
+		changed[i] = !had || !prev.sameAs(entry) || e.hdr.Typeflag == tar.TypeDir ||
+			(e.hdr.Typeflag == tar.TypeReg && prev.SHA256 == "") ||
+			(e.hdr.Typeflag == tar.TypeLink && stored[memberPath(e.hdr.Linkname)])
+
+		if e.hdr.Typeflag == tar.TypeReg {
+			if !changed[i] {
+				entry.SHA256 = prev.SHA256
+			} else {
+				sum, err := hashFile(e.path)
+				if err != nil {
+					return nil, nil, err
+				}
+				entry.SHA256 = sum
+			}
+		}
+		if changed[i] {
+			stored[name] = true
+		}
+		m.Entries[name] = entry
+	}
+
+	if base != nil {
+		for name := range base.Entries {
+			if _, ok := m.Entries[name]; !ok {
+				m.Deleted = append(m.Deleted, name)
+			}
+		}
+		sort.Strings(m.Deleted)
+	}
+	return m, changed, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// openSnapshot opens an archive of any supported layout and reads its
+// manifest, leaving the tar reader at the first data member.
+func openSnapshot(input io.Reader, keys Keys) (*Opened, *tarReader, *Manifest, error) {
+	o, err := Open(input, keys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var stream io.Reader = o
+	switch o.Format() {
+	case FormatTar:
+	case FormatIndexed:
+		ir, cleanup, err := o.indexed("")
+		if err != nil {
+			o.Close()
+			return nil, nil, nil, err
+		}
+		o.closers = append(o.closers, closerFunc(cleanup))
+		stream = ir.tarStream()
+	default:
+		o.Close()
+		return nil, nil, nil, ErrNoManifest
+	}
+
+	tr := newTarReader(stream)
+	hdr, err := tr.Next()
+	if (err == nil && !isManifest(hdr)) || err == io.EOF {
+		err = ErrNoManifest
+	}
+	if err != nil {
+		o.Close()
+		return nil, nil, nil, err
+	}
+	m := new(Manifest)
+	if err := json.NewDecoder(io.LimitReader(tr, maxManifestSize)).Decode(m); err != nil {
+		o.Close()
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrNoManifest, err)
+	}
+	return o, tr, m, nil
+}
+
+// closerFunc adapts a cleanup function to io.Closer.
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+// ReadManifest returns the manifest of a snapshot archive, reading only as
+// far as the manifest itself. It is the base for the next incremental or
+// differential run.
+func ReadManifest(input io.Reader, keys Keys) (*Manifest, error) {
+	o, _, m, err := openSnapshot(input, keys)
+	if err != nil {
+		return nil, err
+	}
+	o.Close()
+	return m, nil
+}
+
+// RestoreChain replays a full snapshot archive and the incrementals or
+// differentials made after it, in the order they were taken, into destDir.
+// Paths deleted between snapshots are removed, and at the end the tree is
+// checked against the last manifest: every path it lists must exist with
+// its recorded content, and restored paths it does not list are removed.
+func RestoreChain(inputs []io.Reader, destDir string, keys Keys, opts ExtractOptions) error {
+	seen := make(map[string]bool)
+	restored := make(map[string]bool)
+	var last *Manifest
+
+	for i, input := range inputs {
+		o, tr, m, err := openSnapshot(input, keys)
+		if err != nil {
+			return fmt.Errorf("archive %d: %w", i+1, err)
+		}
+		if (i == 0) != m.Full() || (i > 0 && !seen[m.BaseID]) {
+			o.Close()
+			return fmt.Errorf("%w: archive %d has base %q", ErrBrokenChain, i+1, m.BaseID)
+		}
+		seen[m.ID] = true
+		last = m
+
+		err = restoreSnapshot(o, tr, m, destDir, opts, restored, i == len(inputs)-1)
+		o.Close()
+		if err != nil {
+			return fmt.Errorf("archive %d: %w", i+1, err)
+		}
+	}
+	if last == nil {
+		return fmt.Errorf("%w: no archives", ErrBrokenChain)
+	}
+	return verifyManifest(last, destDir, opts)
+}
+
+// restoreSnapshot extracts the members of one snapshot and applies its
+// deletions. After the last snapshot everything restored earlier that its
+// manifest no longer lists is removed, which differential chains need.
+func restoreSnapshot(o *Opened, tr *tarReader, m *Manifest, destDir string, opts ExtractOptions, restored map[string]bool, last bool) error {
+	x, err := newExtractor(destDir, opts)
+	if err != nil {
+		return err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		restored[memberPath(hdr.Name)] = true
+		if err := x.extract(hdr, tr); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range m.Deleted {
+		if err := x.remove(name); err != nil {
+			return err
+		}
+	}
+	if last {
+		for name := range restored {
+			if _, ok := m.Entries[name]; !ok {
+				if err := x.remove(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := x.finish(); err != nil {
+		return err
+	}
+	return o.verify()
+}
+
+// remove deletes a member path and everything below it.
+func (x *extractor) remove(name string) error {
+	name, ok := x.opts.targetName(name)
+	if !ok {
+		return nil
+	}
+	target, err := resolveInRoot(x.root, name, false)
+	if errors.Is(err, ErrPathEscapes) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(target)
+}
+
+// verifyManifest checks the restored regular files against their recorded
+// hashes.
+func verifyManifest(m *Manifest, destDir string, opts ExtractOptions) error {
+	root, err := extractRoot(destDir)
+	if err != nil {
+		return err
+	}
+	var bad []string
+	for name, e := range m.Entries {
+		target, ok := opts.targetName(name)
+		if !ok || e.SHA256 == "" {
+			continue
+		}
+		path, err := resolveInRoot(root, target, true)
+		if err != nil {
+			bad = append(bad, name)
+			continue
+		}
+		if sum, err := hashFile(path); err != nil || sum != e.SHA256 {
+			bad = append(bad, name)
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("%w: %s", ErrInconsistentRestore, strings.Join(bad, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func snapshotArchive(t *testing.T, dir string, pass []byte, base *Manifest) ([]byte, *Manifest) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Archive(dir, &buf, ArchiveOptions{Snapshot: true, Base: base, Passphrase: pass}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadManifest(bytes.NewReader(buf.Bytes()), Keys{Passphrase: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), m
+}
+
+func storedFiles(t *testing.T, data, pass []byte) []string {
+	t.Helper()
+	members, err := List(bytes.NewReader(data), Keys{Passphrase: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range members {
+		if m.Type == "file" && m.Name != manifestMember {
+			names = append(names, m.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestIncrementalChain(t *testing.T) {
+	src := t.TempDir()
+	pass := []byte("snapshots")
+	createTestFiles(t, src, map[string]string{
+		"a.txt":     "original",
+		"b.txt":     "to be deleted",
+		"sub/c.txt": "unchanged",
+	})
+	full, m0 := snapshotArchive(t, src, pass, nil)
+	if !m0.Full() || len(m0.Entries) != 4 {
+		t.Fatalf("full manifest = %+v", m0)
+	}
+
+	later := time.Now().Add(time.Hour)
+	os.WriteFile(filepath.Join(src, "a.txt"), []byte("modified"), 0644)
+	os.Chtimes(filepath.Join(src, "a.txt"), later, later)
+	os.Remove(filepath.Join(src, "b.txt"))
+	createTestFiles(t, src, map[string]string{"d.txt": "added"})
+	inc1, m1 := snapshotArchive(t, src, pass, m0)
+	if got := storedFiles(t, inc1, pass); len(got) != 2 || got[0] != "a.txt" || got[1] != "d.txt" {
+		t.Errorf("incremental stored %v", got)
+	}
+	if len(m1.Deleted) != 1 || m1.Deleted[0] != "b.txt" || m1.BaseID != m0.ID {
+		t.Errorf("incremental manifest = %+v", m1)
+	}
+
+	os.Remove(filepath.Join(src, "d.txt"))
+	inc2, _ := snapshotArchive(t, src, pass, m1)
+
+	dest := t.TempDir()
+	inputs := []io.Reader{bytes.NewReader(full), bytes.NewReader(inc1), bytes.NewReader(inc2)}
+	if err := RestoreChain(inputs, dest, Keys{Passphrase: pass}, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dest, "a.txt")); got != "modified" {
+		t.Errorf("a.txt = %q", got)
+	}
+	if got := readFile(t, filepath.Join(dest, "sub/c.txt")); got != "unchanged" {
+		t.Errorf("c.txt = %q", got)
+	}
+	for _, gone := range []string{"b.txt", "d.txt", manifestMember} {
+		if _, err := os.Lstat(filepath.Join(dest, gone)); err == nil {
+			t.Errorf("%s should not exist", gone)
+		}
+	}
+
+	err := RestoreChain([]io.Reader{bytes.NewReader(inc1)}, t.TempDir(), Keys{Passphrase: pass}, ExtractOptions{})
+	if !errors.Is(err, ErrBrokenChain) {
+		t.Errorf("chain without full backup: got %v", err)
+	}
+}
+
+func TestDifferentialChain(t *testing.T) {
+	src := t.TempDir()
+	pass := []byte("snapshots")
+	createTestFiles(t, src, map[string]string{"keep.txt": "kept"})
+	full, m0 := snapshotArchive(t, src, pass, nil)
+
+	createTestFiles(t, src, map[string]string{"temp.txt": "short lived"})
+	diff1, _ := snapshotArchive(t, src, pass, m0)
+	os.Remove(filepath.Join(src, "temp.txt"))
+	diff2, m2 := snapshotArchive(t, src, pass, m0)
+	if len(m2.Deleted) != 0 {
+		t.Errorf("differential against full should not record deletions: %v", m2.Deleted)
+	}
+
+	dest := t.TempDir()
+	inputs := []io.Reader{bytes.NewReader(full), bytes.NewReader(diff1), bytes.NewReader(diff2)}
+	if err := RestoreChain(inputs, dest, Keys{Passphrase: pass}, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "temp.txt")); err == nil {
+		t.Error("temp.txt should have been removed")
+	}
+	if got := readFile(t, filepath.Join(dest, "keep.txt")); got != "kept" {
+		t.Errorf("keep.txt = %q", got)
+	}
+}
+
+func TestReadManifestRequiresSnapshot(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{"f.txt": "x"})
+	var buf bytes.Buffer
+	if err := Archive(src, &buf, ArchiveOptions{Passphrase: []byte("p")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadManifest(&buf, Keys{Passphrase: []byte("p")}); !errors.Is(err, ErrNoManifest) {
+		t.Errorf("got %v, want ErrNoManifest", err)
+	}
+}
+
+// rewritingSink changes each file on disk just before it is stored, as if
+// it were modified between the walk and the copy.
+type rewritingSink struct {
+	tarEntryWriter
+}
+
+func (s rewritingSink) writeFile(hdr *tar.Header, path string, digest io.Writer) error {
+	if err := os.WriteFile(path, bytes.ToUpper(mustRead(path)), 0644); err != nil {
+		return err
+	}
+	return s.tarEntryWriter.writeFile(hdr, path, digest)
+}
+
+func mustRead(path string) []byte {
+	data, _ := os.ReadFile(path)
+	return data
+}
+
+func TestSnapshotRejectsChangedFiles(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{"a.txt": "lower", "sub/b.txt": "case"})
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	err := (ArchiveOptions{Snapshot: true}).walkInto(src, rewritingSink{tarEntryWriter{tw, &buf, false}})
+	if !errors.Is(err, ErrFileChanged) {
+		t.Errorf("file rewritten before it was stored: got %v, want ErrFileChanged", err)
+	}
+}
+
+// countingReader counts what is read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestReadManifestReadsOnlyTheManifest(t *testing.T) {
+	src := t.TempDir()
+	big := make([]byte, 4<<20)
+	rand.Read(big)
+	createTestFiles(t, src, map[string]string{"big.bin": string(big)})
+	pass := []byte("snapshots")
+	data, _ := snapshotArchive(t, src, pass, nil)
+
+	r := &countingReader{r: bytes.NewReader(data)}
+	m, err := ReadManifest(r, Keys{Passphrase: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Entries["big.bin"].SHA256, hashBytes(big); got != want {
+		t.Errorf("big.bin hash = %s, want %s", got, want)
+	}
+	if r.n > int64(len(data))/4 {
+		t.Errorf("read %d of %d bytes for the manifest", r.n, len(data))
+	}
+}
+
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSnapshotOfManifestName(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{manifestMember: "mine", "sub/" + manifestMember: "nested"})
+	pass := []byte("snapshots")
+	data, m := snapshotArchive(t, src, pass, nil)
+	if _, ok := m.Entries[manifestMember]; !ok {
+		t.Errorf("manifest does not list %s", manifestMember)
+	}
+
+	dest := t.TempDir()
+	if err := RestoreChain([]io.Reader{bytes.NewReader(data)}, dest, Keys{Passphrase: pass}, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dest, manifestMember)); got != "mine" {
+		t.Errorf("%s = %q", manifestMember, got)
+	}
+
+	// Outside snapshots the name is an ordinary file too.
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dest = t.TempDir()
+	if err := Untar(&buf, dest, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dest, manifestMember)); got != "mine" {
+		t.Errorf("%s = %q", manifestMember, got)
+	}
+}
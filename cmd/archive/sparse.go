@@ -0,0 +1,303 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// sparseRegion is a range of a sparse file that holds data.
+type sparseRegion struct {
+	Offset, Length int64
+}
+
+// sparseBlockSize is the granularity at which extraction leaves holes.
+const sparseBlockSize = 4096
+
+// canWriteSparse reports whether sparse entries suit the format. They are
+// written in the GNU PAX 1.0 layout, which USTAR and GNU archives cannot
+// carry.
+func canWriteSparse(f tar.Format) bool {
+	return f == tar.FormatUnknown || f == tar.FormatPAX
+}
+
+// writeSparse stores a file with holes as a GNU PAX 1.0 sparse entry: a PAX
+// header naming the file and its real size, then a member whose data is the
+// map of data regions followed by the regions themselves. archive/tar reads
+// these but cannot write them, so the entry is written here, straight to
+// the stream under tw. digest, when set, receives the whole file with its
+// holes as zeros.
+func (t tarEntryWriter) writeSparse(hdr *tar.Header, f *os.File, regions []sparseRegion, digest io.Writer) error {
+	sparseMap := encodeSparseMap(regions, hdr.Size)
+	stored := int64(len(sparseMap))
+	for _, r := range regions {
+		stored += r.Length
+	}
+
+	// What the USTAR member header cannot hold goes in the PAX records.
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+	}
+	for k, v := range hdr.PAXRecords {
+		records[k] = v
+	}
+	member := tar.Header{
+		Name:    sparsePlaceholder(hdr.Name),
+		Mode:    hdr.Mode,
+		Uid:     hdr.Uid,
+		Gid:     hdr.Gid,
+		Uname:   hdr.Uname,
+		Gname:   hdr.Gname,
+		ModTime: hdr.ModTime,
+	}
+	if stored > ustarMaxSize {
+		records["size"] = strconv.FormatInt(stored, 10)
+	}
+	if sec := hdr.ModTime.Unix(); sec < 0 || sec > ustarMaxTime {
+		records["mtime"], member.ModTime = formatPAXTime(hdr.ModTime), time.Unix(0, 0)
+	} else if hdr.ModTime.Nanosecond() != 0 {
+		records["mtime"] = formatPAXTime(hdr.ModTime)
+	}
+	if hdr.Uid > ustarMaxID || hdr.Uid < 0 {
+		records["uid"], member.Uid = strconv.Itoa(hdr.Uid), 0
+	}
+	if hdr.Gid > ustarMaxID || hdr.Gid < 0 {
+		records["gid"], member.Gid = strconv.Itoa(hdr.Gid), 0
+	}
+	if !isASCII(hdr.Uname) || len(hdr.Uname) > ustarOwnerSize {
+		records["uname"], member.Uname = hdr.Uname, ""
+	}
+	if !isASCII(hdr.Gname) || len(hdr.Gname) > ustarOwnerSize {
+		records["gname"], member.Gname = hdr.Gname, ""
+	}
+
+	if err := t.tw.Flush(); err != nil {
+		return err
+	}
+	paxHdr, err := rawPAXHeader(path.Join(path.Dir(member.Name), "PaxHeaders", path.Base(member.Name)), records)
+	if err != nil {
+		return err
+	}
+	memberHdr, err := rawHeader(member, tar.TypeReg, stored)
+	if err != nil {
+		return err
+	}
+	for _, b := range [][]byte{paxHdr, memberHdr, sparseMap} {
+		if _, err := t.raw.Write(b); err != nil {
+			return err
+		}
+	}
+	var pos int64
+	for _, r := range regions {
+		var body io.Reader = io.NewSectionReader(f, r.Offset, r.Length)
+		if digest != nil {
+			if _, err := io.CopyN(digest, zeros{}, r.Offset-pos); err != nil {
+				return err
+			}
+			body = io.TeeReader(body, digest)
+			pos = r.Offset + r.Length
+		}
+		if _, err := io.CopyN(t.raw, body, r.Length); err != nil {
+			return err
+		}
+	}
+	if pad := stored % tarBlockSize; pad != 0 {
+		if _, err := t.raw.Write(make([]byte, tarBlockSize-pad)); err != nil {
+			return err
+		}
+	}
+	if digest != nil {
+		_, err := io.CopyN(digest, zeros{}, hdr.Size-pos)
+		return err
+	}
+	return nil
+}
+
+// zeros reads as an endless run of zero bytes, the content of holes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// sparsePlaceholder is the member name GNU tar uses for sparse files, kept
+// to ASCII within the USTAR name field; readers that know the format use
+// the name in the PAX header instead.
+func sparsePlaceholder(name string) string {
+	base := []byte(path.Base(name))
+	for i, c := range base {
+		if c >= utf8.RuneSelf || c == 0 {
+			base[i] = '_'
+		}
+	}
+	if len(base) > 80 {
+		base = base[:80]
+	}
+	return "GNUSparseFile.0/" + string(base)
+}
+
+// encodeSparseMap writes the map of a GNU 1.0 sparse entry: the number of
+// regions, then the offset and length of each, as decimal lines padded to
+// a whole block. Like GNU tar, a file ending in a hole gets an empty
+// region at its end.
+func encodeSparseMap(regions []sparseRegion, size int64) []byte {
+	if n := len(regions); n == 0 || regions[n-1].Offset+regions[n-1].Length < size {
+		regions = append(regions[:n:n], sparseRegion{Offset: size})
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d\n", len(regions))
+	for _, r := range regions {
+		fmt.Fprintf(&b, "%d\n%d\n", r.Offset, r.Length)
+	}
+	if pad := b.Len() % tarBlockSize; pad != 0 {
+		b.Write(make([]byte, tarBlockSize-pad))
+	}
+	return b.Bytes()
+}
+
+// rawPAXHeader encodes a PAX extended header with the records, sorted so
+// the output is reproducible, and its padding.
+func rawPAXHeader(name string, records map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var body bytes.Buffer
+	for _, k := range keys {
+		body.WriteString(paxRecord(k, records[k]))
+	}
+	b, err := rawHeader(tar.Header{Name: name[:min(len(name), ustarNameSize)], Mode: 0644}, tar.TypeXHeader, int64(body.Len()))
+	if err != nil {
+		return nil, err
+	}
+	if pad := body.Len() % tarBlockSize; pad != 0 {
+		body.Write(make([]byte, tarBlockSize-pad))
+	}
+	return append(b, body.Bytes()...), nil
+}
+
+// rawHeader lays out hdr as a USTAR header block of the given type and data
+// size, which archive/tar refuses to write itself. A size too large for the
+// field is left as zero, for a PAX "size" record to give.
+func rawHeader(hdr tar.Header, typeflag byte, size int64) ([]byte, error) {
+	hdr.Typeflag, hdr.Size, hdr.Format = tar.TypeReg, 0, tar.FormatUSTAR
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return nil, err
+	}
+	if err := tw.Flush(); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()[:tarBlockSize]
+	b[156] = typeflag
+	if size <= ustarMaxSize {
+		copy(b[124:136], fmt.Sprintf("%011o\x00", size))
+	}
+	copy(b[148:156], "        ")
+	var sum int64
+	for _, c := range b {
+		sum += int64(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return b, nil
+}
+
+// paxRecord formats one record, whose length prefix counts itself.
+func paxRecord(k, v string) string {
+	size := len(k) + len(v) + 3 // ' ', '=' and '\n'
+	size += len(strconv.Itoa(size))
+	record := strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	if len(record) != size {
+		size = len(record)
+		record = strconv.Itoa(size) + " " + k + "=" + v + "\n"
+	}
+	return record
+}
+
+// formatPAXTime is the inverse of parsePAXTime.
+func formatPAXTime(t time.Time) string {
+	sec, nsec := t.Unix(), t.Nanosecond()
+	if nsec == 0 {
+		return strconv.FormatInt(sec, 10)
+	}
+	sign := ""
+	if sec < 0 {
+		sign, sec, nsec = "-", -(sec + 1), 1e9-nsec
+	}
+	return sign + strconv.FormatInt(sec, 10) + "." + strings.TrimRight(fmt.Sprintf("%09d", nsec), "0")
+}
+
+// isSparse reports whether a member read by archive/tar was stored sparse.
+// Its holes read back as zeros.
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSparseFile is writeRegular for sparse members: blocks of zeros are
+// skipped rather than written, so the file system leaves holes there.
+func writeSparseFile(target string, r io.Reader) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 16*sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+	var off int64
+	for filled := 0; ; {
+		n, err := r.Read(buf[filled:])
+		filled += n
+		if err == nil && filled < len(buf) {
+			continue
+		}
+		// Only the last read leaves a partial buffer, so blocks stay aligned.
+		for i := 0; i < filled; i += sparseBlockSize {
+			block := buf[i:min(i+sparseBlockSize, filled)]
+			if !bytes.Equal(block, zeros[:len(block)]) {
+				if _, err := out.WriteAt(block, off); err != nil {
+					out.Close()
+					return err
+				}
+			}
+			off += int64(len(block))
+		}
+		filled = 0
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	// Extends the file over a trailing hole.
+	if err := out.Truncate(off); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
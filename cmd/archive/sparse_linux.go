@@ -0,0 +1,47 @@
+package archive
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataRegions returns where f, size bytes long, holds data, or nil when
+// it has no holes or the file system cannot tell.
+func dataRegions(f *os.File, size int64) ([]sparseRegion, error) {
+	fd := int(f.Fd())
+	regions := []sparseRegion{}
+	var stored int64
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // a hole up to the end
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		if data >= hole {
+			break
+		}
+		regions = append(regions, sparseRegion{Offset: data, Length: hole - data})
+		stored += hole - data
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if stored == size {
+		return nil, nil
+	}
+	return regions, nil
+}
@@ -0,0 +1,251 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// makeSparse creates a file of size bytes with data only at the offsets.
+func makeSparse(t *testing.T, path string, size int64, offsets ...int64) []byte {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	for _, off := range offsets {
+		data := bytes.Repeat([]byte{byte(off>>16) | 1}, 10000)
+		if _, err := f.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+		copy(want[off:], data)
+	}
+	return want
+}
+
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestSparseRoundTrip(t *testing.T) {
+	const size = 8 << 20
+	src := t.TempDir()
+	files := map[string][]byte{
+		"image.raw": makeSparse(t, filepath.Join(src, "image.raw"), size, 1<<20, 5<<20),
+		"tail.raw":  makeSparse(t, filepath.Join(src, "tail.raw"), size, 0),
+		"empty.raw": makeSparse(t, filepath.Join(src, "empty.raw"), size),
+	}
+	f, _ := os.Open(filepath.Join(src, "image.raw"))
+	regions, err := dataRegions(f, size)
+	f.Close()
+	if err != nil || regions == nil {
+		t.Skipf("file system does not report holes: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 1<<20 {
+		t.Errorf("sparse files took %d bytes", buf.Len())
+	}
+
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, ok := files[hdr.Name]; !ok || hdr.Size != size || !bytes.Equal(data, want) {
+			t.Errorf("%s: size %d, content matches %v", hdr.Name, hdr.Size, bytes.Equal(data, want))
+		}
+	}
+
+	dest := t.TempDir()
+	if err := UntarStream(&buf, dest); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		path := filepath.Join(dest, name)
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content differs", name)
+		}
+		if n := allocated(t, path); n > size/4 {
+			t.Errorf("%s: %d bytes allocated", name, n)
+		}
+	}
+}
+
+func TestSparseFallsBackForOtherDialects(t *testing.T) {
+	src := t.TempDir()
+	want := makeSparse(t, filepath.Join(src, "disk.img"), 1<<20, 4096)
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{Dialect: tar.FormatGNU}); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(tr)
+	if hdr.Name != "disk.img" || len(hdr.PAXRecords) != 0 || !bytes.Equal(data, want) {
+		t.Errorf("GNU entry %+v", hdr)
+	}
+}
+
+func TestSparseNonASCIIName(t *testing.T) {
+	src := t.TempDir()
+	want := makeSparse(t, filepath.Join(src, "données.img"), 1<<20, 4096)
+	f, _ := os.Open(filepath.Join(src, "données.img"))
+	regions, err := dataRegions(f, 1<<20)
+	f.Close()
+	if err != nil || regions == nil {
+		t.Skipf("file system does not report holes: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 64<<10 {
+		t.Errorf("sparse file took %d bytes", buf.Len())
+	}
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(tr)
+	if hdr.Name != "données.img" || !bytes.Equal(data, want) {
+		t.Errorf("entry %q, content matches %v", hdr.Name, bytes.Equal(data, want))
+	}
+}
+
+// headWriter keeps the first bytes written to it and counts the rest.
+type headWriter struct {
+	head []byte
+	n    int64
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if room := 64<<10 - len(w.head); room > 0 {
+		w.head = append(w.head, p[:min(room, len(p))]...)
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestSparseBeyondUSTARSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("stores 8 GiB")
+	}
+	const size = 9 << 30
+	name := filepath.Join(t.TempDir(), "vm.img")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	// The regions are holes on disk, but are stored as data all the same.
+	regions := []sparseRegion{{Offset: 0, Length: ustarMaxSize + 1}}
+	var out headWriter
+	tw := tar.NewWriter(&out)
+	hdr := &tar.Header{Name: "vm.img", Typeflag: tar.TypeReg, Size: size, Mode: 0644, ModTime: time.Unix(1700000000, 0)}
+	if err := (tarEntryWriter{tw, &out, false}).writeSparse(hdr, f, regions, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.n < ustarMaxSize || out.n >= size {
+		t.Fatalf("wrote %d bytes", out.n)
+	}
+	got, err := tar.NewReader(bytes.NewReader(out.head)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "vm.img" || got.Size != size {
+		t.Errorf("entry %q of %d bytes", got.Name, got.Size)
+	}
+}
+
+func TestSparseBefore1970(t *testing.T) {
+	src := t.TempDir()
+	path := filepath.Join(src, "old.img")
+	want := makeSparse(t, path, 1<<20, 4096)
+	mtime := time.Date(1960, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes(path, mtime, mtime)
+	f, _ := os.Open(path)
+	regions, err := dataRegions(f, 1<<20)
+	f.Close()
+	if err != nil || regions == nil {
+		t.Skipf("file system does not report holes: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := TarFolder(src, &buf, TarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 64<<10 {
+		t.Errorf("sparse file took %d bytes", buf.Len())
+	}
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(tr)
+	if !hdr.ModTime.Equal(mtime) || !bytes.Equal(data, want) {
+		t.Errorf("mtime %v, content matches %v", hdr.ModTime, bytes.Equal(data, want))
+	}
+}
+
+func TestReproducibleIgnoresHoles(t *testing.T) {
+	sparse, dense := t.TempDir(), t.TempDir()
+	want := makeSparse(t, filepath.Join(sparse, "disk.img"), 1<<20, 4096)
+	os.WriteFile(filepath.Join(dense, "disk.img"), want, 0644)
+
+	opts := TarOptions{Reproducible: &Reproducible{ModTime: time.Unix(1700000000, 0)}}
+	var a, b bytes.Buffer
+	if err := TarFolder(sparse, &a, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := TarFolder(dense, &b, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("the same content with and without holes archived differently")
+	}
+}
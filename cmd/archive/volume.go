@@ -0,0 +1,373 @@
+package archive
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A volume set splits one output into base.001, base.002, ... of at most
+// VolumeSize bytes each. base.manifest lists the volumes with their sizes
+// and hashes, so that a reader can tell a missing, truncated, damaged or
+// misplaced volume apart and name it. The volumes themselves are plain
+// slices: concatenated they are the original archive.
+
+const volumeSetVersion = 1
+
+// ErrVolumeSet is wrapped by errors about an incomplete or damaged volume
+// set.
+var ErrVolumeSet = errors.New("volume set is incomplete or damaged")
+
+// VolumeManifestName returns the manifest path of the volume set base.
+func VolumeManifestName(base string) string {
+	return base + ".manifest"
+}
+
+func volumeName(base string, n int) string {
+	return fmt.Sprintf("%s.%03d", base, n)
+}
+
+// VolumeInfo describes one volume of a set.
+type VolumeInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// VolumeManifest describes a volume set. Volume names are relative to the
+// manifest so that sets can be moved.
+type VolumeManifest struct {
+	Version    int          `json:"version"`
+	ID         string       `json:"id"`
+	VolumeSize int64        `json:"volume_size"`
+	TotalSize  int64        `json:"total_size"`
+	Volumes    []VolumeInfo `json:"volumes"`
+}
+
+// VolumeProblem names a volume and what is wrong with it.
+type VolumeProblem struct {
+	Volume  int    `json:"volume"`
+	Name    string `json:"name"`
+	Problem string `json:"problem"`
+}
+
+// VolumeError reports the damaged volumes of a set.
+type VolumeError struct {
+	Problems []VolumeProblem
+}
+
+func (e *VolumeError) Error() string {
+	parts := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		parts[i] = fmt.Sprintf("volume %d (%s): %s", p.Volume, p.Name, p.Problem)
+	}
+	return fmt.Sprintf("%v: %s", ErrVolumeSet, strings.Join(parts, "; "))
+}
+
+func (e *VolumeError) Unwrap() error {
+	return ErrVolumeSet
+}
+
+// VolumeWriter writes a volume set, starting a new volume whenever the
+// current one reaches the volume size. Close writes the manifest.
+type VolumeWriter struct {
+	base     string
+	size     int64
+	cur      *os.File
+	curSize  int64
+	hash     hash.Hash
+	manifest VolumeManifest
+}
+
+// NewVolumeWriter starts the volume set base with volumes of at most size
+// bytes.
+func NewVolumeWriter(base string, size int64) (*VolumeWriter, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("volume size must be positive, got %d", size)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &VolumeWriter{
+		base: base,
+		size: size,
+		manifest: VolumeManifest{
+			Version:    volumeSetVersion,
+			ID:         hex.EncodeToString(id),
+			VolumeSize: size,
+		},
+	}, nil
+}
+
+func (w *VolumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if w.cur == nil || w.curSize == w.size {
+			if err := w.next(); err != nil {
+				return n - len(p), err
+			}
+		}
+		chunk := p[:min(int64(len(p)), w.size-w.curSize)]
+		k, err := w.cur.Write(chunk)
+		w.hash.Write(chunk[:k])
+		w.curSize += int64(k)
+		w.manifest.TotalSize += int64(k)
+		p = p[k:]
+		if err != nil {
+			return n - len(p), err
+		}
+	}
+	return n, nil
+}
+
+// next finishes the current volume and opens the following one.
+func (w *VolumeWriter) next() error {
+	if err := w.finishVolume(); err != nil {
+		return err
+	}
+	name := volumeName(w.base, len(w.manifest.Volumes)+1)
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.cur, w.curSize, w.hash = f, 0, sha256.New()
+	return nil
+}
+
+func (w *VolumeWriter) finishVolume() error {
+	if w.cur == nil {
+		return nil
+	}
+	err := w.cur.Close()
+	w.manifest.Volumes = append(w.manifest.Volumes, VolumeInfo{
+		Name:   filepath.Base(w.cur.Name()),
+		Size:   w.curSize,
+		SHA256: hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	w.cur = nil
+	return err
+}
+
+// Close finishes the last volume and writes the manifest. An empty output
+// still gets one, empty, volume.
+func (w *VolumeWriter) Close() error {
+	if w.cur == nil && len(w.manifest.Volumes) == 0 {
+		if err := w.next(); err != nil {
+			return err
+		}
+	}
+	if err := w.finishVolume(); err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(VolumeManifestName(w.base), encoded)
+}
+
+// Abort stops writing the set and removes the volumes written so far,
+// without writing a manifest.
+func (w *VolumeWriter) Abort() error {
+	var first error
+	if w.cur != nil {
+		first = w.cur.Close()
+		if err := os.Remove(w.cur.Name()); err != nil && first == nil {
+			first = err
+		}
+		w.cur = nil
+	}
+	for _, v := range w.manifest.Volumes {
+		err := os.Remove(filepath.Join(filepath.Dir(w.base), v.Name))
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	w.manifest.Volumes = nil
+	return first
+}
+
+// Manifest returns the manifest of a closed writer.
+func (w *VolumeWriter) Manifest() VolumeManifest {
+	return w.manifest
+}
+
+// ReadVolumeManifest reads the manifest of the volume set base.
+func ReadVolumeManifest(base string) (*VolumeManifest, error) {
+	data, err := os.ReadFile(VolumeManifestName(base))
+	if err != nil {
+		return nil, err
+	}
+	m := new(VolumeManifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %v", ErrVolumeSet, err)
+	}
+	if m.Version != volumeSetVersion {
+		return nil, fmt.Errorf("%w: volume set version %d", ErrUnsupportedFormat, m.Version)
+	}
+	for _, v := range m.Volumes {
+		if v.Name != filepath.Base(v.Name) || v.Name == "." || v.Name == ".." {
+			return nil, fmt.Errorf("%w: volume name %q", ErrVolumeSet, v.Name)
+		}
+	}
+	return m, nil
+}
+
+// checkVolume compares volume i of the set with its manifest entry. A
+// volume holding the data of another one is reported as misplaced.
+func (m *VolumeManifest) checkVolume(dir string, i int, hashed bool) (string, error) {
+	v := m.Volumes[i]
+	path := filepath.Join(dir, v.Name)
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != v.Size {
+		return fmt.Sprintf("size is %d, expected %d", info.Size(), v.Size), nil
+	}
+	if !hashed {
+		return "", nil
+	}
+	sum, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+	return m.hashProblem(i, sum), nil
+}
+
+// hashProblem compares the hash of volume i's data with the manifest.
+func (m *VolumeManifest) hashProblem(i int, sum string) string {
+	if sum == m.Volumes[i].SHA256 {
+		return ""
+	}
+	for j, other := range m.Volumes {
+		if j != i && other.SHA256 == sum {
+			return fmt.Sprintf("holds the data of volume %d", j+1)
+		}
+	}
+	return "content does not match the manifest"
+}
+
+// check reports the problems of all volumes; hashed also reads their data.
+func (m *VolumeManifest) check(dir string, hashed bool) error {
+	var problems []VolumeProblem
+	for i, v := range m.Volumes {
+		problem, err := m.checkVolume(dir, i, hashed)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			problems = append(problems, VolumeProblem{Volume: i + 1, Name: v.Name, Problem: problem})
+		}
+	}
+	if len(problems) > 0 {
+		return &VolumeError{Problems: problems}
+	}
+	return nil
+}
+
+// VerifyVolumes checks every volume of the set base against the manifest
+// and returns a *VolumeError naming the ones that are not intact.
+func VerifyVolumes(base string) error {
+	m, err := ReadVolumeManifest(base)
+	if err != nil {
+		return err
+	}
+	return m.check(filepath.Dir(base), true)
+}
+
+// OpenVolumes returns the concatenated data of the volume set base. Missing
+// and truncated volumes are reported up front. Each volume is hashed as it
+// is read, and one that does not match the manifest fails the read at its
+// end with a *VolumeError naming it; its data has been returned by then, so
+// readers must not trust anything before a clean io.EOF.
+func OpenVolumes(base string) (io.ReadCloser, error) {
+	m, err := ReadVolumeManifest(base)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(base)
+	if err := m.check(dir, false); err != nil {
+		return nil, err
+	}
+	return &volumeReader{manifest: m, dir: dir}, nil
+}
+
+type volumeReader struct {
+	manifest *VolumeManifest
+	dir      string
+	next     int
+	cur      *os.File
+	body     io.Reader
+	hash     hash.Hash
+	read     int64
+}
+
+func (r *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next == len(r.manifest.Volumes) {
+				return 0, io.EOF
+			}
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.read += int64(n)
+		if err == io.EOF {
+			err = r.finish()
+			if n == 0 && err == nil {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+func (r *volumeReader) open() error {
+	f, err := os.Open(filepath.Join(r.dir, r.manifest.Volumes[r.next].Name))
+	if err != nil {
+		return err
+	}
+	r.cur, r.hash, r.read = f, sha256.New(), 0
+	r.body = io.TeeReader(f, r.hash)
+	r.next++
+	return nil
+}
+
+// finish closes the volume just read and checks what came out of it.
+func (r *volumeReader) finish() error {
+	r.cur.Close()
+	r.cur = nil
+	i := r.next - 1
+	v := r.manifest.Volumes[i]
+	problem := r.manifest.hashProblem(i, hex.EncodeToString(r.hash.Sum(nil)))
+	if r.read != v.Size {
+		problem = fmt.Sprintf("size is %d, expected %d", r.read, v.Size)
+	}
+	if problem != "" {
+		return &VolumeError{Problems: []VolumeProblem{{Volume: i + 1, Name: v.Name, Problem: problem}}}
+	}
+	return nil
+}
+
+func (r *volumeReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
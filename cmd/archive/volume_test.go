@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeVolumes(t *testing.T, base string, data []byte, size int64) {
+	t.Helper()
+	w, err := NewVolumeWriter(base, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func volumeProblems(t *testing.T, err error) []VolumeProblem {
+	t.Helper()
+	var verr *VolumeError
+	if !errors.As(err, &verr) {
+		t.Fatalf("got %v, want *VolumeError", err)
+	}
+	return verr.Problems
+}
+
+func TestVolumesRoundTrip(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "backup.bin")
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(3)).Read(data)
+	writeVolumes(t, base, data, 3000)
+
+	m, err := ReadVolumeManifest(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Volumes) != 4 || m.Volumes[3].Size != 1000 || m.TotalSize != 10000 {
+		t.Fatalf("manifest = %+v", m)
+	}
+	r, err := OpenVolumes(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back %d bytes, %v", len(got), err)
+	}
+	if err := VerifyVolumes(base); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVolumesReportDamage(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "backup.bin")
+	data := make([]byte, 9000)
+	rand.New(rand.NewSource(4)).Read(data)
+	writeVolumes(t, base, data, 3000)
+
+	// Swapped volumes are named with the data they hold.
+	os.Rename(volumeName(base, 1), base+".tmp")
+	os.Rename(volumeName(base, 2), volumeName(base, 1))
+	os.Rename(base+".tmp", volumeName(base, 2))
+	r, err := OpenVolumes(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	r.Close()
+	if p := volumeProblems(t, err); len(p) != 1 || p[0].Volume != 1 || p[0].Problem != "holds the data of volume 2" {
+		t.Errorf("swapped volumes: %+v", p)
+	}
+
+	// Flipped bits are found by a full check.
+	os.Rename(volumeName(base, 1), base+".tmp")
+	os.Rename(volumeName(base, 2), volumeName(base, 1))
+	os.Rename(base+".tmp", volumeName(base, 2))
+	f, _ := os.OpenFile(volumeName(base, 2), os.O_RDWR, 0)
+	f.WriteAt([]byte{0xff}, 100)
+	f.Close()
+	if p := volumeProblems(t, VerifyVolumes(base)); len(p) != 1 || p[0].Volume != 2 {
+		t.Errorf("damaged volume: %+v", p)
+	}
+	// Reading names the volume once its end is reached.
+	r, err = OpenVolumes(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	r.Close()
+	if p := volumeProblems(t, err); len(p) != 1 || p[0].Volume != 2 || len(got) != 6000 {
+		t.Errorf("damaged volume read: %+v after %d bytes", p, len(got))
+	}
+
+	// Missing volumes are reported before anything is read.
+	os.Remove(volumeName(base, 3))
+	_, err = OpenVolumes(base)
+	if p := volumeProblems(t, err); len(p) != 1 || p[0].Volume != 3 || p[0].Problem != "missing" {
+		t.Errorf("missing volume: %+v", p)
+	}
+	if !errors.Is(err, ErrVolumeSet) {
+		t.Errorf("%v does not wrap ErrVolumeSet", err)
+	}
+}
+
+func TestArchiveToVolumes(t *testing.T) {
+	src := t.TempDir()
+	big := make([]byte, 50000)
+	rand.New(rand.NewSource(5)).Read(big)
+	createTestFiles(t, src, map[string]string{"a.txt": "alpha", "big.bin": string(big)})
+
+	base := filepath.Join(t.TempDir(), "archive.bin")
+	w, err := NewVolumeWriter(base, 16<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Archive(src, w, ArchiveOptions{Passphrase: []byte("volumes")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(w.Manifest().Volumes); n < 3 {
+		t.Fatalf("expected several volumes, got %d", n)
+	}
+
+	r, err := OpenVolumes(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	dest := t.TempDir()
+	if err := Extract(r, dest, Keys{Passphrase: []byte("volumes")}, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dest, "big.bin")); got != string(big) {
+		t.Error("big.bin does not match")
+	}
+}
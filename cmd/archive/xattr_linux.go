@@ -0,0 +1,48 @@
+//go:build linux
+
+package archive
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of path without following a
+// final symlink. Filesystems without xattr support yield an empty map.
+func readXattrs(path string) (map[string]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string]string)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		key := string(name)
+		vsize, err := unix.Lgetxattr(path, key, nil)
+		if err != nil {
+			return nil, err
+		}
+		val := make([]byte, vsize)
+		if vsize, err = unix.Lgetxattr(path, key, val); err != nil {
+			return nil, err
+		}
+		attrs[key] = string(val[:vsize])
+	}
+	return attrs, nil
+}
+
+func writeXattr(path, name, value string) error {
+	return unix.Lsetxattr(path, name, []byte(value), 0)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package archive
+
+import "errors"
+
+func readXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeXattr(path, name, value string) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
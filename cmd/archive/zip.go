@@ -0,0 +1,218 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// ZipOptions controls how ZipFolder walks and stores a source tree.
+type ZipOptions struct {
+	// Filter, FollowSymlinks, Rules, IgnoreFiles, Select, Where and DryRun
+	// behave as in TarOptions.
+	Filter         func(string) bool
+	FollowSymlinks bool
+	Rules          *Rules
+	IgnoreFiles    bool
+	Select         func(relPath string, isDir bool) Verdict
+	Where          Predicate
+	DryRun         *Preview
+	// Method picks zip.Store or zip.Deflate per file; nil uses
+	// DefaultZipMethod.
+	Method func(name string, size int64) uint16
+	// Level is the deflate level; 0 uses the flate default.
+	Level int
+}
+
+// storedExtensions are formats that are already compressed, where deflate
+// only costs time.
+var storedExtensions = map[string]bool{
+	".7z": true, ".bz2": true, ".gz": true, ".jpeg": true, ".jpg": true,
+	".mp3": true, ".mp4": true, ".png": true, ".rar": true, ".tgz": true,
+	".webp": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// DefaultZipMethod stores empty and already-compressed files and deflates
+// everything else.
+func DefaultZipMethod(name string, size int64) uint16 {
+	if size == 0 || storedExtensions[strings.ToLower(path.Ext(name))] {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// ZipFolderFiltered is ZipFolder with only a filter. For the other walking
+// options, call ZipFolder.
+func ZipFolderFiltered(src string, w io.Writer, filter func(string) bool) error {
+	return ZipFolder(src, w, ZipOptions{Filter: filter})
+}
+
+// ZipFolder writes the tree below src to w as a zip archive, walking it
+// exactly as TarFolder does. Symlinks are stored the Info-ZIP way, as
+// entries holding the link target. Zip has no hardlinks, so every name gets
+// its own copy of the data, and FIFOs and device nodes are skipped. Entries
+// of 4 GiB and more, and archives that large, use the ZIP64 extensions.
+func ZipFolder(src string, w io.Writer, opts ZipOptions) error {
+	level := opts.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	walkOpts := TarOptions{
+		Filter:         opts.Filter,
+		FollowSymlinks: opts.FollowSymlinks,
+		Rules:          opts.Rules,
+		IgnoreFiles:    opts.IgnoreFiles,
+		Select:         opts.Select,
+		Where:          opts.Where,
+	}
+	if opts.DryRun != nil {
+		return opts.DryRun.collect(src, walkOpts, "flate", level)
+	}
+
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+
+	method := opts.Method
+	if method == nil {
+		method = DefaultZipMethod
+	}
+	if err := newTreeWalker(zipEntryWriter{zw, method}, walkOpts).run(src); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// zipEntryWriter stores walked entries in a zip archive.
+type zipEntryWriter struct {
+	zw     *zip.Writer
+	method func(name string, size int64) uint16
+}
+
+func (z zipEntryWriter) writeEntry(hdr *tar.Header, path string) error {
+	fh := &zip.FileHeader{Name: hdr.Name, Modified: hdr.ModTime, Method: zip.Store}
+	fh.SetMode(hdr.FileInfo().Mode())
+
+	var body io.Reader
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+	case tar.TypeSymlink:
+		body = strings.NewReader(hdr.Linkname)
+	case tar.TypeReg, tar.TypeLink:
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		fh.SetMode(info.Mode())
+		fh.UncompressedSize64 = uint64(info.Size())
+		fh.Method = z.method(hdr.Name, info.Size())
+		body = f
+	default:
+		slog.Warn("Skipping special file zip cannot store: " + hdr.Name)
+		return nil
+	}
+
+	w, err := z.zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		_, err = io.Copy(w, body)
+	}
+	return err
+}
+
+// maxZipLinkSize bounds the target read from a zip symlink entry.
+const maxZipLinkSize = 4096
+
+// Unzip extracts the zip archive in r below destDir with the same
+// confinement rules and reporting as Untar. Zip records no ownership, so
+// extracted files keep the extracting user as owner.
+func Unzip(r io.ReaderAt, size int64, destDir string, opts ExtractOptions) error {
+	zr, err := zip.NewReader(r, size)
+	// Non-local names are reported by the extractor like any other escape.
+	if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+		return err
+	}
+	x, err := newExtractor(destDir, opts)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		if err := x.extractZip(f); err != nil {
+			return err
+		}
+	}
+	return x.finish()
+}
+
+// errZipLinkTooLong marks symlink entries whose target exceeds
+// maxZipLinkSize.
+var errZipLinkTooLong = errors.New("zip symlink target too long")
+
+// zipHeader describes f as a tar header, reading the target of symlinks from
+// their data, or returns nil for unsupported file types. Zip records no
+// ownership, so Uid and Gid are -1, which leaves ownership untouched when
+// extracting as root.
+func zipHeader(f *zip.File) (*tar.Header, error) {
+	var link string
+	if f.Mode()&os.ModeSymlink != 0 {
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(io.LimitReader(rc, maxZipLinkSize+1))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxZipLinkSize {
+			return nil, errZipLinkTooLong
+		}
+		link = string(b)
+	}
+
+	hdr, err := tar.FileInfoHeader(f.FileInfo(), link)
+	if err != nil {
+		// A file type tar cannot describe either.
+		return nil, nil
+	}
+	hdr.Name = f.Name
+	hdr.Uid, hdr.Gid = -1, -1
+	return hdr, nil
+}
+
+func (x *extractor) extractZip(f *zip.File) error {
+	hdr, err := zipHeader(f)
+	if errors.Is(err, errZipLinkTooLong) {
+		x.reject(f.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if hdr == nil {
+		slog.Warn("Skipping unsupported member: " + f.Name)
+		return nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return x.extract(hdr, rc)
+}
@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestZipRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	createTestFiles(t, src, map[string]string{
+		"docs/readme.txt": strings.Repeat("compress me ", 100),
+		"img/photo.png":   "already compressed",
+		"skip.log":        "filtered out",
+	})
+	filter := func(name string) bool { return !strings.HasSuffix(name, ".log") }
+
+	var buf bytes.Buffer
+	if err := ZipFolderFiltered(src, &buf, filter); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := map[string]uint16{}
+	for _, f := range zr.File {
+		methods[f.Name] = f.Method
+	}
+	if _, ok := methods["skip.log"]; ok {
+		t.Error("filtered file was stored")
+	}
+	if methods["docs/readme.txt"] != zip.Deflate || methods["img/photo.png"] != zip.Store {
+		t.Errorf("unexpected methods: %v", methods)
+	}
+	if _, ok := methods["docs/"]; !ok {
+		t.Errorf("directory entry missing: %v", methods)
+	}
+
+	dest := t.TempDir()
+	if err := Unzip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dest, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dest, "docs/readme.txt")); got != strings.Repeat("compress me ", 100) {
+		t.Errorf("readme.txt = %q", got)
+	}
+}
+
+func TestUnzipRejectsEscapingMembers(t *testing.T) {
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "dest")
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"ok.txt", "../evil.txt"} {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(name))
+	}
+	zw.Close()
+
+	err := Unzip(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dest, ExtractOptions{})
+	var unsafe *UnsafeEntriesError
+	if !errors.As(err, &unsafe) || len(unsafe.Members) != 1 {
+		t.Fatalf("expected one rejected member, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "evil.txt")); err == nil {
+		t.Error("evil.txt escaped the destination")
+	}
+}
+
+func TestPipelineZip(t *testing.T) {
+	inputDir := t.TempDir()
+	createTestFiles(t, inputDir, map[string]string{"a/b.txt": "zipped and encrypted"})
+	pass := []byte("zip-pass")
+
+	var buf bytes.Buffer
+	if err := Archive(inputDir, &buf, ArchiveOptions{Format: FormatZip, Passphrase: pass}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The decrypted zip must not be spooled to the temporary directory,
+	// which does not exist here, nor left behind in the destination.
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	outputDir := filepath.Join(t.TempDir(), "out")
+	if err := Extract(bytes.NewReader(buf.Bytes()), outputDir, Keys{Passphrase: pass}, ExtractOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(outputDir, "a/b.txt")); got != "zipped and encrypted" {
+		t.Errorf("b.txt = %q", got)
+	}
+	entries, _ := os.ReadDir(outputDir)
+	for _, e := range entries {
+		if e.Name() != "a" {
+			t.Errorf("%s left in the destination", e.Name())
+		}
+	}
+}
+
+func TestListLargeEncryptedZip(t *testing.T) {
+	inputDir := t.TempDir()
+	big := make([]byte, 80<<20)
+	rand.New(rand.NewSource(11)).Read(big)
+	createTestFiles(t, inputDir, map[string]string{"big.bin": string(big)})
+	pass := []byte("zip-pass")
+
+	var buf bytes.Buffer
+	if err := Archive(inputDir, &buf, ArchiveOptions{Format: FormatZip, Passphrase: pass}); err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	members, err := List(bytes.NewReader(buf.Bytes()), Keys{Passphrase: pass})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Size != int64(len(big)) {
+		t.Errorf("members = %+v", members)
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("spool file left behind: %v", left)
+	}
+}
@@ -1,3 +1,13 @@
 module github.com/ssongin/tartarus
 
 go 1.24.3
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/klauspost/reedsolomon v1.10.0
+	github.com/ulikunitz/xz v0.5.17
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
+)
+
+require github.com/klauspost/cpuid/v2 v2.2.11 // indirect
@@ -11,6 +11,7 @@ type TartarusRouter struct{}
 func (app *TartarusRouter) ApiRouter() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/archive/", http.StripPrefix("/archive", api.GetArchiveRouter()))
+	mux.Handle("/repository/", http.StripPrefix("/repository", api.GetRepositoryRouter()))
 	return mux
 }
 